@@ -4,15 +4,31 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"io"
 	"net/http"
+	"net/url"
 	"tools"
+
+	"github.com/go-chi/chi/v5"
 )
 
 const (
 	authenticationServiceURL = "http://authentication-service/authenticate"
 	loggerServiceURL         = "http://logger-service/log"
+	loggerStatsURL           = "http://logger-service/logs/stats/"
+	mailPreviewURL           = "http://mail-service/preview"
+	mailTemplatesURL         = "http://mail-service/templates"
+	mailMessagesURL          = "http://mail-service/messages/"
 )
 
+// logStats are the statistics of the logger-service that can be fetched
+// through the broker
+var logStats = map[string]bool{
+	"counts": true,
+	"top":    true,
+	"errors": true,
+}
+
 type RequestPayload struct {
 	Action string      `json:"action"`
 	Auth   AuthPayload `json:"auth,omitempty"`
@@ -25,8 +41,9 @@ type AuthPayload struct {
 }
 
 type LogPayload struct {
-	Name string `json:"name"`
-	Data string `json:"data"`
+	Name  string `json:"name"`
+	Level string `json:"level,omitempty"`
+	Data  string `json:"data"`
 }
 
 func (app *Config) Broker(w http.ResponseWriter, r *http.Request) {
@@ -57,6 +74,78 @@ func (app *Config) HandleSubmission(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// LogStats proxies the log statistics endpoints of the logger-service, passing
+// the query parameters along, so the front end only has to talk to the broker
+func (app *Config) LogStats(w http.ResponseWriter, r *http.Request) {
+	kind := chi.URLParam(r, "kind")
+	if !logStats[kind] {
+		_ = app.ErrorJSON(w, errors.New("unknown log statistic"), http.StatusNotFound)
+		return
+	}
+
+	statsURL := loggerStatsURL + kind
+	if r.URL.RawQuery != "" {
+		statsURL += "?" + r.URL.RawQuery
+	}
+
+	request, err := http.NewRequest(http.MethodGet, statsURL, nil)
+	if err != nil {
+		_ = app.ErrorJSON(w, err)
+		return
+	}
+
+	app.setLoggerAPIKey(request)
+	app.forward(w, request)
+}
+
+// MailPreview proxies the template previews of the mail-service, which
+// render a template with sample data without sending anything
+func (app *Config) MailPreview(w http.ResponseWriter, r *http.Request) {
+	app.proxy(w, http.MethodPost, mailPreviewURL, r.Body)
+}
+
+// MailTemplates proxies the list of the templates of the mail-service
+func (app *Config) MailTemplates(w http.ResponseWriter, r *http.Request) {
+	app.proxy(w, http.MethodGet, mailTemplatesURL, nil)
+}
+
+// MailMessage proxies the status of a message of the mail-service, which
+// tells for every recipient whether it was sent to, and why not when it was
+// suppressed, failed or bounced
+func (app *Config) MailMessage(w http.ResponseWriter, r *http.Request) {
+	app.proxy(w, http.MethodGet, mailMessagesURL+url.PathEscape(chi.URLParam(r, "id")), nil)
+}
+
+// proxy sends a request to another service and copies its JSON response
+func (app *Config) proxy(w http.ResponseWriter, method, targetURL string, body io.Reader) {
+	request, err := http.NewRequest(method, targetURL, body)
+	if err != nil {
+		_ = app.ErrorJSON(w, err)
+		return
+	}
+
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	app.forward(w, request)
+}
+
+// forward sends a request to another service and copies its JSON response
+func (app *Config) forward(w http.ResponseWriter, request *http.Request) {
+	client := &http.Client{}
+	response, err := client.Do(request)
+	if err != nil {
+		_ = app.ErrorJSON(w, err, http.StatusBadGateway)
+		return
+	}
+	defer response.Body.Close()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(response.StatusCode)
+	_, _ = io.Copy(w, response.Body)
+}
+
 func (app *Config) logItem(w http.ResponseWriter, entry LogPayload) {
 	jsonData, err := json.MarshalIndent(entry, "", "\t")
 	if err != nil {
@@ -75,6 +164,7 @@ func (app *Config) logItem(w http.ResponseWriter, entry LogPayload) {
 	}
 
 	request.Header.Set("Content-Type", "application/json")
+	app.setLoggerAPIKey(request)
 
 	client := &http.Client{}
 	response, err := client.Do(request)
@@ -96,6 +186,14 @@ func (app *Config) logItem(w http.ResponseWriter, entry LogPayload) {
 	_ = app.WriteJSON(w, http.StatusAccepted, payload)
 }
 
+// setLoggerAPIKey authenticates a request to the logger-service with the
+// LOGGER_API_KEY of the broker, when it is set
+func (app *Config) setLoggerAPIKey(request *http.Request) {
+	if app.LoggerAPIKey != "" {
+		request.Header.Set("X-API-Key", app.LoggerAPIKey)
+	}
+}
+
 func (app *Config) authenticate(w http.ResponseWriter, a AuthPayload) {
 	// TODO: change to just marshall after completion
 	jsonData, _ := json.MarshalIndent(a, "", "\t")
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"tools"
 )
 
@@ -11,11 +12,15 @@ const port = 80
 
 type Config struct {
 	tools.Tools
+	// LoggerAPIKey is sent to the logger-service, which requires an API key
+	// when it has tenants
+	LoggerAPIKey string
 }
 
 func main() {
 	app := Config{
-		Tools: tools.New(),
+		Tools:        tools.New(),
+		LoggerAPIKey: os.Getenv("LOGGER_API_KEY"),
 	}
 
 	log.Printf("Starting broker service on port %d\n", port)
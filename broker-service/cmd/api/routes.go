@@ -28,5 +28,11 @@ func (app *Config) routes() http.Handler {
 
 	mux.Post("/handle", app.HandleSubmission)
 
+	mux.Get("/logs/stats/{kind}", app.LogStats)
+
+	mux.Post("/mail/preview", app.MailPreview)
+	mux.Get("/mail/templates", app.MailTemplates)
+	mux.Get("/mail/messages/{id}", app.MailMessage)
+
 	return mux
 }
@@ -14,6 +14,10 @@ func main() {
 		render(w, "test.page.gohtml")
 	})
 
+	http.HandleFunc("/mail", func(w http.ResponseWriter, r *http.Request) {
+		render(w, "mail.page.gohtml")
+	})
+
 	fmt.Printf("Starting front end service on port %d\n", port)
 	err := http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
 	if err != nil {
@@ -0,0 +1,174 @@
+// Package alert evaluates alert rules against the log entries as they are
+// inserted. A rule fires when more entries than its threshold match within its
+// sliding window, and repeated firings are deduplicated so that a burst of
+// matching entries sends one notification per cooldown instead of one per
+// entry
+package alert
+
+import (
+	"fmt"
+	"log"
+	"logger-service/data"
+	"sync"
+	"time"
+)
+
+// Alert is sent to the notifiers when a rule fires
+type Alert struct {
+	Rule    *data.AlertRule `json:"rule"`
+	Count   int             `json:"count"`
+	FiredAt time.Time       `json:"fired_at"`
+	// Suppressed is the number of times the rule fired during the cooldown
+	// that followed the previous notification
+	Suppressed int `json:"suppressed"`
+	// Entry is the entry that made the rule fire
+	Entry *data.LogEntry `json:"entry"`
+}
+
+// Summary describes the alert in one line, used as the subject of emails
+func (a *Alert) Summary() string {
+	return fmt.Sprintf("Alert %q: %d matching log entries within %s",
+		a.Rule.Name, a.Count, time.Duration(a.Rule.Window)*time.Second)
+}
+
+// Notifier delivers the alerts of the rules
+type Notifier interface {
+	Notify(alert *Alert) error
+}
+
+// Engine holds the alert rules and the recent matches of each of them. Only
+// the entries inserted by this process are counted, each replica of the
+// service evaluates its own share of the inserts
+type Engine struct {
+	notifier Notifier
+
+	mu     sync.Mutex
+	rules  []*data.AlertRule
+	states map[string]*ruleState
+}
+
+// ruleState is the sliding window of a rule and its deduplication state
+type ruleState struct {
+	// updatedAt is the version of the rule the state belongs to, the state
+	// is reset when the rule changes
+	updatedAt time.Time
+	// matches are the times of the latest matching entries, at most one more
+	// than the threshold of the rule is kept
+	matches    []time.Time
+	notifiedAt time.Time
+	suppressed int
+}
+
+// New returns an engine without rules, sending the alerts to notifier
+func New(notifier Notifier) *Engine {
+	return &Engine{
+		notifier: notifier,
+		states:   make(map[string]*ruleState),
+	}
+}
+
+// SetRules replaces the rules of the engine. The windows of the rules that did
+// not change are kept
+func (e *Engine) SetRules(rules []*data.AlertRule) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	states := make(map[string]*ruleState, len(rules))
+	for _, rule := range rules {
+		state, ok := e.states[rule.ID]
+		if !ok || !state.updatedAt.Equal(rule.UpdatedAt) {
+			state = &ruleState{updatedAt: rule.UpdatedAt}
+		}
+
+		states[rule.ID] = state
+	}
+
+	e.rules = rules
+	e.states = states
+}
+
+// Evaluate counts an inserted entry in the windows of the rules it matches and
+// notifies the rules that fire. Notifications are sent in the background
+func (e *Engine) Evaluate(entry *data.LogEntry) {
+	var alerts []*Alert
+
+	now := time.Now()
+
+	e.mu.Lock()
+	for _, rule := range e.rules {
+		if rule.Disabled || !Matches(rule, entry) {
+			continue
+		}
+
+		if alert := e.record(rule, entry, now); alert != nil {
+			alerts = append(alerts, alert)
+		}
+	}
+	e.mu.Unlock()
+
+	for _, alert := range alerts {
+		go func(alert *Alert) {
+			if err := e.notifier.Notify(alert); err != nil {
+				log.Printf("Error notifying alert %q: %v\n", alert.Rule.Name, err)
+			}
+		}(alert)
+	}
+}
+
+// record adds a match to the window of a rule and returns the alert to send,
+// if the rule fires and is not in its cooldown. The caller must hold mu
+func (e *Engine) record(rule *data.AlertRule, entry *data.LogEntry, now time.Time) *Alert {
+	state := e.states[rule.ID]
+
+	window := time.Duration(rule.Window) * time.Second
+
+	// drop the matches that left the window, and the oldest ones beyond what
+	// is needed to know whether the threshold is exceeded
+	matches := append(state.matches, now)
+	start := 0
+	for start < len(matches) && !matches[start].After(now.Add(-window)) {
+		start++
+	}
+	if len(matches)-start > rule.Threshold+1 {
+		start = len(matches) - rule.Threshold - 1
+	}
+	state.matches = append(state.matches[:0], matches[start:]...)
+
+	if len(state.matches) <= rule.Threshold {
+		return nil
+	}
+
+	cooldown := time.Duration(rule.Cooldown) * time.Second
+	if cooldown == 0 {
+		cooldown = window
+	}
+
+	if !state.notifiedAt.IsZero() && now.Sub(state.notifiedAt) < cooldown {
+		state.suppressed++
+		return nil
+	}
+
+	alert := &Alert{
+		Rule:       rule,
+		Count:      len(state.matches),
+		FiredAt:    now,
+		Suppressed: state.suppressed,
+		Entry:      entry,
+	}
+
+	state.notifiedAt = now
+	state.suppressed = 0
+
+	return alert
+}
+
+// Matches reports whether a rule counts the entry. A rule of a tenant only
+// counts the entries of that tenant, the rules without a tenant count every
+// entry
+func Matches(rule *data.AlertRule, entry *data.LogEntry) bool {
+	if rule.Tenant != "" && entry.Tenant != rule.Tenant {
+		return false
+	}
+
+	return rule.Match.Matches(entry)
+}
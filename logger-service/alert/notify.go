@@ -0,0 +1,106 @@
+package alert
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// HTTPNotifier emails the alerts through the mail-service and posts them as
+// JSON to the webhook of the rule
+type HTTPNotifier struct {
+	// MailURL is the send endpoint of the mail-service
+	MailURL string
+	// MailFrom is the sender of the alert emails
+	MailFrom string
+
+	Client *http.Client
+}
+
+// NewHTTPNotifier returns a notifier sending emails through the mail-service
+// at mailURL
+func NewHTTPNotifier(mailURL, mailFrom string) *HTTPNotifier {
+	return &HTTPNotifier{
+		MailURL:  mailURL,
+		MailFrom: mailFrom,
+		Client:   &http.Client{Timeout: time.Second * 10},
+	}
+}
+
+// Notify sends the alert to every destination of its rule and returns the
+// errors of the destinations that failed
+func (n *HTTPNotifier) Notify(alert *Alert) error {
+	var errs []error
+
+	for _, address := range alert.Rule.Notify.Email {
+		if err := n.email(address, alert); err != nil {
+			errs = append(errs, fmt.Errorf("emailing %s: %w", address, err))
+		}
+	}
+
+	if alert.Rule.Notify.Webhook != "" {
+		if err := n.post(alert.Rule.Notify.Webhook, alert); err != nil {
+			errs = append(errs, fmt.Errorf("calling webhook: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// email sends the alert to one address through the mail-service, so that the
+// recipients do not see each other
+func (n *HTTPNotifier) email(address string, alert *Alert) error {
+	var message strings.Builder
+
+	fmt.Fprintf(&message, "%s.\n\n", alert.Summary())
+	fmt.Fprintf(&message, "Fired at: %s\n", alert.FiredAt.UTC().Format(time.RFC3339))
+	if alert.Suppressed > 0 {
+		fmt.Fprintf(&message, "Suppressed since the last notification: %d\n", alert.Suppressed)
+	}
+	if alert.Entry != nil {
+		fmt.Fprintf(&message, "\nLatest entry:\n%s [%s] %s\n", alert.Entry.Name, alert.Entry.Level, alert.Entry.Data)
+	}
+
+	payload := struct {
+		From    string `json:"from"`
+		To      string `json:"to"`
+		Subject string `json:"subject"`
+		Message string `json:"message"`
+	}{
+		From:    n.MailFrom,
+		To:      address,
+		Subject: alert.Summary(),
+		Message: message.String(),
+	}
+
+	return n.post(n.MailURL, payload)
+}
+
+func (n *HTTPNotifier) post(url string, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := n.Client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("unexpected status %s", response.Status)
+	}
+
+	return nil
+}
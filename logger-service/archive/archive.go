@@ -0,0 +1,408 @@
+// Package archive exports log entries to gzip compressed NDJSON files, one
+// file per day and log name, and keeps a manifest with the checksum of every
+// file so that an archive can be verified and imported again later
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"logger-service/data"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+const (
+	manifestPrefix = "manifests/"
+	filesPrefix    = "logs/"
+)
+
+// unsafeKeyChars matches everything that should not end up in an object key
+var unsafeKeyChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// Manifest describes one archive run and the files it produced
+type Manifest struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Entries   int       `json:"entries"`
+	Files     []File    `json:"files"`
+}
+
+// File is one archived file, holding the entries of one log name for one day
+type File struct {
+	Key     string `json:"key"`
+	Name    string `json:"name"`
+	Day     string `json:"day"`
+	Entries int    `json:"entries"`
+	Size    int64  `json:"size"`
+	SHA256  string `json:"sha256"`
+}
+
+// Archive writes and reads archived log files through a Store
+type Archive struct {
+	Store Store
+}
+
+// Save uploads every file of the batch, verifies each upload by reading it
+// back and comparing its checksum, and finally writes the manifest. The
+// entries of the batch must only be deleted once Save returned successfully
+func (a *Archive) Save(batch *Batch) (*Manifest, error) {
+	manifest := &Manifest{
+		ID:        batch.id,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	for i, file := range batch.files {
+		// the index keeps the keys unique when two names map to the same safe key
+		key := fmt.Sprintf("%s%s/%s-%s-%d.ndjson.gz", filesPrefix, file.day, safeKey(file.name), batch.id, i)
+
+		size, sum, err := a.upload(key, file.path)
+		if err != nil {
+			return nil, fmt.Errorf("archiving %s: %w", key, err)
+		}
+
+		manifest.Entries += len(file.ids)
+		manifest.Files = append(manifest.Files, File{
+			Key:     key,
+			Name:    file.name,
+			Day:     file.day,
+			Entries: len(file.ids),
+			Size:    size,
+			SHA256:  sum,
+		})
+	}
+
+	content, err := json.MarshalIndent(manifest, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+
+	key := manifestPrefix + manifest.ID + ".json"
+
+	err = a.Store.Put(key, bytes.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("writing manifest: %w", err)
+	}
+
+	if err = a.verify(key, checksum(content)); err != nil {
+		return nil, fmt.Errorf("writing manifest: %w", err)
+	}
+
+	return manifest, nil
+}
+
+// Manifests returns the manifest of every archive run, oldest first
+func (a *Archive) Manifests() ([]*Manifest, error) {
+	keys, err := a.Store.List(manifestPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	manifests := make([]*Manifest, 0, len(keys))
+	for _, key := range keys {
+		manifest, err := a.manifest(key)
+		if err != nil {
+			return nil, err
+		}
+
+		manifests = append(manifests, manifest)
+	}
+
+	return manifests, nil
+}
+
+// Load reads back every entry of the archive run with the given id. The
+// checksum of each file is checked against the manifest before any of its
+// entries are passed to fn
+func (a *Archive) Load(id string, fn func([]*data.LogEntry) error) error {
+	manifest, err := a.manifest(manifestPrefix + safeKey(id) + ".json")
+	if err != nil {
+		return err
+	}
+
+	for _, file := range manifest.Files {
+		entries, err := a.readFile(file)
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", file.Key, err)
+		}
+
+		if err = fn(entries); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// upload writes the file at path under key and verifies the stored copy
+func (a *Archive) upload(key, path string) (int64, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	counter := &countingWriter{}
+
+	err = a.Store.Put(key, io.TeeReader(file, io.MultiWriter(hash, counter)))
+	if err != nil {
+		return 0, "", err
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if err = a.verify(key, sum); err != nil {
+		return 0, "", err
+	}
+
+	return counter.n, sum, nil
+}
+
+// verify reads back the object stored under key and compares its checksum
+func (a *Archive) verify(key, sum string) error {
+	object, err := a.Store.Get(key)
+	if err != nil {
+		return err
+	}
+	defer object.Close()
+
+	hash := sha256.New()
+	if _, err = io.Copy(hash, object); err != nil {
+		return err
+	}
+
+	if stored := hex.EncodeToString(hash.Sum(nil)); stored != sum {
+		return fmt.Errorf("checksum mismatch, expected %s but stored object has %s", sum, stored)
+	}
+
+	return nil
+}
+
+func (a *Archive) manifest(key string) (*Manifest, error) {
+	object, err := a.Store.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+
+	var manifest Manifest
+	if err = json.NewDecoder(object).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("reading manifest %s: %w", key, err)
+	}
+
+	return &manifest, nil
+}
+
+// readFile downloads one archived file, checks it against the manifest and
+// decodes its entries
+func (a *Archive) readFile(file File) ([]*data.LogEntry, error) {
+	object, err := a.Store.Get(file.Key)
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+
+	content, err := io.ReadAll(object)
+	if err != nil {
+		return nil, err
+	}
+
+	if sum := checksum(content); sum != file.SHA256 {
+		return nil, fmt.Errorf("checksum mismatch, expected %s but archived file has %s", file.SHA256, sum)
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	var entries []*data.LogEntry
+
+	decoder := json.NewDecoder(reader)
+	for {
+		var entry data.LogEntry
+
+		err := decoder.Decode(&entry)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, &entry)
+	}
+
+	return entries, nil
+}
+
+// Batch collects log entries into compressed NDJSON files in a temporary
+// directory, one file per day and log name, ready to be saved to an Archive.
+// Entries must be added in order of creation
+type Batch struct {
+	id    string
+	dir   string
+	day   string
+	files []*batchFile
+	open  map[string]*batchFile
+}
+
+type batchFile struct {
+	name string
+	day  string
+	path string
+	ids  []string
+
+	file    *os.File
+	buffer  *bufio.Writer
+	gzip    *gzip.Writer
+	encoder *json.Encoder
+}
+
+// NewBatch creates an empty batch. Remove must be called once the batch is no
+// longer needed to clean up its temporary files
+func NewBatch() (*Batch, error) {
+	dir, err := os.MkdirTemp("", "logs-archive-*")
+	if err != nil {
+		return nil, err
+	}
+
+	return &Batch{
+		id:   newID(),
+		dir:  dir,
+		open: make(map[string]*batchFile),
+	}, nil
+}
+
+// Add writes one entry to the file of its day and name. The files of the
+// previous day are finished as soon as an entry of a new day is added
+func (b *Batch) Add(entry *data.LogEntry) error {
+	day := entry.CreatedAt.UTC().Format("2006-01-02")
+
+	if day != b.day {
+		if err := b.finish(); err != nil {
+			return err
+		}
+		b.day = day
+	}
+
+	file, ok := b.open[entry.Name]
+	if !ok {
+		path := filepath.Join(b.dir, fmt.Sprintf("%s-%d.ndjson.gz", day, len(b.files)))
+
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+
+		file = &batchFile{name: entry.Name, day: day, path: path, file: f}
+		file.buffer = bufio.NewWriter(f)
+		file.gzip = gzip.NewWriter(file.buffer)
+		file.encoder = json.NewEncoder(file.gzip)
+
+		b.open[entry.Name] = file
+		b.files = append(b.files, file)
+	}
+
+	if err := file.encoder.Encode(entry); err != nil {
+		return err
+	}
+
+	file.ids = append(file.ids, entry.ID)
+
+	return nil
+}
+
+// Close finishes the files that are still being written
+func (b *Batch) Close() error {
+	return b.finish()
+}
+
+// Len returns the number of entries added to the batch
+func (b *Batch) Len() int {
+	n := 0
+	for _, file := range b.files {
+		n += len(file.ids)
+	}
+
+	return n
+}
+
+// IDs returns the ids of every entry added to the batch
+func (b *Batch) IDs() []string {
+	var ids []string
+	for _, file := range b.files {
+		ids = append(ids, file.ids...)
+	}
+
+	return ids
+}
+
+// Remove deletes the temporary files of the batch
+func (b *Batch) Remove() error {
+	_ = b.finish()
+
+	return os.RemoveAll(b.dir)
+}
+
+// finish flushes and closes every open file
+func (b *Batch) finish() error {
+	for name, file := range b.open {
+		delete(b.open, name)
+
+		err := file.gzip.Close()
+		if err == nil {
+			err = file.buffer.Flush()
+		}
+		if closeErr := file.file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+func checksum(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// newID returns a sortable, unique id for an archive run
+func newID() string {
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+
+	return time.Now().UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(suffix)
+}
+
+// safeKey replaces the characters of s that are not safe in an object key
+func safeKey(s string) string {
+	s = unsafeKeyChars.ReplaceAllString(s, "_")
+	if s == "" {
+		return "_"
+	}
+
+	return s
+}
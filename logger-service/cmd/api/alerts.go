@@ -0,0 +1,253 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"logger-service/alert"
+	"logger-service/data"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"time"
+	"tools"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	// defaultMailServiceURL is used when MAIL_SERVICE_URL is not set
+	defaultMailServiceURL = "http://mail-service/send"
+
+	// defaultAlertMailFrom is used when ALERT_MAIL_FROM is not set
+	defaultAlertMailFrom = "alerts@logger-service"
+
+	// alertRulesRefreshInterval is how often the alert rules are reloaded, so
+	// that changes made through another replica are picked up
+	alertRulesRefreshInterval = time.Minute
+)
+
+type AlertRulePayload struct {
+	Name      string           `json:"name"`
+	Match     data.AlertMatch  `json:"match"`
+	Threshold int              `json:"threshold"`
+	Window    int64            `json:"window_seconds"`
+	Cooldown  int64            `json:"cooldown_seconds"`
+	Notify    data.AlertNotify `json:"notify"`
+	Disabled  bool             `json:"disabled"`
+}
+
+// createAlerts returns the engine evaluating the alert rules, which notifies
+// through the mail-service at MAIL_SERVICE_URL and the webhooks of the rules
+func createAlerts() *alert.Engine {
+	mailURL := os.Getenv("MAIL_SERVICE_URL")
+	if mailURL == "" {
+		mailURL = defaultMailServiceURL
+	}
+
+	from := os.Getenv("ALERT_MAIL_FROM")
+	if from == "" {
+		from = defaultAlertMailFrom
+	}
+
+	return alert.New(alert.NewHTTPNotifier(mailURL, from))
+}
+
+// GetAlertRules lists the alert rules of the caller
+func (app *Config) GetAlertRules(w http.ResponseWriter, r *http.Request) {
+	models := app.tenantModels(r)
+
+	rules, err := models.AlertRule.All()
+	if err != nil {
+		_ = app.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := tools.JsonResponse{
+		Error:   false,
+		Message: "alert rules",
+		Data:    rules,
+	}
+
+	_ = app.WriteJSON(w, http.StatusOK, resp)
+}
+
+// GetAlertRule returns one alert rule by id
+func (app *Config) GetAlertRule(w http.ResponseWriter, r *http.Request) {
+	models := app.tenantModels(r)
+
+	rule, err := models.AlertRule.GetOne(chi.URLParam(r, "id"))
+	if err != nil {
+		app.alertRuleError(w, err)
+		return
+	}
+
+	resp := tools.JsonResponse{
+		Error:   false,
+		Message: "alert rule",
+		Data:    rule,
+	}
+
+	_ = app.WriteJSON(w, http.StatusOK, resp)
+}
+
+// CreateAlertRule adds an alert rule for the entries of the caller
+func (app *Config) CreateAlertRule(w http.ResponseWriter, r *http.Request) {
+	rule, err := app.readAlertRule(w, r)
+	if err != nil {
+		_ = app.ErrorJSON(w, err)
+		return
+	}
+
+	models := app.tenantModels(r)
+
+	saved, err := models.AlertRule.Insert(*rule)
+	if err != nil {
+		_ = app.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.loadAlertRules()
+
+	resp := tools.JsonResponse{
+		Error:   false,
+		Message: "alert rule created",
+		Data:    saved,
+	}
+
+	_ = app.WriteJSON(w, http.StatusCreated, resp)
+}
+
+// UpdateAlertRule replaces an alert rule. Its window starts over
+func (app *Config) UpdateAlertRule(w http.ResponseWriter, r *http.Request) {
+	rule, err := app.readAlertRule(w, r)
+	if err != nil {
+		_ = app.ErrorJSON(w, err)
+		return
+	}
+
+	rule.ID = chi.URLParam(r, "id")
+
+	models := app.tenantModels(r)
+
+	saved, err := models.AlertRule.Update(*rule)
+	if err != nil {
+		app.alertRuleError(w, err)
+		return
+	}
+
+	app.loadAlertRules()
+
+	resp := tools.JsonResponse{
+		Error:   false,
+		Message: "alert rule saved",
+		Data:    saved,
+	}
+
+	_ = app.WriteJSON(w, http.StatusAccepted, resp)
+}
+
+// DeleteAlertRule removes an alert rule
+func (app *Config) DeleteAlertRule(w http.ResponseWriter, r *http.Request) {
+	models := app.tenantModels(r)
+
+	err := models.AlertRule.DeleteByID(chi.URLParam(r, "id"))
+	if err != nil {
+		app.alertRuleError(w, err)
+		return
+	}
+
+	app.loadAlertRules()
+
+	resp := tools.JsonResponse{
+		Error:   false,
+		Message: "alert rule deleted",
+	}
+
+	_ = app.WriteJSON(w, http.StatusAccepted, resp)
+}
+
+// readAlertRule reads and validates the alert rule in the request body
+func (app *Config) readAlertRule(w http.ResponseWriter, r *http.Request) (*data.AlertRule, error) {
+	var requestPayload AlertRulePayload
+
+	if err := app.ReadJSON(w, r, &requestPayload); err != nil {
+		return nil, err
+	}
+
+	if requestPayload.Name == "" {
+		return nil, errors.New("name is required")
+	}
+
+	if requestPayload.Threshold < 0 {
+		return nil, errors.New("threshold must not be negative")
+	}
+
+	if requestPayload.Window <= 0 {
+		return nil, errors.New("window_seconds must be greater than zero")
+	}
+
+	if requestPayload.Cooldown < 0 {
+		return nil, errors.New("cooldown_seconds must not be negative")
+	}
+
+	notify := requestPayload.Notify
+	if len(notify.Email) == 0 && notify.Webhook == "" {
+		return nil, errors.New("notify needs at least one email address or a webhook")
+	}
+
+	for _, address := range notify.Email {
+		if _, err := mail.ParseAddress(address); err != nil {
+			return nil, fmt.Errorf("invalid email address %q", address)
+		}
+	}
+
+	if notify.Webhook != "" {
+		webhook, err := url.Parse(notify.Webhook)
+		if err != nil || (webhook.Scheme != "http" && webhook.Scheme != "https") || webhook.Host == "" {
+			return nil, errors.New("webhook must be an http or https URL")
+		}
+	}
+
+	return &data.AlertRule{
+		Name:      requestPayload.Name,
+		Match:     requestPayload.Match,
+		Threshold: requestPayload.Threshold,
+		Window:    requestPayload.Window,
+		Cooldown:  requestPayload.Cooldown,
+		Notify:    notify,
+		Disabled:  requestPayload.Disabled,
+	}, nil
+}
+
+func (app *Config) alertRuleError(w http.ResponseWriter, err error) {
+	if errors.Is(err, data.ErrNotFound) {
+		_ = app.ErrorJSON(w, errors.New("alert rule not found"), http.StatusNotFound)
+		return
+	}
+
+	_ = app.ErrorJSON(w, err, http.StatusInternalServerError)
+}
+
+// loadAlertRules gives the alert engine the current rules of every tenant
+func (app *Config) loadAlertRules() {
+	rules, err := app.Models.AlertRule.All()
+	if err != nil {
+		log.Println("Error loading alert rules:", err)
+		return
+	}
+
+	app.Alerts.SetRules(rules)
+}
+
+// refreshAlertRules periodically reloads the alert rules, so changes made
+// through another replica are picked up
+func (app *Config) refreshAlertRules(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		app.loadAlertRules()
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"logger-service/archive"
+	"logger-service/data"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+	"tools"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// deleteChunkSize is the number of archived entries deleted per query, keeping
+// the list of ids well under the maximum size of a MongoDB document
+const deleteChunkSize = 1000
+
+// archiveMu makes sure only one archive run happens at a time
+var archiveMu sync.Mutex
+
+var errArchiveDisabled = errors.New("archiving is not configured")
+
+type ArchivePayload struct {
+	Name   string    `json:"name"`
+	Before time.Time `json:"before"`
+}
+
+// ArchiveLogs exports the entries created before the given cutoff to the
+// archive and deletes them once the archive has been verified
+func (app *Config) ArchiveLogs(w http.ResponseWriter, r *http.Request) {
+	if app.Archive == nil {
+		_ = app.ErrorJSON(w, errArchiveDisabled, http.StatusNotImplemented)
+		return
+	}
+
+	var requestPayload ArchivePayload
+
+	err := app.ReadJSON(w, r, &requestPayload)
+	if err != nil {
+		_ = app.ErrorJSON(w, err)
+		return
+	}
+
+	if requestPayload.Before.IsZero() {
+		_ = app.ErrorJSON(w, errors.New("before is required"))
+		return
+	}
+
+	manifest, err := app.archiveLogs(data.Filter{
+		Name: requestPayload.Name,
+		To:   requestPayload.Before,
+	})
+	if err != nil {
+		_ = app.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := tools.JsonResponse{
+		Error:   false,
+		Message: "logs archived",
+		Data:    manifest,
+	}
+
+	_ = app.WriteJSON(w, http.StatusAccepted, resp)
+}
+
+// GetArchives lists the manifests of the previous archive runs
+func (app *Config) GetArchives(w http.ResponseWriter, r *http.Request) {
+	if app.Archive == nil {
+		_ = app.ErrorJSON(w, errArchiveDisabled, http.StatusNotImplemented)
+		return
+	}
+
+	manifests, err := app.Archive.Manifests()
+	if err != nil {
+		_ = app.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := tools.JsonResponse{
+		Error:   false,
+		Message: "archives",
+		Data:    manifests,
+	}
+
+	_ = app.WriteJSON(w, http.StatusOK, resp)
+}
+
+// ImportArchive puts the entries of an archive run back into the logs
+// collection. Entries that are still present are left untouched
+func (app *Config) ImportArchive(w http.ResponseWriter, r *http.Request) {
+	if app.Archive == nil {
+		_ = app.ErrorJSON(w, errArchiveDisabled, http.StatusNotImplemented)
+		return
+	}
+
+	restored := 0
+	err := app.Archive.Load(chi.URLParam(r, "id"), func(entries []*data.LogEntry) error {
+		n, err := app.Models.LogEntry.Restore(entries)
+		restored += n
+		return err
+	})
+	if err != nil {
+		if errors.Is(err, archive.ErrNotFound) {
+			_ = app.ErrorJSON(w, errors.New("archive not found"), http.StatusNotFound)
+			return
+		}
+
+		_ = app.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := tools.JsonResponse{
+		Error:   false,
+		Message: "archive imported",
+		Data:    map[string]int{"restored": restored},
+	}
+
+	_ = app.WriteJSON(w, http.StatusAccepted, resp)
+}
+
+// archiveLogs writes the entries matched by the filter to the archive and
+// deletes them, but only after every archived file has been verified. It
+// returns nil when there was nothing to archive
+func (app *Config) archiveLogs(filter data.Filter) (*archive.Manifest, error) {
+	archiveMu.Lock()
+	defer archiveMu.Unlock()
+
+	batch, err := archive.NewBatch()
+	if err != nil {
+		return nil, err
+	}
+	defer batch.Remove()
+
+	err = app.Models.LogEntry.Each(filter, batch.Add)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = batch.Close(); err != nil {
+		return nil, err
+	}
+
+	if batch.Len() == 0 {
+		return nil, nil
+	}
+
+	manifest, err := app.Archive.Save(batch)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := batch.IDs()
+	for start := 0; start < len(ids); start += deleteChunkSize {
+		end := min(start+deleteChunkSize, len(ids))
+
+		_, err = app.Models.LogEntry.DeleteByIDs(ids[start:end])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	log.Printf("Archived %d log entries in %d files (%s)\n", manifest.Entries, len(manifest.Files), manifest.ID)
+
+	return manifest, nil
+}
+
+// createArchive sets up the archive from the environment. Files are written
+// to ARCHIVE_DIR, or to the bucket ARCHIVE_S3_BUCKET when ARCHIVE_S3_ENDPOINT
+// is set. It returns nil when neither is configured
+func createArchive() *archive.Archive {
+	if endpoint := os.Getenv("ARCHIVE_S3_ENDPOINT"); endpoint != "" {
+		region := os.Getenv("ARCHIVE_S3_REGION")
+		if region == "" {
+			region = "us-east-1"
+		}
+
+		return &archive.Archive{
+			Store: &archive.S3Store{
+				Endpoint:  endpoint,
+				Region:    region,
+				Bucket:    os.Getenv("ARCHIVE_S3_BUCKET"),
+				AccessKey: os.Getenv("ARCHIVE_S3_ACCESS_KEY"),
+				SecretKey: os.Getenv("ARCHIVE_S3_SECRET_KEY"),
+				Client:    &http.Client{Timeout: time.Minute * 5},
+			},
+		}
+	}
+
+	if dir := os.Getenv("ARCHIVE_DIR"); dir != "" {
+		return &archive.Archive{
+			Store: &archive.LocalStore{Dir: dir},
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"logger-service/data"
+	"mime"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+	"tools"
+)
+
+// defaultBulkChunkSize is used when BULK_CHUNK_SIZE is not set
+const defaultBulkChunkSize = 500
+
+type BulkItemResult struct {
+	Index int    `json:"index"`
+	ID    string `json:"id,omitempty"`
+	Error string `json:"error,omitempty"`
+	// NotAttempted is set on the entries that were read but not inserted
+	// because the store failed, which may be sent again
+	NotAttempted bool `json:"not_attempted,omitempty"`
+}
+
+type BulkResponse struct {
+	Inserted     int `json:"inserted"`
+	Failed       int `json:"failed"`
+	NotAttempted int `json:"not_attempted,omitempty"`
+	// StoppedAt is the index of the entry at which the request stopped, on
+	// a syntax error or a store error, and Error is that error. The entries
+	// from there on without a result were not attempted
+	StoppedAt *int             `json:"stopped_at,omitempty"`
+	Error     string           `json:"error,omitempty"`
+	Results   []BulkItemResult `json:"results"`
+}
+
+// bulkStoreError is a failure of the store to insert a chunk of entries, as
+// opposed to a failure to read the body
+type bulkStoreError struct {
+	err error
+}
+
+func (e *bulkStoreError) Error() string {
+	return e.err.Error()
+}
+
+func (e *bulkStoreError) Unwrap() error {
+	return e.err
+}
+
+// bulkInserter collects decoded entries and inserts them in chunks
+type bulkInserter struct {
+	app       *Config
+	request   *http.Request
+	models    data.Models
+	chunkSize int
+	pending   []data.LogEntry
+	indexes   []int
+	response  BulkResponse
+
+	// next is the index of the entry being read
+	next int
+
+	// rateLimited counts the entries rejected by a rate limit, and
+	// retryAfter is the longest wait they were given
+	rateLimited int
+	retryAfter  time.Duration
+}
+
+// WriteLogs inserts many log entries in one request. The body is either a JSON
+// array of log entries or, with a Content-Type of application/x-ndjson, one
+// log entry per line. The result of every entry is reported by its position.
+// When the body cannot be read further or the store fails, the entries read
+// so far are still reported, with the index at which the request stopped, so
+// that a client sends again only the entries that were not inserted
+func (app *Config) WriteLogs(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, int64(app.MaxJSONSize))
+
+	inserter := &bulkInserter{
+		app:       app,
+		request:   r,
+		models:    app.tenantModels(r),
+		chunkSize: app.BulkChunkSize,
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	var err error
+	if mediaType == "application/x-ndjson" || mediaType == "application/jsonl" {
+		err = app.readNDJSON(r, inserter)
+	} else {
+		err = readJSONArray(r, inserter)
+	}
+
+	// the entries read before a syntax error are inserted all the same, a
+	// store error has already stopped the request where it happened
+	var (
+		storeErr    *bulkStoreError
+		maxBytesErr *http.MaxBytesError
+	)
+	if err != nil && !errors.As(err, &storeErr) {
+		stopErr := err
+		if errors.As(err, &maxBytesErr) {
+			stopErr = fmt.Errorf("body must not be larger than %d bytes", maxBytesErr.Limit)
+		}
+
+		inserter.stop(inserter.next, stopErr)
+	}
+	if flushErr := inserter.flush(); flushErr != nil {
+		err = flushErr
+	}
+
+	// invalid entries are reported as soon as they are read and the others
+	// once their chunk is inserted, so put the results back in order
+	sort.Slice(inserter.response.Results, func(i, j int) bool {
+		return inserter.response.Results[i].Index < inserter.response.Results[j].Index
+	})
+
+	if err != nil {
+		status := http.StatusBadRequest
+		switch {
+		case errors.As(err, &storeErr):
+			log.Println("Error inserting logs:", err)
+			status = http.StatusInternalServerError
+		case errors.As(err, &maxBytesErr):
+			status = http.StatusRequestEntityTooLarge
+		}
+
+		resp := tools.JsonResponse{
+			Error:   true,
+			Message: fmt.Sprintf("stopped at entry %d after logging %d entries: %s", *inserter.response.StoppedAt, inserter.response.Inserted, inserter.response.Error),
+			Data:    inserter.response,
+		}
+
+		_ = app.WriteJSON(w, status, resp)
+		return
+	}
+
+	status := http.StatusAccepted
+	if inserter.response.Failed > 0 {
+		status = http.StatusMultiStatus
+	}
+	if inserter.rateLimited > 0 {
+		setRetryAfter(w, inserter.retryAfter)
+
+		if inserter.throttled() {
+			status = http.StatusTooManyRequests
+		}
+	}
+
+	resp := tools.JsonResponse{
+		Error:   inserter.response.Inserted == 0 && inserter.response.Failed > 0,
+		Message: fmt.Sprintf("logged %d of %d entries", inserter.response.Inserted, len(inserter.response.Results)),
+		Data:    inserter.response,
+	}
+
+	_ = app.WriteJSON(w, status, resp)
+}
+
+// readJSONArray decodes the body as a JSON array, one element at a time
+func readJSONArray(r *http.Request, inserter *bulkInserter) error {
+	decoder := json.NewDecoder(r.Body)
+
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return errors.New("body must be a JSON array of log entries")
+	}
+
+	index := 0
+	for ; decoder.More(); index++ {
+		inserter.next = index
+
+		var payload RequestPayload
+
+		err := decoder.Decode(&payload)
+		if err != nil {
+			var typeErr *json.UnmarshalTypeError
+			if !errors.As(err, &typeErr) {
+				// the rest of the array can not be read after a syntax error
+				return err
+			}
+
+			inserter.fail(index, err)
+			continue
+		}
+
+		if err = inserter.add(index, payload); err != nil {
+			return err
+		}
+	}
+
+	inserter.next = index
+	if _, err = decoder.Token(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// readNDJSON decodes the body one line at a time, a line that is not valid
+// JSON only fails that entry
+func (app *Config) readNDJSON(r *http.Request, inserter *bulkInserter) error {
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), app.MaxJSONSize)
+
+	index := 0
+	for scanner.Scan() {
+		inserter.next = index
+
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var payload RequestPayload
+
+		err := json.Unmarshal(line, &payload)
+		if err != nil {
+			inserter.fail(index, err)
+		} else if err = inserter.add(index, payload); err != nil {
+			return err
+		}
+
+		index++
+	}
+
+	// the line that could not be read
+	inserter.next = index
+
+	return scanner.Err()
+}
+
+// add validates one entry and queues it
+func (b *bulkInserter) add(index int, payload RequestPayload) error {
+	if payload.Name == "" {
+		b.fail(index, errors.New("name is required"))
+		return nil
+	}
+
+	entry := data.LogEntry{
+		Name:  payload.Name,
+		Level: payload.Level,
+		Data:  b.app.redact(payload.Data),
+	}
+
+	return b.queue(index, entry)
+}
+
+// queue counts an entry against the quotas of the tenant and queues it,
+// inserting the queue once it reaches the chunk size
+func (b *bulkInserter) queue(index int, entry data.LogEntry) error {
+	err := b.app.reserve(b.request, entry)
+	if err != nil {
+		var rateErr *rateLimitError
+		if errors.As(err, &rateErr) {
+			b.rateLimited++
+			b.retryAfter = max(b.retryAfter, rateErr.retryAfter)
+		}
+
+		if rateErr != nil || errors.Is(err, errStorageQuota) {
+			b.fail(index, err)
+			return nil
+		}
+
+		return err
+	}
+
+	b.pending = append(b.pending, entry)
+	b.indexes = append(b.indexes, index)
+
+	if len(b.pending) >= b.chunkSize {
+		return b.flush()
+	}
+
+	return nil
+}
+
+// flush inserts the queued entries and records their results
+func (b *bulkInserter) flush() error {
+	if len(b.pending) == 0 {
+		return nil
+	}
+
+	tenant := tenantFrom(b.request)
+
+	ids, folded, failed, err := b.models.LogEntry.InsertMany(b.pending)
+	if err != nil {
+		b.stop(b.indexes[0], err)
+
+		for i, index := range b.indexes {
+			b.app.settle(tenant, b.pending[i], false, err)
+
+			b.response.NotAttempted++
+			b.response.Results = append(b.response.Results, BulkItemResult{Index: index, Error: err.Error(), NotAttempted: true})
+		}
+
+		b.pending = b.pending[:0]
+		b.indexes = b.indexes[:0]
+
+		return &bulkStoreError{err: err}
+	}
+
+	for i, index := range b.indexes {
+		itemErr, ok := failed[i]
+		b.app.settle(tenant, b.pending[i], folded[i], itemErr)
+
+		if ok {
+			b.fail(index, itemErr)
+			continue
+		}
+
+		b.response.Inserted++
+		b.response.Results = append(b.response.Results, BulkItemResult{Index: index, ID: ids[i]})
+	}
+
+	b.pending = b.pending[:0]
+	b.indexes = b.indexes[:0]
+
+	return nil
+}
+
+// throttled reports whether no entry was inserted because every entry was
+// rejected by a rate limit
+func (b *bulkInserter) throttled() bool {
+	return b.response.Inserted == 0 && b.rateLimited > 0 && b.rateLimited == b.response.Failed
+}
+
+// stop records the error that stopped the request at the entry of the given
+// index, keeping the earliest one
+func (b *bulkInserter) stop(index int, err error) {
+	if b.response.StoppedAt != nil && *b.response.StoppedAt <= index {
+		return
+	}
+
+	b.response.StoppedAt = &index
+	b.response.Error = err.Error()
+}
+
+func (b *bulkInserter) fail(index int, err error) {
+	b.response.Failed++
+	b.response.Results = append(b.response.Results, BulkItemResult{Index: index, Error: err.Error()})
+}
+
+// bulkChunkSize returns the number of entries inserted per query by the bulk
+// endpoint, read from the BULK_CHUNK_SIZE environment variable
+func bulkChunkSize() int {
+	value := os.Getenv("BULK_CHUNK_SIZE")
+	if value == "" {
+		return defaultBulkChunkSize
+	}
+
+	size, err := strconv.Atoi(value)
+	if err != nil || size < 1 {
+		log.Panic("BULK_CHUNK_SIZE must be a positive number")
+	}
+
+	return size
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"logger-service/data"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exportFlushEvery is the number of entries written between two flushes, so
+// large exports reach the client progressively
+const exportFlushEvery = 500
+
+// csvHeader lists the columns of the CSV export. The columns added after the
+// first release come last, so the files read by position stay readable. The
+// attributes are a JSON object, and the count is 1 for entries never folded
+var csvHeader = []string{"id", "name", "level", "data", "created_at", "updated_at", "tenant", "attributes", "count"}
+
+// ExportLogs streams the entries matching the name, level, from and to query
+// parameters, oldest first. The format query parameter selects ndjson
+// (default) or csv, otherwise the Accept header is used
+func (app *Config) ExportLogs(w http.ResponseWriter, r *http.Request) {
+	format, err := exportFormat(r)
+	if err != nil {
+		_ = app.ErrorJSON(w, err, http.StatusNotAcceptable)
+		return
+	}
+
+	filter, err := filterFromQuery(r)
+	if err != nil {
+		_ = app.ErrorJSON(w, err)
+		return
+	}
+
+	var write func(*data.LogEntry) error
+	var flush func() error
+
+	switch format {
+	case "csv":
+		cw := csv.NewWriter(w)
+		write = func(entry *data.LogEntry) error {
+			attributes := ""
+			if len(entry.Attributes) > 0 {
+				encoded, err := json.Marshal(entry.Attributes)
+				if err != nil {
+					return err
+				}
+				attributes = string(encoded)
+			}
+
+			return cw.Write([]string{
+				entry.ID,
+				entry.Name,
+				entry.Level,
+				entry.Data,
+				entry.CreatedAt.Format(time.RFC3339Nano),
+				entry.UpdatedAt.Format(time.RFC3339Nano),
+				entry.Tenant,
+				attributes,
+				strconv.FormatInt(max(entry.Count, 1), 10),
+			})
+		}
+		// buffered by the writer until the first flush
+		_ = cw.Write(csvHeader)
+		flush = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	default:
+		enc := json.NewEncoder(w)
+		write = func(entry *data.LogEntry) error {
+			return enc.Encode(entry)
+		}
+		flush = func() error {
+			return nil
+		}
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+
+	filename := fmt.Sprintf("logs-%s.%s", time.Now().UTC().Format("20060102T150405Z"), format)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	count := 0
+
+	models := app.tenantModels(r)
+
+	// once the first bytes are sent the status can no longer change, so a
+	// failure only cuts the export short. The export lasts as long as the
+	// client keeps reading, so it stops with the request rather than after
+	// a fixed timeout
+	err = models.LogEntry.EachContext(r.Context(), filter, func(entry *data.LogEntry) error {
+		if err := write(entry); err != nil {
+			return err
+		}
+
+		count++
+		if count%exportFlushEvery == 0 {
+			if err := flush(); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Println("Error exporting logs:", err)
+		return
+	}
+
+	if err = flush(); err != nil {
+		log.Println("Error exporting logs:", err)
+	}
+}
+
+// exportFormat picks the export format from the format query parameter or,
+// when it is not set, from the Accept header
+func exportFormat(r *http.Request) (string, error) {
+	if format := r.URL.Query().Get("format"); format != "" {
+		switch strings.ToLower(format) {
+		case "ndjson", "jsonl":
+			return "ndjson", nil
+		case "csv":
+			return "csv", nil
+		}
+
+		return "", errors.New("format must be ndjson or csv")
+	}
+
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, _ := mime.ParseMediaType(strings.TrimSpace(accepted))
+
+		switch mediaType {
+		case "text/csv":
+			return "csv", nil
+		case "application/x-ndjson", "application/jsonl", "application/json", "*/*", "":
+			return "ndjson", nil
+		}
+	}
+
+	return "", errors.New("the export is only available as application/x-ndjson or text/csv")
+}
@@ -1,14 +1,17 @@
 package main
 
 import (
+	"fmt"
 	"logger-service/data"
 	"net/http"
+	"time"
 	"tools"
 )
 
 type RequestPayload struct {
-	Name string `json:"name"`
-	Data string `json:"data"`
+	Name  string `json:"name"`
+	Level string `json:"level,omitempty"`
+	Data  string `json:"data"`
 }
 
 func (app *Config) WriteLog(w http.ResponseWriter, r *http.Request) {
@@ -16,11 +19,21 @@ func (app *Config) WriteLog(w http.ResponseWriter, r *http.Request) {
 	_ = app.ReadJSON(w, r, &requestPayload)
 
 	event := data.LogEntry{
-		Name: requestPayload.Name,
-		Data: requestPayload.Data,
+		Name:  requestPayload.Name,
+		Level: requestPayload.Level,
+		Data:  app.redact(requestPayload.Data),
 	}
 
-	err := app.Models.LogEntry.Insert(event)
+	err := app.reserve(r, event)
+	if err != nil {
+		app.quotaError(w, err)
+		return
+	}
+
+	models := app.tenantModels(r)
+
+	folded, err := models.LogEntry.Insert(event)
+	app.settle(tenantFrom(r), event, folded, err)
 	if err != nil {
 		_ = app.ErrorJSON(w, err)
 		return
@@ -33,3 +46,54 @@ func (app *Config) WriteLog(w http.ResponseWriter, r *http.Request) {
 
 	_ = app.WriteJSON(w, http.StatusAccepted, resp)
 }
+
+// filterFromQuery reads the name, level, request_id, from and to query
+// parameters used by the endpoints that query logs. Times are expected in
+// RFC 3339 format
+func filterFromQuery(r *http.Request) (data.Filter, error) {
+	query := r.URL.Query()
+
+	filter := data.Filter{
+		Name:      query.Get("name"),
+		Level:     query.Get("level"),
+		RequestID: query.Get("request_id"),
+	}
+
+	if value := query.Get("from"); value != "" {
+		from, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return filter, fmt.Errorf("invalid from: %w", err)
+		}
+		filter.From = from
+	}
+
+	if value := query.Get("to"); value != "" {
+		to, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return filter, fmt.Errorf("invalid to: %w", err)
+		}
+		filter.To = to
+	}
+
+	return filter, nil
+}
+
+// redact removes personal data and secrets from a log message, according to
+// the configured redaction rules
+func (app *Config) redact(message string) string {
+	if app.Redactor == nil {
+		return message
+	}
+
+	return app.Redactor.String(message)
+}
+
+// redactAttributes removes personal data and secrets from the attributes of an
+// entry, in place
+func (app *Config) redactAttributes(attributes map[string]string) {
+	if app.Redactor == nil {
+		return
+	}
+
+	app.Redactor.Attributes(attributes)
+}
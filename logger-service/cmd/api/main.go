@@ -1,55 +1,121 @@
 package main
 
 import (
-	"context"
 	"fmt"
 	"log"
+	"logger-service/alert"
+	"logger-service/archive"
 	"logger-service/data"
+	"logger-service/redact"
+	"logger-service/webhook"
 	"net/http"
+	"os"
 	"time"
 	"tools"
-
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-const (
-	webPort  = 80
-	mongoURL = "mongodb://mongo:27017"
-)
+const webPort = 80
 
 type Config struct {
 	tools.Tools
-	Models data.Models
+	Models  data.Models
+	Archive *archive.Archive
+	Hub     *Hub
+
+	// Redactor removes personal data and secrets from entries before they
+	// are stored, it is nil when redaction is turned off
+	Redactor *redact.Redactor
+
+	// Alerts evaluates the alert rules against the inserted entries
+	Alerts *alert.Engine
+
+	// Webhooks delivers the events of the inserted entries to the webhooks
+	Webhooks *webhook.Dispatcher
+
+	// Tenants identifies the tenant of each request, it is nil when tenants
+	// are not configured and every caller sees every entry
+	Tenants *Tenants
+
+	// SourceLimits limits the entries each source may insert per minute, it
+	// is nil when sources are not limited
+	SourceLimits *sourceLimits
+
+	// BulkChunkSize is the number of entries inserted per query when logs
+	// are written in bulk
+	BulkChunkSize int
 }
 
 func main() {
-	// connect to mongo
-	client, err := connectToMongo()
+	// open the store selected by LOG_STORE, mongo unless configured otherwise
+	store, closeStore := openStore()
+	defer closeStore()
+
+	redactor, err := redact.FromEnv()
 	if err != nil {
 		log.Panic(err)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
-	defer cancel()
+	models := data.New(store)
 
-	// close connection
-	defer func() {
-		log.Println("Disconnecting from mongo...")
+	app := Config{
+		Tools:         tools.New(),
+		Models:        models,
+		Archive:       createArchive(),
+		Hub:           NewHub(),
+		Redactor:      redactor,
+		Alerts:        createAlerts(),
+		Webhooks:      webhook.NewDispatcher(models),
+		Tenants:       createTenants(models),
+		SourceLimits:  createSourceLimits(),
+		BulkChunkSize: bulkChunkSize(),
+	}
 
-		if err = client.Disconnect(ctx); err != nil {
-			log.Println("Error disconnecting from mongo:", err)
-			panic(err)
-		}
+	// create the indexes the queries rely on, including the text index used by
+	// the search endpoint
+	err = app.Models.LogEntry.EnsureIndexes()
+	if err != nil {
+		log.Panic(err)
+	}
 
-		log.Println("Successfully disconnected from mongo")
-	}()
+	// load the retention policies and keep enforcing them in the background.
+	// When archiving is enabled, the store must not delete expired entries on
+	// its own, they are deleted by the sweeper once they have been archived
+	if app.Archive != nil {
+		err = app.Models.RetentionPolicy.DropTTLIndex()
+	} else {
+		err = app.Models.RetentionPolicy.EnsureTTLIndex()
+	}
+	if err != nil {
+		log.Panic(err)
+	}
 
-	app := Config{
-		Tools:  tools.New(),
-		Models: data.New(client),
+	_, err = app.Models.RetentionPolicy.Refresh()
+	if err != nil {
+		log.Panic(err)
 	}
 
+	go app.sweepRetention(sweepInterval())
+
+	// fold identical entries received within DEDUP_WINDOW (e.g. "1m") into one
+	app.Models.LogEntry.Deduplicate(envDuration("DEDUP_WINDOW", 0))
+
+	// evaluate the alert rules against every entry inserted by this process
+	app.loadAlertRules()
+	app.Models.LogEntry.OnInsert(app.Alerts.Evaluate)
+	go app.refreshAlertRules(alertRulesRefreshInterval)
+
+	// notify the webhooks subscribed to the inserted entries and sign-ins
+	app.loadWebhooks()
+	app.Models.LogEntry.OnInsert(app.Webhooks.Publish)
+	go app.refreshWebhooks(webhooksRefreshInterval)
+
+	// push new entries to the clients following the log stream
+	app.startStream()
+
+	// receive the logs of the components that only speak syslog or OTLP
+	app.listenSyslog()
+	app.serveOTLP()
+
 	log.Println("Starting logger-service on port:", webPort)
 	server := &http.Server{
 		Addr:    fmt.Sprintf(":%d", webPort),
@@ -62,24 +128,18 @@ func main() {
 	}
 }
 
-func connectToMongo() (*mongo.Client, error) {
-	log.Println("Connecting to mongo...")
-
-	// create connection options
-	clientOptions := options.Client().ApplyURI(mongoURL)
-	clientOptions.SetAuth(options.Credential{
-		Username: "admin",
-		Password: "password",
-	})
-
-	// connect to mongo
-	client, err := mongo.Connect(context.TODO(), clientOptions)
-	if err != nil {
-		log.Println("Error connecting to mongo:", err)
-		return nil, err
+// sweepInterval returns how often the retention sweeper runs, read from the
+// RETENTION_SWEEP_INTERVAL environment variable (e.g. "30m")
+func sweepInterval() time.Duration {
+	value := os.Getenv("RETENTION_SWEEP_INTERVAL")
+	if value == "" {
+		return defaultSweepInterval
 	}
 
-	log.Println("Successfully connected to mongo")
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval <= 0 {
+		log.Panicf("RETENTION_SWEEP_INTERVAL must be a positive duration, got %q", value)
+	}
 
-	return client, nil
+	return interval
 }
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"logger-service/ingest"
+	"mime"
+	"net/http"
+	"os"
+)
+
+// WriteOTLPLogs receives the logs exported by OpenTelemetry SDKs and
+// collectors over OTLP/HTTP, encoded as protobuf or JSON and optionally
+// gzipped. Records that can not be stored are reported as a partial success
+func (app *Config) WriteOTLPLogs(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, int64(app.MaxJSONSize))
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		reader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			_ = app.ErrorJSON(w, err)
+			return
+		}
+		defer reader.Close()
+
+		// the limit also applies to the uncompressed body
+		body = io.LimitReader(reader, int64(app.MaxJSONSize)+1)
+	}
+
+	content, err := io.ReadAll(body)
+	if err == nil && len(content) > app.MaxJSONSize {
+		err = &http.MaxBytesError{Limit: int64(app.MaxJSONSize)}
+	}
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			_ = app.ErrorJSON(w, fmt.Errorf("body must not be larger than %d bytes", maxBytesErr.Limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		_ = app.ErrorJSON(w, err)
+		return
+	}
+
+	logs, err := ingest.DecodeOTLP(content, mediaType)
+	if err != nil {
+		if errors.Is(err, ingest.ErrUnsupportedEncoding) {
+			_ = app.ErrorJSON(w, err, http.StatusUnsupportedMediaType)
+			return
+		}
+
+		_ = app.ErrorJSON(w, err)
+		return
+	}
+
+	inserter := &bulkInserter{
+		app:       app,
+		request:   r,
+		models:    app.tenantModels(r),
+		chunkSize: app.BulkChunkSize,
+	}
+
+	for index, entry := range ingest.OTLPEntries(logs) {
+		entry.Data = app.redact(entry.Data)
+		app.redactAttributes(entry.Attributes)
+
+		if err = inserter.queue(index, entry); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = inserter.flush()
+	}
+	if err != nil {
+		_ = app.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	// the exporter retries the whole request after the given wait
+	if inserter.throttled() {
+		setRetryAfter(w, inserter.retryAfter)
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+
+	message := ""
+	for _, result := range inserter.response.Results {
+		if result.Error != "" {
+			message = result.Error
+			break
+		}
+	}
+
+	w.Header().Set("Content-Type", mediaType)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(ingest.EncodeOTLPResponse(mediaType, int64(inserter.response.Failed), message))
+}
+
+// serveOTLP listens for OTLP/HTTP logs on the address set in OTLP_HTTP_ADDR,
+// usually :4318, when it is set
+func (app *Config) serveOTLP() {
+	addr := os.Getenv("OTLP_HTTP_ADDR")
+	if addr == "" {
+		return
+	}
+
+	server := &http.Server{
+		Addr:    addr,
+		Handler: app.otlpRoutes(),
+	}
+
+	go func() {
+		log.Println("Listening for OTLP logs on", addr)
+
+		if err := server.ListenAndServe(); err != nil {
+			log.Panic(err)
+		}
+	}()
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimiter keeps a token bucket per key. Every bucket holds up to a
+// minute worth of tokens and refills continuously at the rate given on each
+// call
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		buckets: make(map[string]*tokenBucket),
+		swept:   time.Now(),
+	}
+}
+
+// allow takes n tokens from the bucket of key, which refills at perMinute
+// tokens per minute. When there are not enough tokens nothing is taken and
+// the time until there will be is returned
+func (l *rateLimiter) allow(key string, n, perMinute int) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+
+	// a bucket left alone for a minute is full again, forgetting it changes
+	// nothing and keeps the number of buckets bounded
+	if now.Sub(l.swept) >= time.Minute {
+		for k, bucket := range l.buckets {
+			if now.Sub(bucket.last) >= time.Minute {
+				delete(l.buckets, k)
+			}
+		}
+		l.swept = now
+	}
+
+	capacity := float64(perMinute)
+	perSecond := capacity / 60
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: capacity, last: now}
+		l.buckets[key] = bucket
+	}
+
+	bucket.tokens = math.Min(capacity, bucket.tokens+now.Sub(bucket.last).Seconds()*perSecond)
+	bucket.last = now
+
+	if bucket.tokens >= float64(n) {
+		bucket.tokens -= float64(n)
+		return true, 0
+	}
+
+	missing := float64(n) - bucket.tokens
+	return false, time.Duration(missing / perSecond * float64(time.Second))
+}
+
+// refund gives back n tokens taken from the bucket of key, for entries that
+// could not be inserted
+func (l *rateLimiter) refund(key string, n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// a bucket already forgotten is full again
+	if bucket, ok := l.buckets[key]; ok {
+		bucket.tokens += float64(n)
+	}
+}
+
+// sourceLimits limits the number of entries each source may insert per
+// minute. The source of an entry is its name, which is the service name for
+// OTLP and the app name for syslog. The sources of different tenants have
+// their own limits
+type sourceLimits struct {
+	limiter *rateLimiter
+	// rate applies to the sources without a rate of their own, zero means
+	// unlimited
+	rate  int
+	rates map[string]int
+}
+
+// createSourceLimits reads the default rate of every source from
+// SOURCE_INSERT_RATE and the rates of specific sources from
+// SOURCE_INSERT_RATES, as a comma separated list of name=rate. It returns nil
+// when neither is set
+func createSourceLimits() *sourceLimits {
+	defaultRate := os.Getenv("SOURCE_INSERT_RATE")
+	rates := os.Getenv("SOURCE_INSERT_RATES")
+	if defaultRate == "" && rates == "" {
+		return nil
+	}
+
+	limits := &sourceLimits{
+		limiter: newRateLimiter(),
+		rate:    int(envInt64("SOURCE_INSERT_RATE", 0)),
+		rates:   make(map[string]int),
+	}
+
+	for _, pair := range strings.Split(rates, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+
+		name, value, ok := strings.Cut(pair, "=")
+		rate, err := strconv.Atoi(strings.TrimSpace(value))
+		if !ok || err != nil || rate < 0 {
+			log.Panicf("SOURCE_INSERT_RATES must be a comma separated list of name=rate, got %q", pair)
+		}
+
+		limits.rates[strings.TrimSpace(name)] = rate
+	}
+
+	return limits
+}
+
+// allow takes one entry of the source of the given tenant, or returns a
+// rateLimitError when the source is over its rate
+func (s *sourceLimits) allow(tenant, source string) error {
+	if s == nil {
+		return nil
+	}
+
+	rate, ok := s.rates[source]
+	if !ok {
+		rate = s.rate
+	}
+
+	if rate == 0 {
+		return nil
+	}
+
+	if ok, wait := s.limiter.allow(sourceKey(tenant, source), 1, rate); !ok {
+		return &rateLimitError{source: source, retryAfter: wait}
+	}
+
+	return nil
+}
+
+// refund gives back the entry taken by allow from the source of the given
+// tenant
+func (s *sourceLimits) refund(tenant, source string) {
+	if s == nil {
+		return
+	}
+
+	s.limiter.refund(sourceKey(tenant, source), 1)
+}
+
+// sourceKey is the key of the bucket of a source of a tenant
+func sourceKey(tenant, source string) string {
+	return fmt.Sprintf("%s\x00%s", tenant, source)
+}
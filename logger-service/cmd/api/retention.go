@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"logger-service/data"
+	"net/http"
+	"time"
+	"tools"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// defaultSweepInterval is used when RETENTION_SWEEP_INTERVAL is not set
+const defaultSweepInterval = time.Hour
+
+type RetentionPayload struct {
+	Name   string `json:"name"`
+	Level  string `json:"level"`
+	MaxAge int64  `json:"max_age_seconds"`
+}
+
+// GetRetentionPolicies lists the retention policies currently in use
+func (app *Config) GetRetentionPolicies(w http.ResponseWriter, r *http.Request) {
+	policies, err := app.Models.RetentionPolicy.All()
+	if err != nil {
+		_ = app.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := tools.JsonResponse{
+		Error:   false,
+		Message: "retention policies",
+		Data:    policies,
+	}
+
+	_ = app.WriteJSON(w, http.StatusOK, resp)
+}
+
+// SetRetentionPolicy creates or replaces the retention policy for a log name
+// and/or level. Leaving both empty sets the default policy
+func (app *Config) SetRetentionPolicy(w http.ResponseWriter, r *http.Request) {
+	var requestPayload RetentionPayload
+
+	err := app.ReadJSON(w, r, &requestPayload)
+	if err != nil {
+		_ = app.ErrorJSON(w, err)
+		return
+	}
+
+	if requestPayload.MaxAge <= 0 {
+		_ = app.ErrorJSON(w, errors.New("max_age_seconds must be greater than zero"))
+		return
+	}
+
+	policy, err := app.Models.RetentionPolicy.Upsert(data.RetentionPolicy{
+		Name:   requestPayload.Name,
+		Level:  requestPayload.Level,
+		MaxAge: requestPayload.MaxAge,
+	})
+	if err != nil {
+		_ = app.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	go app.applyRetention()
+
+	resp := tools.JsonResponse{
+		Error:   false,
+		Message: "retention policy saved",
+		Data:    policy,
+	}
+
+	_ = app.WriteJSON(w, http.StatusAccepted, resp)
+}
+
+// DeleteRetentionPolicy removes a retention policy, entries it applied to fall
+// back to the next matching policy or are kept forever
+func (app *Config) DeleteRetentionPolicy(w http.ResponseWriter, r *http.Request) {
+	err := app.Models.RetentionPolicy.DeleteByID(chi.URLParam(r, "id"))
+	if err != nil {
+		if errors.Is(err, data.ErrNotFound) {
+			_ = app.ErrorJSON(w, errors.New("retention policy not found"), http.StatusNotFound)
+			return
+		}
+
+		_ = app.ErrorJSON(w, err)
+		return
+	}
+
+	go app.applyRetention()
+
+	resp := tools.JsonResponse{
+		Error:   false,
+		Message: "retention policy deleted",
+	}
+
+	_ = app.WriteJSON(w, http.StatusAccepted, resp)
+}
+
+// applyRetention recalculates the expiry of the stored log entries after the
+// retention policies changed
+func (app *Config) applyRetention() {
+	err := app.Models.RetentionPolicy.ApplyExpiry()
+	if err != nil {
+		log.Println("Error applying retention policies:", err)
+	}
+}
+
+// sweepRetention periodically reloads the retention policies, so changes made
+// through another replica are picked up, and deletes the expired log entries.
+// When archiving is enabled the expired entries are archived before deletion.
+// The entries deleted since the previous sweep are compacted away first
+func (app *Config) sweepRetention(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		compacted, err := app.Models.RetentionPolicy.Compact()
+		if err != nil {
+			log.Println("Error compacting deleted logs:", err)
+		} else if compacted > 0 {
+			log.Printf("Retention sweep compacted %d deleted log entries\n", compacted)
+		}
+
+		changed, err := app.Models.RetentionPolicy.Refresh()
+		if err != nil {
+			log.Println("Error refreshing retention policies:", err)
+			continue
+		}
+
+		if changed {
+			app.applyRetention()
+		}
+
+		if app.Archive != nil {
+			_, err = app.archiveLogs(data.Filter{ExpiredBy: time.Now()})
+			if err != nil {
+				log.Println("Error archiving expired logs:", err)
+			}
+			continue
+		}
+
+		deleted, err := app.Models.RetentionPolicy.Sweep()
+		if err != nil {
+			log.Println("Error sweeping expired logs:", err)
+			continue
+		}
+
+		if deleted > 0 {
+			log.Printf("Retention sweep deleted %d log entries\n", deleted)
+		}
+	}
+}
@@ -16,14 +16,65 @@ func (app *Config) routes() http.Handler {
 		AllowedOrigins:   []string{"https://*", "http://*"},
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-		ExposedHeaders:   []string{"Link"},
+		ExposedHeaders:   []string{"Link", "Content-Disposition"},
 		AllowCredentials: true,
 		MaxAge:           300,
 	}))
 
 	mux.Use(middleware.Heartbeat("/ping"))
 
-	mux.Post("/log", app.WriteLog)
+	// every route below only sees the entries of the tenant of the caller
+	mux.Group(func(mux chi.Router) {
+		mux.Use(app.identifyTenant)
+
+		mux.Post("/log", app.WriteLog)
+		mux.Post("/logs/bulk", app.WriteLogs)
+		mux.Get("/logs/search", app.SearchLogs)
+		mux.Get("/logs/export", app.ExportLogs)
+		mux.Get("/logs/stream", app.StreamLogs)
+
+		mux.Get("/logs/stats/counts", app.LogCounts)
+		mux.Get("/logs/stats/top", app.TopLogNames)
+		mux.Get("/logs/stats/errors", app.LogErrorRate)
+
+		mux.Get("/alerts/rules", app.GetAlertRules)
+		mux.Post("/alerts/rules", app.CreateAlertRule)
+		mux.Get("/alerts/rules/{id}", app.GetAlertRule)
+		mux.Put("/alerts/rules/{id}", app.UpdateAlertRule)
+		mux.Delete("/alerts/rules/{id}", app.DeleteAlertRule)
+
+		mux.Get("/webhooks", app.GetWebhooks)
+		mux.Post("/webhooks", app.CreateWebhook)
+		mux.Get("/webhooks/{id}", app.GetWebhook)
+		mux.Put("/webhooks/{id}", app.UpdateWebhook)
+		mux.Delete("/webhooks/{id}", app.DeleteWebhook)
+		mux.Get("/webhooks/{id}/deliveries", app.GetWebhookDeliveries)
+
+		// retention and archives apply to all tenants at once
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.requireAdmin)
+
+			mux.Get("/retention", app.GetRetentionPolicies)
+			mux.Put("/retention", app.SetRetentionPolicy)
+			mux.Delete("/retention/{id}", app.DeleteRetentionPolicy)
+
+			mux.Get("/archive", app.GetArchives)
+			mux.Post("/archive", app.ArchiveLogs)
+			mux.Post("/archive/{id}/import", app.ImportArchive)
+		})
+	})
+
+	return mux
+}
+
+// otlpRoutes serves the OTLP/HTTP logs endpoint, on its own port like the
+// OpenTelemetry collector
+func (app *Config) otlpRoutes() http.Handler {
+	mux := chi.NewRouter()
+
+	mux.Use(app.identifyTenant)
+
+	mux.Post("/v1/logs", app.WriteOTLPLogs)
 
 	return mux
 }
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"html"
+	"logger-service/data"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"tools"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+// searchTerms splits a $text query into "quoted phrases" and single words,
+// ignoring the -negated terms
+var searchTerms = regexp.MustCompile(`"([^"]+)"|(-?[^\s"]+)`)
+
+type SearchHit struct {
+	*data.SearchResult
+	// Highlights are keyed by name, level, data or attributes.<key>
+	Highlights map[string]string `json:"highlights,omitempty"`
+}
+
+type SearchResponse struct {
+	Results    []SearchHit `json:"results"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+// SearchLogs runs a full-text search over the logs. It takes the query in q,
+// the page size in limit and the next_cursor of the previous page in cursor
+func (app *Config) SearchLogs(w http.ResponseWriter, r *http.Request) {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		_ = app.ErrorJSON(w, errors.New("q is required"))
+		return
+	}
+
+	limit := defaultSearchLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxSearchLimit {
+			_ = app.ErrorJSON(w, errors.New("limit must be between 1 and 100"))
+			return
+		}
+		limit = n
+	}
+
+	var after *data.SearchCursor
+	if value := r.URL.Query().Get("cursor"); value != "" {
+		cursor, err := data.DecodeSearchCursor(value)
+		if err != nil {
+			_ = app.ErrorJSON(w, err)
+			return
+		}
+		after = cursor
+	}
+
+	models := app.tenantModels(r)
+
+	// fetch one more result than needed to know whether there is a next page
+	results, err := models.LogEntry.Search(query, limit+1, after)
+	if errors.Is(err, data.ErrNotSupported) {
+		_ = app.ErrorJSON(w, err, http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		_ = app.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	var response SearchResponse
+	if len(results) > limit {
+		results = results[:limit]
+
+		last := results[len(results)-1]
+		response.NextCursor = data.SearchCursor{Score: last.Score, ID: last.ID}.Encode()
+	}
+
+	pattern := highlightPattern(query)
+
+	response.Results = make([]SearchHit, 0, len(results))
+	for _, result := range results {
+		hit := SearchHit{SearchResult: result}
+
+		fields := map[string]string{"name": result.Name, "level": result.Level, "data": result.Data}
+		for key, value := range result.Attributes {
+			fields["attributes."+key] = value
+		}
+
+		for field, text := range fields {
+			if marked, ok := highlight(text, pattern); ok {
+				if hit.Highlights == nil {
+					hit.Highlights = make(map[string]string)
+				}
+				hit.Highlights[field] = marked
+			}
+		}
+
+		response.Results = append(response.Results, hit)
+	}
+
+	resp := tools.JsonResponse{
+		Error:   false,
+		Message: "search results",
+		Data:    response,
+	}
+
+	_ = app.WriteJSON(w, http.StatusOK, resp)
+}
+
+// highlightPattern builds a case-insensitive pattern matching the words and
+// phrases of a $text query. MongoDB stems the search terms, so words are also
+// matched on their stem followed by any word characters
+func highlightPattern(query string) *regexp.Regexp {
+	var alternatives []string
+
+	for _, match := range searchTerms.FindAllStringSubmatch(query, -1) {
+		switch {
+		case match[1] != "":
+			alternatives = append(alternatives, regexp.QuoteMeta(match[1]))
+		case !strings.HasPrefix(match[2], "-"):
+			alternatives = append(alternatives, regexp.QuoteMeta(stem(match[2]))+`\w*`)
+		}
+	}
+
+	if len(alternatives) == 0 {
+		return nil
+	}
+
+	return regexp.MustCompile(`(?i)` + strings.Join(alternatives, "|"))
+}
+
+// highlight HTML escapes text and wraps every match of pattern in <mark>
+// tags. It reports whether anything matched
+func highlight(text string, pattern *regexp.Regexp) (string, bool) {
+	if pattern == nil {
+		return "", false
+	}
+
+	matches := pattern.FindAllStringIndex(text, -1)
+	if len(matches) == 0 {
+		return "", false
+	}
+
+	var b strings.Builder
+	last := 0
+	for _, match := range matches {
+		b.WriteString(html.EscapeString(text[last:match[0]]))
+		b.WriteString("<mark>")
+		b.WriteString(html.EscapeString(text[match[0]:match[1]]))
+		b.WriteString("</mark>")
+		last = match[1]
+	}
+	b.WriteString(html.EscapeString(text[last:]))
+
+	return b.String(), true
+}
+
+// stem lowers a word and strips the most common English suffixes, which is
+// close enough to the stemming MongoDB applies for highlighting purposes
+func stem(word string) string {
+	lower := strings.ToLower(word)
+
+	for _, suffix := range []string{"ing", "ed", "es", "s"} {
+		if strings.HasSuffix(lower, suffix) && len(lower)-len(suffix) >= 3 {
+			return lower[:len(lower)-len(suffix)]
+		}
+	}
+
+	return lower
+}
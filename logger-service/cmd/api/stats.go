@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"logger-service/data"
+	"net/http"
+	"strconv"
+	"time"
+	"tools"
+)
+
+const (
+	// defaultStatsWindow is the period covered by the statistics when the
+	// from query parameter is not set
+	defaultStatsWindow = time.Hour * 24
+
+	defaultTopLimit = 10
+	maxTopLimit     = 100
+)
+
+// LogCounts returns the number of entries per name over time. The bucket
+// query parameter selects the bucket size: minute, hour (default) or day
+func (app *Config) LogCounts(w http.ResponseWriter, r *http.Request) {
+	filter, err := statsFilter(r)
+	if err != nil {
+		_ = app.ErrorJSON(w, err)
+		return
+	}
+
+	models := app.tenantModels(r)
+
+	counts, err := models.LogEntry.CountsOverTime(filter, bucketFromQuery(r))
+	if err != nil {
+		app.statsError(w, err)
+		return
+	}
+
+	resp := tools.JsonResponse{
+		Error:   false,
+		Message: "log counts",
+		Data:    counts,
+	}
+
+	_ = app.WriteJSON(w, http.StatusOK, resp)
+}
+
+// TopLogNames returns the names with the most entries. The number of names is
+// set with the limit query parameter
+func (app *Config) TopLogNames(w http.ResponseWriter, r *http.Request) {
+	filter, err := statsFilter(r)
+	if err != nil {
+		_ = app.ErrorJSON(w, err)
+		return
+	}
+
+	limit := defaultTopLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxTopLimit {
+			_ = app.ErrorJSON(w, errors.New("limit must be between 1 and 100"))
+			return
+		}
+		limit = n
+	}
+
+	models := app.tenantModels(r)
+
+	counts, err := models.LogEntry.TopNames(filter, limit)
+	if err != nil {
+		app.statsError(w, err)
+		return
+	}
+
+	resp := tools.JsonResponse{
+		Error:   false,
+		Message: "top log names",
+		Data:    counts,
+	}
+
+	_ = app.WriteJSON(w, http.StatusOK, resp)
+}
+
+// LogErrorRate returns the share of error entries over time, using the same
+// bucket query parameter as LogCounts
+func (app *Config) LogErrorRate(w http.ResponseWriter, r *http.Request) {
+	filter, err := statsFilter(r)
+	if err != nil {
+		_ = app.ErrorJSON(w, err)
+		return
+	}
+
+	models := app.tenantModels(r)
+
+	points, err := models.LogEntry.ErrorRate(filter, bucketFromQuery(r))
+	if err != nil {
+		app.statsError(w, err)
+		return
+	}
+
+	resp := tools.JsonResponse{
+		Error:   false,
+		Message: "log error rate",
+		Data:    points,
+	}
+
+	_ = app.WriteJSON(w, http.StatusOK, resp)
+}
+
+// statsFilter reads the query filter, limiting it to the default window when
+// no start time is given
+func statsFilter(r *http.Request) (data.Filter, error) {
+	filter, err := filterFromQuery(r)
+	if err != nil {
+		return filter, err
+	}
+
+	if filter.From.IsZero() {
+		filter.From = time.Now().Add(-defaultStatsWindow)
+	}
+
+	return filter, nil
+}
+
+func bucketFromQuery(r *http.Request) string {
+	if bucket := r.URL.Query().Get("bucket"); bucket != "" {
+		return bucket
+	}
+
+	return "hour"
+}
+
+func (app *Config) statsError(w http.ResponseWriter, err error) {
+	if errors.Is(err, data.ErrInvalidBucket) {
+		_ = app.ErrorJSON(w, err)
+		return
+	}
+
+	_ = app.ErrorJSON(w, err, http.StatusInternalServerError)
+}
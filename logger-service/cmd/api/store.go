@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"logger-service/data"
+	"os"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	// PostgreSQL driver
+	_ "github.com/jackc/pgx/v4/stdlib"
+)
+
+const (
+	// defaultLogDir is where the file store keeps its files when LOG_DIR is
+	// not set
+	defaultLogDir = "/var/lib/logger"
+
+	// defaultLogFileMaxBytes is the size at which the file store starts a new
+	// file when LOG_FILE_MAX_BYTES is not set
+	defaultLogFileMaxBytes = 64 << 20
+
+	// defaultMongoURL is used when MONGO_URL is not set
+	defaultMongoURL = "mongodb://mongo:27017"
+
+	// maxCount is the maximum number of times connecting to the database is
+	// attempted
+	maxCount = 10
+
+	// timeInterval is the time between each attempt at connecting to the
+	// database
+	timeInterval = time.Second * 2
+)
+
+// openStore opens the log store selected by the LOG_STORE environment
+// variable: mongo (the default), file or postgres. It returns the store and a
+// function closing it
+func openStore() (data.Store, func()) {
+	switch os.Getenv("LOG_STORE") {
+	case "", "mongo":
+		client := connectToMongo()
+		if client == nil {
+			log.Panic("Can't connect to Mongo!")
+		}
+
+		closeStore := func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+			defer cancel()
+
+			log.Println("Disconnecting from mongo...")
+
+			if err := client.Disconnect(ctx); err != nil {
+				log.Println("Error disconnecting from mongo:", err)
+				panic(err)
+			}
+
+			log.Println("Successfully disconnected from mongo")
+		}
+
+		return data.NewMongoStore(client), closeStore
+
+	case "file":
+		dir := os.Getenv("LOG_DIR")
+		if dir == "" {
+			dir = defaultLogDir
+		}
+
+		store, err := data.NewFileStore(dir, envInt64("LOG_FILE_MAX_BYTES", defaultLogFileMaxBytes), int(envInt64("LOG_FILE_MAX_FILES", 0)))
+		if err != nil {
+			log.Panic(err)
+		}
+
+		log.Println("Storing logs in", dir)
+
+		return store, func() {}
+
+	case "postgres":
+		conn := connectToDB()
+		if conn == nil {
+			log.Panic("Can't connect to Postgres!")
+		}
+
+		store, err := data.NewPostgresStore(conn)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		closeStore := func() {
+			if err := conn.Close(); err != nil {
+				log.Println("Error closing Postgres connection:", err)
+			}
+		}
+
+		return store, closeStore
+
+	default:
+		log.Panicf("LOG_STORE must be one of mongo, file or postgres, got %q", os.Getenv("LOG_STORE"))
+		return nil, nil
+	}
+}
+
+// connectToMongo connects to the MongoDB server at MONGO_URL, retrying while
+// it is not ready yet. The credentials are read from MONGO_USERNAME and
+// MONGO_PASSWORD, unless they are part of the URL
+func connectToMongo() *mongo.Client {
+	// count is the number of times connecting to the database is attempted
+	count := 0
+
+	clientOptions := mongoOptions()
+
+	for {
+		client, err := openMongo(clientOptions)
+		if err != nil {
+			log.Println("Mongo not yet ready...")
+			count++
+		} else {
+			log.Println("Connected to mongo!")
+			return client
+		}
+
+		if count >= maxCount {
+			log.Println(err)
+			return nil
+		}
+
+		log.Println("Backing off for two seconds...")
+		time.Sleep(timeInterval)
+	}
+}
+
+func openMongo(clientOptions *options.ClientOptions) (*mongo.Client, error) {
+	client, err := mongo.Connect(context.Background(), clientOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	// connecting does not wait for the server, pinging does
+	ctx, cancel := context.WithTimeout(context.Background(), envDuration("MONGO_CONNECT_TIMEOUT", time.Second*10))
+	defer cancel()
+
+	if err = client.Ping(ctx, nil); err != nil {
+		_ = client.Disconnect(context.Background())
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// mongoOptions reads the connection settings from the environment. The
+// settings left unset keep the defaults of the driver
+func mongoOptions() *options.ClientOptions {
+	mongoURL := os.Getenv("MONGO_URL")
+	if mongoURL == "" {
+		mongoURL = defaultMongoURL
+	}
+
+	clientOptions := options.Client().ApplyURI(mongoURL)
+
+	if username := os.Getenv("MONGO_USERNAME"); username != "" {
+		clientOptions.SetAuth(options.Credential{
+			Username: username,
+			Password: os.Getenv("MONGO_PASSWORD"),
+		})
+	}
+
+	if value := os.Getenv("MONGO_MAX_POOL_SIZE"); value != "" {
+		clientOptions.SetMaxPoolSize(uint64(envInt64("MONGO_MAX_POOL_SIZE", 0)))
+	}
+
+	if value := os.Getenv("MONGO_MIN_POOL_SIZE"); value != "" {
+		clientOptions.SetMinPoolSize(uint64(envInt64("MONGO_MIN_POOL_SIZE", 0)))
+	}
+
+	if value := os.Getenv("MONGO_MAX_CONN_IDLE_TIME"); value != "" {
+		clientOptions.SetMaxConnIdleTime(envDuration("MONGO_MAX_CONN_IDLE_TIME", 0))
+	}
+
+	if value := os.Getenv("MONGO_CONNECT_TIMEOUT"); value != "" {
+		clientOptions.SetConnectTimeout(envDuration("MONGO_CONNECT_TIMEOUT", 0))
+	}
+
+	if value := os.Getenv("MONGO_SERVER_SELECTION_TIMEOUT"); value != "" {
+		clientOptions.SetServerSelectionTimeout(envDuration("MONGO_SERVER_SELECTION_TIMEOUT", 0))
+	}
+
+	if value := os.Getenv("MONGO_SOCKET_TIMEOUT"); value != "" {
+		clientOptions.SetSocketTimeout(envDuration("MONGO_SOCKET_TIMEOUT", 0))
+	}
+
+	return clientOptions
+}
+
+// envDuration reads a duration such as "30s" from an environment variable,
+// returning fallback when it is not set
+func envDuration(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 {
+		log.Panicf("%s must be a non negative duration, got %q", name, value)
+	}
+
+	return duration
+}
+
+// envInt64 reads a non negative integer from an environment variable,
+// returning fallback when it is not set
+func envInt64(name string, fallback int64) int64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		log.Panicf("%s must be a non negative integer, got %q", name, value)
+	}
+
+	return n
+}
+
+func connectToDB() *sql.DB {
+	// count is the number of times connecting to the database is attempted
+	count := 0
+
+	dataSourceName := os.Getenv("DSN")
+
+	for {
+		connection, err := openDB(dataSourceName)
+		if err != nil {
+			log.Println("Postgres not yet ready...")
+			count++
+		} else {
+			log.Println("Connected to PostgreSQL!")
+			return connection
+		}
+
+		if count >= maxCount {
+			log.Println(err)
+			return nil
+		}
+
+		log.Println("Backing off for two seconds...")
+		time.Sleep(timeInterval)
+	}
+}
+
+func openDB(dataSourceName string) (*sql.DB, error) {
+	db, err := sql.Open("pgx", dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Ping()
+	if err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"logger-service/data"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// subscriberBuffer is the number of entries queued for a client before
+	// new entries are dropped for it
+	subscriberBuffer = 256
+
+	// maxDropped is the number of entries a client may miss in a row before it
+	// is disconnected for being too slow
+	maxDropped = 1000
+
+	// keepAliveInterval is how often an idle stream is pinged, so proxies do
+	// not close the connection
+	keepAliveInterval = time.Second * 15
+
+	// streamWriteTimeout is the time a websocket client has to accept a message
+	streamWriteTimeout = time.Second * 10
+)
+
+// upgrader keeps the default origin check, which only accepts the pages
+// served from the host of the service or clients sending no origin. Unlike
+// the other endpoints, a websocket is not protected by CORS, so any page
+// could follow the stream with the cookies of its visitor otherwise
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// Hub fans out inserted log entries to the clients following the stream
+type Hub struct {
+	mu          sync.RWMutex
+	subscribers map[*subscriber]struct{}
+}
+
+// subscriber is one client following the stream
+type subscriber struct {
+	tenant  string
+	names   []string
+	levels  []string
+	entries chan *data.LogEntry
+
+	mu      sync.Mutex
+	dropped int
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		subscribers: make(map[*subscriber]struct{}),
+	}
+}
+
+// Publish queues the entry for every subscriber whose filters match it. It
+// never blocks: when the queue of a slow client is full the entry is dropped
+// for that client and the client is told how many entries it missed
+func (h *Hub) Publish(entry *data.LogEntry) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for sub := range h.subscribers {
+		if !sub.matches(entry) {
+			continue
+		}
+
+		select {
+		case sub.entries <- entry:
+		default:
+			sub.mu.Lock()
+			sub.dropped++
+			sub.mu.Unlock()
+		}
+	}
+}
+
+func (h *Hub) subscribe(tenant string, names, levels []string) *subscriber {
+	sub := &subscriber{
+		tenant:  tenant,
+		names:   names,
+		levels:  levels,
+		entries: make(chan *data.LogEntry, subscriberBuffer),
+	}
+
+	h.mu.Lock()
+	h.subscribers[sub] = struct{}{}
+	h.mu.Unlock()
+
+	return sub
+}
+
+func (h *Hub) unsubscribe(sub *subscriber) {
+	h.mu.Lock()
+	delete(h.subscribers, sub)
+	h.mu.Unlock()
+}
+
+func (s *subscriber) matches(entry *data.LogEntry) bool {
+	if s.tenant != "" && entry.Tenant != s.tenant {
+		return false
+	}
+
+	if len(s.names) > 0 && !slices.Contains(s.names, entry.Name) {
+		return false
+	}
+
+	if len(s.levels) > 0 && !slices.Contains(s.levels, entry.Level) {
+		return false
+	}
+
+	return true
+}
+
+// takeDropped returns the number of entries dropped since the last call
+func (s *subscriber) takeDropped() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dropped := s.dropped
+	s.dropped = 0
+
+	return dropped
+}
+
+// streamMessage is one message sent to a client following the stream
+type streamMessage struct {
+	Type    string         `json:"type"`
+	Entry   *data.LogEntry `json:"entry,omitempty"`
+	Dropped int            `json:"dropped,omitempty"`
+}
+
+// StreamLogs pushes new log entries to the client as they are inserted, using
+// a WebSocket when the client asks for an upgrade and Server-Sent Events
+// otherwise. The name and level query parameters, which may be repeated,
+// restrict the stream to matching entries
+func (app *Config) StreamLogs(w http.ResponseWriter, r *http.Request) {
+	tenant := ""
+	if t := tenantFrom(r); t != nil {
+		tenant = t.ID
+	}
+
+	query := r.URL.Query()
+	sub := app.Hub.subscribe(tenant, query["name"], query["level"])
+	defer app.Hub.unsubscribe(sub)
+
+	if websocket.IsWebSocketUpgrade(r) {
+		app.streamWebSocket(w, r, sub)
+		return
+	}
+
+	app.streamSSE(w, r, sub)
+}
+
+func (app *Config) streamSSE(w http.ResponseWriter, r *http.Request, sub *subscriber) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		_ = app.ErrorJSON(w, errors.New("streaming is not supported"), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	err := follow(r.Context(), sub, func(msg streamMessage) error {
+		var err error
+		if msg.Type == "ping" {
+			_, err = fmt.Fprint(w, ": ping\n\n")
+		} else {
+			var out []byte
+			out, err = json.Marshal(msg)
+			if err == nil {
+				_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", msg.Type, out)
+			}
+		}
+
+		flusher.Flush()
+		return err
+	})
+	if err != nil && !errors.Is(err, context.Canceled) {
+		log.Println("Log stream closed:", err)
+	}
+}
+
+func (app *Config) streamWebSocket(w http.ResponseWriter, r *http.Request, sub *subscriber) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader already replied with an error
+		return
+	}
+	defer conn.Close()
+
+	// the client is not expected to send anything, but the connection has to
+	// be read to process control frames and notice when it goes away
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	err = follow(ctx, sub, func(msg streamMessage) error {
+		_ = conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+
+		if msg.Type == "ping" {
+			return conn.WriteMessage(websocket.PingMessage, nil)
+		}
+
+		return conn.WriteJSON(msg)
+	})
+	if err != nil && !errors.Is(err, context.Canceled) {
+		log.Println("Log stream closed:", err)
+
+		_ = conn.WriteControl(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error()),
+			time.Now().Add(streamWriteTimeout),
+		)
+	}
+}
+
+// errTooSlow is returned when a client misses too many entries in a row
+var errTooSlow = errors.New("client is too slow to follow the stream")
+
+// follow passes the entries queued for the subscriber to send, preceded by a
+// notice whenever entries had to be dropped, until ctx is done or send fails
+func follow(ctx context.Context, sub *subscriber, send func(streamMessage) error) error {
+	ticker := time.NewTicker(keepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case <-ticker.C:
+			if err := send(streamMessage{Type: "ping"}); err != nil {
+				return err
+			}
+
+		case entry := <-sub.entries:
+			if dropped := sub.takeDropped(); dropped > 0 {
+				if dropped > maxDropped {
+					_ = send(streamMessage{Type: "dropped", Dropped: dropped})
+					return errTooSlow
+				}
+
+				if err := send(streamMessage{Type: "dropped", Dropped: dropped}); err != nil {
+					return err
+				}
+			}
+
+			if err := send(streamMessage{Type: "log", Entry: entry}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// startStream feeds the hub from a MongoDB change stream, so clients see the
+// entries inserted by every replica. When change streams are not available,
+// because MongoDB does not run as a replica set, the hub is fed with the
+// entries inserted by this process instead
+func (app *Config) startStream() {
+	stream, err := app.Models.LogEntry.Watch()
+	if err != nil {
+		log.Println("Change streams not available, streaming local inserts only:", err)
+		app.Models.LogEntry.OnInsert(app.Hub.Publish)
+		return
+	}
+
+	go func() {
+		err := stream.Each(context.Background(), app.Hub.Publish)
+
+		log.Println("Change stream closed, streaming local inserts only:", err)
+		app.Models.LogEntry.OnInsert(app.Hub.Publish)
+	}()
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"logger-service/ingest"
+	"net"
+	"os"
+	"strconv"
+)
+
+// maxSyslogMessage is the largest syslog message accepted, which is also the
+// largest UDP datagram
+const maxSyslogMessage = 64 * 1024
+
+var errSyslogTooLarge = errors.New("syslog message too large")
+
+// syslogReceiver stores the syslog messages received over UDP and TCP. Syslog
+// carries no API key, so every message goes to the same tenant
+type syslogReceiver struct {
+	app    *Config
+	tenant *Tenant
+}
+
+// listenSyslog listens for RFC 5424 syslog messages on the addresses set in
+// SYSLOG_UDP_ADDR and SYSLOG_TCP_ADDR (e.g. ":514"), if any. When tenants are
+// configured the messages are stored for DEFAULT_TENANT, which must be set
+func (app *Config) listenSyslog() {
+	udpAddr := os.Getenv("SYSLOG_UDP_ADDR")
+	tcpAddr := os.Getenv("SYSLOG_TCP_ADDR")
+	if udpAddr == "" && tcpAddr == "" {
+		return
+	}
+
+	receiver := &syslogReceiver{app: app}
+	if app.Tenants != nil {
+		receiver.tenant = app.Tenants.defaultTenant
+		if receiver.tenant == nil {
+			log.Panic("DEFAULT_TENANT must be set to receive syslog messages")
+		}
+	}
+
+	if udpAddr != "" {
+		conn, err := net.ListenPacket("udp", udpAddr)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		log.Println("Listening for syslog over UDP on", udpAddr)
+		go receiver.serveUDP(conn)
+	}
+
+	if tcpAddr != "" {
+		listener, err := net.Listen("tcp", tcpAddr)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		log.Println("Listening for syslog over TCP on", tcpAddr)
+		go receiver.serveTCP(listener)
+	}
+}
+
+// serveUDP handles datagrams, each holding one message
+func (s *syslogReceiver) serveUDP(conn net.PacketConn) {
+	buffer := make([]byte, maxSyslogMessage)
+
+	for {
+		n, _, err := conn.ReadFrom(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Println("Error reading syslog datagram:", err)
+			continue
+		}
+
+		s.receive(buffer[:n])
+	}
+}
+
+func (s *syslogReceiver) serveTCP(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Println("Error accepting syslog connection:", err)
+			continue
+		}
+
+		go s.serveConn(conn)
+	}
+}
+
+// serveConn reads the messages of one TCP connection, framed either by octet
+// counting or by newlines as described in RFC 6587
+func (s *syslogReceiver) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReaderSize(conn, maxSyslogMessage)
+
+	for {
+		message, err := readSyslogFrame(reader)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Println("Closing syslog connection:", err)
+			}
+			return
+		}
+
+		if len(bytes.TrimSpace(message)) > 0 {
+			s.receive(message)
+		}
+	}
+}
+
+// readSyslogFrame reads the next message of a TCP stream. Octet counted frames
+// start with the length of the message, the others end at a newline
+func readSyslogFrame(reader *bufio.Reader) ([]byte, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	if first[0] < '0' || first[0] > '9' {
+		line, err := reader.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			return nil, errSyslogTooLarge
+		}
+		if err != nil && (!errors.Is(err, io.EOF) || len(line) == 0) {
+			return nil, err
+		}
+
+		return line, nil
+	}
+
+	prefix, err := reader.ReadSlice(' ')
+	if err != nil {
+		return nil, err
+	}
+
+	length, err := strconv.Atoi(string(prefix[:len(prefix)-1]))
+	if err != nil {
+		return nil, err
+	}
+	if length > maxSyslogMessage {
+		return nil, errSyslogTooLarge
+	}
+
+	message := make([]byte, length)
+	if _, err = io.ReadFull(reader, message); err != nil {
+		return nil, err
+	}
+
+	return message, nil
+}
+
+// receive parses and stores one message
+func (s *syslogReceiver) receive(message []byte) {
+	entry, err := ingest.ParseSyslog(message)
+	if err != nil {
+		log.Println("Error parsing syslog message:", err)
+		return
+	}
+
+	entry.Data = s.app.redact(entry.Data)
+	s.app.redactAttributes(entry.Attributes)
+
+	if err = s.app.reserveFor(s.tenant, *entry); err != nil {
+		log.Println("Dropping syslog message:", err)
+		return
+	}
+
+	models := s.app.Models
+	if s.tenant != nil {
+		models = models.ForTenant(s.tenant.ID)
+	}
+
+	// errors are logged by Insert
+	folded, err := models.LogEntry.Insert(*entry)
+	s.app.settle(s.tenant, *entry, folded, err)
+}
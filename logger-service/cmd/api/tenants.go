@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"logger-service/data"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// storageRefreshInterval is how long the storage used by a tenant is trusted
+// before it is measured again. In between, inserted bytes are added to it
+const storageRefreshInterval = time.Minute
+
+type contextKey string
+
+const tenantContextKey contextKey = "tenant"
+
+var (
+	errUnauthenticated = errors.New("a valid API key is required")
+	errForbidden       = errors.New("this API key is not allowed to manage the logger-service")
+	errStorageQuota    = errors.New("storage quota exceeded")
+)
+
+// rateLimitError is returned when an insert exceeds a rate limit, either the
+// one of the tenant or, when source is set, the one of a source
+type rateLimitError struct {
+	source     string
+	retryAfter time.Duration
+}
+
+func (e *rateLimitError) Error() string {
+	if e.source != "" {
+		return fmt.Sprintf("insert rate limit of source %q exceeded, retry in %s", e.source, e.retryAfter.Round(time.Second))
+	}
+
+	return fmt.Sprintf("insert rate limit exceeded, retry in %s", e.retryAfter.Round(time.Second))
+}
+
+// Tenant is one project or team writing logs. Its entries are stored with
+// its id and its API keys only give access to those entries
+type Tenant struct {
+	ID      string   `json:"id"`
+	APIKeys []string `json:"api_keys"`
+	// Admin allows managing retention and archives, which span all tenants
+	Admin bool `json:"admin"`
+	// InsertRate is the number of entries the tenant may insert per minute,
+	// zero means unlimited
+	InsertRate int `json:"insert_rate"`
+	// MaxStorage is the number of bytes of names, messages and attributes the
+	// tenant may keep, zero means unlimited
+	MaxStorage int64 `json:"max_storage_bytes"`
+}
+
+// Tenants identifies the tenant of each request and enforces its quotas
+type Tenants struct {
+	byKey         map[string]*Tenant
+	defaultTenant *Tenant
+	models        data.Models
+	limiter       *rateLimiter
+
+	mu    sync.Mutex
+	usage map[string]*storageUsage
+}
+
+type storageUsage struct {
+	bytes    int64
+	measured time.Time
+}
+
+// createTenants loads the tenants from the JSON file named by TENANTS_FILE.
+// Requests without an API key are assigned to the tenant named by
+// DEFAULT_TENANT, or rejected when it is not set. It returns nil when no
+// tenants are configured, in which case every request sees every entry
+func createTenants(models data.Models) *Tenants {
+	path := os.Getenv("TENANTS_FILE")
+	if path == "" {
+		return nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	var list []*Tenant
+	if err = json.Unmarshal(content, &list); err != nil {
+		log.Panicf("Error reading %s: %v", path, err)
+	}
+
+	tenants := &Tenants{
+		byKey:   make(map[string]*Tenant),
+		models:  models,
+		limiter: newRateLimiter(),
+		usage:   make(map[string]*storageUsage),
+	}
+
+	for _, tenant := range list {
+		if tenant.ID == "" {
+			log.Panicf("Every tenant in %s needs an id", path)
+		}
+
+		for _, key := range tenant.APIKeys {
+			tenants.byKey[key] = tenant
+		}
+
+		if tenant.ID == os.Getenv("DEFAULT_TENANT") {
+			tenants.defaultTenant = tenant
+		}
+	}
+
+	if name := os.Getenv("DEFAULT_TENANT"); name != "" && tenants.defaultTenant == nil {
+		log.Panicf("DEFAULT_TENANT %s is not defined in %s", name, path)
+	}
+
+	return tenants
+}
+
+// authenticate returns the tenant owning the API key of the request, sent in
+// the X-API-Key header or as a bearer token
+func (t *Tenants) authenticate(r *http.Request) *Tenant {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		key, _ = strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+
+	if key == "" {
+		return t.defaultTenant
+	}
+
+	return t.byKey[key]
+}
+
+// reserve checks that the tenant may insert entries taking the given number
+// of bytes, and counts the entries against its rate. The bytes are only
+// counted by store, once the entries are stored
+func (t *Tenants) reserve(tenant *Tenant, entries int, bytes int64) error {
+	if tenant.MaxStorage > 0 {
+		used, err := t.storageUsed(tenant)
+		if err != nil {
+			return err
+		}
+
+		if used+bytes > tenant.MaxStorage {
+			return errStorageQuota
+		}
+	}
+
+	if tenant.InsertRate > 0 {
+		if ok, wait := t.limiter.allow(tenant.ID, entries, tenant.InsertRate); !ok {
+			return &rateLimitError{retryAfter: wait}
+		}
+	}
+
+	return nil
+}
+
+// store counts the bytes of stored entries against the storage quota of the
+// tenant
+func (t *Tenants) store(tenant *Tenant, bytes int64) {
+	if tenant.MaxStorage <= 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// the bytes are measured again with the next reservation otherwise
+	if usage, ok := t.usage[tenant.ID]; ok {
+		usage.bytes += bytes
+	}
+}
+
+// refund gives back the rate taken by reserve for entries that could not be
+// inserted
+func (t *Tenants) refund(tenant *Tenant, entries int) {
+	if tenant.InsertRate > 0 {
+		t.limiter.refund(tenant.ID, entries)
+	}
+}
+
+// storageUsed returns the bytes used by the tenant, measuring them again when
+// the last measurement is too old
+func (t *Tenants) storageUsed(tenant *Tenant) (int64, error) {
+	t.mu.Lock()
+	usage, ok := t.usage[tenant.ID]
+	t.mu.Unlock()
+
+	if ok && time.Since(usage.measured) < storageRefreshInterval {
+		return usage.bytes, nil
+	}
+
+	models := t.models.ForTenant(tenant.ID)
+
+	bytes, err := models.LogEntry.StorageUsed()
+	if err != nil {
+		return 0, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.usage[tenant.ID] = &storageUsage{bytes: bytes, measured: time.Now()}
+
+	return bytes, nil
+}
+
+// identifyTenant stores the tenant of the request in its context, rejecting
+// requests that do not belong to any tenant
+func (app *Config) identifyTenant(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.Tenants == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		tenant := app.Tenants.authenticate(r)
+		if tenant == nil {
+			_ = app.ErrorJSON(w, errUnauthenticated, http.StatusUnauthorized)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), tenantContextKey, tenant)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requireAdmin only lets through the requests of admin tenants
+func (app *Config) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tenant := tenantFrom(r); tenant != nil && !tenant.Admin {
+			_ = app.ErrorJSON(w, errForbidden, http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// tenantFrom returns the tenant of the request, nil when tenants are not
+// configured
+func tenantFrom(r *http.Request) *Tenant {
+	tenant, _ := r.Context().Value(tenantContextKey).(*Tenant)
+	return tenant
+}
+
+// tenantModels returns the models restricted to the tenant of the request
+func (app *Config) tenantModels(r *http.Request) data.Models {
+	if tenant := tenantFrom(r); tenant != nil {
+		return app.Models.ForTenant(tenant.ID)
+	}
+
+	return app.Models
+}
+
+// reserve counts an entry against the rate of its source and the quotas of
+// the tenant of the request. It is completed by settle once the entry is
+// inserted
+func (app *Config) reserve(r *http.Request, entry data.LogEntry) error {
+	return app.reserveFor(tenantFrom(r), entry)
+}
+
+// reserveFor counts an entry against the rate of its source and the quotas of
+// the given tenant, which is nil when tenants are not configured
+func (app *Config) reserveFor(tenant *Tenant, entry data.LogEntry) error {
+	tenantID := ""
+	if tenant != nil {
+		tenantID = tenant.ID
+	}
+
+	if err := app.SourceLimits.allow(tenantID, entry.Name); err != nil {
+		return err
+	}
+
+	if tenant == nil {
+		return nil
+	}
+
+	if err := app.Tenants.reserve(tenant, 1, entry.Size()); err != nil {
+		app.SourceLimits.refund(tenantID, entry.Name)
+		return err
+	}
+
+	return nil
+}
+
+// settle completes the reservation of an entry once it was inserted. An entry
+// stored on its own counts against the storage quota, while an entry folded
+// into an identical one takes no storage. The rates are only given back for
+// an entry that could not be inserted, a flood of identical entries is still
+// limited
+func (app *Config) settle(tenant *Tenant, entry data.LogEntry, folded bool, err error) {
+	if err == nil {
+		if tenant != nil && !folded {
+			app.Tenants.store(tenant, entry.Size())
+		}
+		return
+	}
+
+	tenantID := ""
+	if tenant != nil {
+		tenantID = tenant.ID
+		app.Tenants.refund(tenant, 1)
+	}
+
+	app.SourceLimits.refund(tenantID, entry.Name)
+}
+
+// quotaError sends the response for an error returned by reserve
+func (app *Config) quotaError(w http.ResponseWriter, err error) {
+	var rateErr *rateLimitError
+
+	switch {
+	case errors.As(err, &rateErr):
+		setRetryAfter(w, rateErr.retryAfter)
+		_ = app.ErrorJSON(w, err, http.StatusTooManyRequests)
+	case errors.Is(err, errStorageQuota):
+		_ = app.ErrorJSON(w, err, http.StatusInsufficientStorage)
+	default:
+		_ = app.ErrorJSON(w, err, http.StatusInternalServerError)
+	}
+}
+
+// setRetryAfter tells the client how many seconds to wait before retrying
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+}
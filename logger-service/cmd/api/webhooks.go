@@ -0,0 +1,306 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"logger-service/data"
+	"logger-service/webhook"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+	"tools"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	// webhooksRefreshInterval is how often the webhooks are reloaded, so that
+	// changes made through another replica are picked up
+	webhooksRefreshInterval = time.Minute
+
+	// deliveryRetention is how long the delivery history of the webhooks is
+	// kept
+	deliveryRetention = time.Hour * 24 * 7
+
+	defaultDeliveriesLimit = 50
+	maxDeliveriesLimit     = 500
+)
+
+type WebhookPayload struct {
+	URL      string          `json:"url"`
+	Events   []string        `json:"events"`
+	Match    data.AlertMatch `json:"match"`
+	Secret   string          `json:"secret"`
+	Disabled bool            `json:"disabled"`
+}
+
+// webhookResponse is a webhook as returned to the callers. The secret is only
+// returned when the webhook is created, the stores keep it in Webhook
+type webhookResponse struct {
+	*data.Webhook
+	Secret string `json:"secret,omitempty"`
+}
+
+// webhookResponses hides the secrets of webhooks
+func webhookResponses(hooks []*data.Webhook) []webhookResponse {
+	responses := make([]webhookResponse, len(hooks))
+	for i, hook := range hooks {
+		responses[i] = webhookResponse{Webhook: hook}
+	}
+
+	return responses
+}
+
+// GetWebhooks lists the webhooks of the caller
+func (app *Config) GetWebhooks(w http.ResponseWriter, r *http.Request) {
+	models := app.tenantModels(r)
+
+	hooks, err := models.Webhook.All()
+	if err != nil {
+		_ = app.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := tools.JsonResponse{
+		Error:   false,
+		Message: "webhooks",
+		Data:    webhookResponses(hooks),
+	}
+
+	_ = app.WriteJSON(w, http.StatusOK, resp)
+}
+
+// GetWebhook returns one webhook by id
+func (app *Config) GetWebhook(w http.ResponseWriter, r *http.Request) {
+	models := app.tenantModels(r)
+
+	hook, err := models.Webhook.GetOne(chi.URLParam(r, "id"))
+	if err != nil {
+		app.webhookError(w, err)
+		return
+	}
+
+	resp := tools.JsonResponse{
+		Error:   false,
+		Message: "webhook",
+		Data:    webhookResponse{Webhook: hook},
+	}
+
+	_ = app.WriteJSON(w, http.StatusOK, resp)
+}
+
+// CreateWebhook subscribes a URL to events. A secret is generated when none
+// is given, it is returned so the receiver can verify the signatures. It is
+// the only response with the secret
+func (app *Config) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	hook, err := app.readWebhook(w, r)
+	if err != nil {
+		_ = app.ErrorJSON(w, err)
+		return
+	}
+
+	if hook.Secret == "" {
+		hook.Secret, err = newWebhookSecret()
+		if err != nil {
+			_ = app.ErrorJSON(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	models := app.tenantModels(r)
+
+	saved, err := models.Webhook.Insert(*hook)
+	if err != nil {
+		_ = app.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.loadWebhooks()
+
+	resp := tools.JsonResponse{
+		Error:   false,
+		Message: "webhook created",
+		Data:    webhookResponse{Webhook: saved, Secret: saved.Secret},
+	}
+
+	_ = app.WriteJSON(w, http.StatusCreated, resp)
+}
+
+// UpdateWebhook replaces a webhook. Enabling a webhook that was disabled
+// after failing resets its failures, and leaving the secret empty keeps the
+// current one
+func (app *Config) UpdateWebhook(w http.ResponseWriter, r *http.Request) {
+	hook, err := app.readWebhook(w, r)
+	if err != nil {
+		_ = app.ErrorJSON(w, err)
+		return
+	}
+
+	hook.ID = chi.URLParam(r, "id")
+
+	models := app.tenantModels(r)
+
+	if hook.Secret == "" {
+		existing, err := models.Webhook.GetOne(hook.ID)
+		if err != nil {
+			app.webhookError(w, err)
+			return
+		}
+
+		hook.Secret = existing.Secret
+	}
+
+	saved, err := models.Webhook.Update(*hook)
+	if err != nil {
+		app.webhookError(w, err)
+		return
+	}
+
+	app.loadWebhooks()
+
+	resp := tools.JsonResponse{
+		Error:   false,
+		Message: "webhook saved",
+		Data:    webhookResponse{Webhook: saved},
+	}
+
+	_ = app.WriteJSON(w, http.StatusAccepted, resp)
+}
+
+// DeleteWebhook removes a webhook and its delivery history
+func (app *Config) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	models := app.tenantModels(r)
+
+	err := models.Webhook.DeleteByID(chi.URLParam(r, "id"))
+	if err != nil {
+		app.webhookError(w, err)
+		return
+	}
+
+	app.loadWebhooks()
+
+	resp := tools.JsonResponse{
+		Error:   false,
+		Message: "webhook deleted",
+	}
+
+	_ = app.WriteJSON(w, http.StatusAccepted, resp)
+}
+
+// GetWebhookDeliveries returns the latest delivery attempts of a webhook, the
+// most recent first. The number of attempts is set by the limit parameter
+func (app *Config) GetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	limit := defaultDeliveriesLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxDeliveriesLimit {
+			_ = app.ErrorJSON(w, fmt.Errorf("limit must be between 1 and %d", maxDeliveriesLimit))
+			return
+		}
+		limit = parsed
+	}
+
+	models := app.tenantModels(r)
+
+	deliveries, err := models.Webhook.Deliveries(chi.URLParam(r, "id"), limit)
+	if err != nil {
+		app.webhookError(w, err)
+		return
+	}
+
+	resp := tools.JsonResponse{
+		Error:   false,
+		Message: "webhook deliveries",
+		Data:    deliveries,
+	}
+
+	_ = app.WriteJSON(w, http.StatusOK, resp)
+}
+
+// readWebhook reads and validates the webhook in the request body
+func (app *Config) readWebhook(w http.ResponseWriter, r *http.Request) (*data.Webhook, error) {
+	var requestPayload WebhookPayload
+
+	if err := app.ReadJSON(w, r, &requestPayload); err != nil {
+		return nil, err
+	}
+
+	target, err := url.Parse(requestPayload.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return nil, errors.New("url must be an http or https URL")
+	}
+
+	if len(requestPayload.Events) == 0 {
+		return nil, fmt.Errorf("events must list at least one of %v", webhook.Events)
+	}
+
+	for _, event := range requestPayload.Events {
+		if !slices.Contains(webhook.Events, event) {
+			return nil, fmt.Errorf("unknown event %q, events must be among %v", event, webhook.Events)
+		}
+	}
+
+	return &data.Webhook{
+		URL:      requestPayload.URL,
+		Events:   requestPayload.Events,
+		Match:    requestPayload.Match,
+		Secret:   requestPayload.Secret,
+		Disabled: requestPayload.Disabled,
+	}, nil
+}
+
+func (app *Config) webhookError(w http.ResponseWriter, err error) {
+	if errors.Is(err, data.ErrNotFound) {
+		_ = app.ErrorJSON(w, errors.New("webhook not found"), http.StatusNotFound)
+		return
+	}
+
+	_ = app.ErrorJSON(w, err, http.StatusInternalServerError)
+}
+
+// loadWebhooks gives the dispatcher the current webhooks of every tenant
+func (app *Config) loadWebhooks() {
+	hooks, err := app.Models.Webhook.All()
+	if err != nil {
+		log.Println("Error loading webhooks:", err)
+		return
+	}
+
+	app.Webhooks.SetWebhooks(hooks)
+}
+
+// refreshWebhooks periodically reloads the webhooks, so changes made through
+// another replica are picked up, and deletes the old delivery history
+func (app *Config) refreshWebhooks(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var pruned time.Time
+	for range ticker.C {
+		app.loadWebhooks()
+
+		if time.Since(pruned) < time.Hour {
+			continue
+		}
+		pruned = time.Now()
+
+		_, err := app.Models.Webhook.PruneDeliveries(time.Now().Add(-deliveryRetention))
+		if err != nil {
+			log.Println("Error pruning webhook deliveries:", err)
+		}
+	}
+}
+
+func newWebhookSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(secret), nil
+}
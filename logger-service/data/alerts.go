@@ -0,0 +1,188 @@
+package data
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// AlertRule fires when more than Threshold log entries matched by Match are
+// inserted within Window seconds. Once fired, it does not notify again until
+// Cooldown seconds have passed. When Tenant is set on the receiver of a
+// method, the method only sees and creates the rules of that tenant
+type AlertRule struct {
+	ID        string      `bson:"_id,omitempty" json:"id,omitempty"`
+	Tenant    string      `bson:"tenant,omitempty" json:"tenant,omitempty"`
+	Name      string      `bson:"name" json:"name"`
+	Match     AlertMatch  `bson:"match" json:"match"`
+	Threshold int         `bson:"threshold" json:"threshold"`
+	Window    int64       `bson:"window_seconds" json:"window_seconds"`
+	Cooldown  int64       `bson:"cooldown_seconds" json:"cooldown_seconds"`
+	Notify    AlertNotify `bson:"notify" json:"notify"`
+	Disabled  bool        `bson:"disabled,omitempty" json:"disabled,omitempty"`
+	CreatedAt time.Time   `bson:"created_at" json:"created_at"`
+	UpdatedAt time.Time   `bson:"updated_at" json:"updated_at"`
+}
+
+// AlertMatch selects the log entries counted by a rule. Fields left empty
+// match any entry
+type AlertMatch struct {
+	Name  string `bson:"name,omitempty" json:"name,omitempty"`
+	Level string `bson:"level,omitempty" json:"level,omitempty"`
+	// Contains must appear in the data of the entry
+	Contains string `bson:"contains,omitempty" json:"contains,omitempty"`
+	// Fields must all have the given value, either as attributes of the entry
+	// or as top level fields of its data when it is a JSON object
+	Fields map[string]string `bson:"fields,omitempty" json:"fields,omitempty"`
+}
+
+// Matches reports whether the entry is selected
+func (m AlertMatch) Matches(entry *LogEntry) bool {
+	if m.Name != "" && entry.Name != m.Name {
+		return false
+	}
+
+	if m.Level != "" && entry.Level != m.Level {
+		return false
+	}
+
+	if m.Contains != "" && !strings.Contains(entry.Data, m.Contains) {
+		return false
+	}
+
+	if len(m.Fields) == 0 {
+		return true
+	}
+
+	fields := dataFields(entry.Data)
+	for key, want := range m.Fields {
+		value, ok := entry.Attributes[key]
+		if !ok {
+			value, ok = fields[key]
+		}
+
+		if !ok || value != want {
+			return false
+		}
+	}
+
+	return true
+}
+
+// AlertNotify lists where the notifications of a rule are sent
+type AlertNotify struct {
+	// Email addresses are notified through the mail-service
+	Email   []string `bson:"email,omitempty" json:"email,omitempty"`
+	Webhook string   `bson:"webhook,omitempty" json:"webhook,omitempty"`
+}
+
+// All returns the alert rules, ordered by name
+func (a *AlertRule) All() ([]*AlertRule, error) {
+	all, err := store.Rules()
+	if err != nil {
+		return nil, err
+	}
+
+	if a.Tenant == "" {
+		return all, nil
+	}
+
+	var own []*AlertRule
+	for _, rule := range all {
+		if rule.Tenant == a.Tenant {
+			own = append(own, rule)
+		}
+	}
+
+	return own, nil
+}
+
+// GetOne returns one alert rule by id, or ErrNotFound
+func (a *AlertRule) GetOne(id string) (*AlertRule, error) {
+	all, err := a.All()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rule := range all {
+		if rule.ID == id {
+			return rule, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+// Insert saves a new alert rule and returns it with its id
+func (a *AlertRule) Insert(rule AlertRule) (*AlertRule, error) {
+	now := time.Now().UTC()
+
+	rule.ID = primitive.NewObjectID().Hex()
+	rule.Tenant = a.Tenant
+	rule.CreatedAt = now
+	rule.UpdatedAt = now
+
+	if err := store.SaveRule(&rule); err != nil {
+		return nil, err
+	}
+
+	return &rule, nil
+}
+
+// Update replaces the alert rule with the id of the given rule, or returns
+// ErrNotFound
+func (a *AlertRule) Update(rule AlertRule) (*AlertRule, error) {
+	existing, err := a.GetOne(rule.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	rule.Tenant = existing.Tenant
+	rule.CreatedAt = existing.CreatedAt
+	rule.UpdatedAt = time.Now().UTC()
+
+	if err = store.SaveRule(&rule); err != nil {
+		return nil, err
+	}
+
+	return &rule, nil
+}
+
+// DeleteByID removes one alert rule by id, or returns ErrNotFound
+func (a *AlertRule) DeleteByID(id string) error {
+	if _, err := a.GetOne(id); err != nil {
+		return err
+	}
+
+	return store.DeleteRule(id)
+}
+
+// dataFields returns the top level fields of text when it is a JSON object,
+// with their values formatted as text
+func dataFields(text string) map[string]string {
+	if !strings.HasPrefix(strings.TrimSpace(text), "{") {
+		return nil
+	}
+
+	var object map[string]any
+	if err := json.Unmarshal([]byte(text), &object); err != nil {
+		return nil
+	}
+
+	fields := make(map[string]string, len(object))
+	for key, value := range object {
+		switch value := value.(type) {
+		case string:
+			fields[key] = value
+		case nil:
+			fields[key] = ""
+		default:
+			encoded, _ := json.Marshal(value)
+			fields[key] = string(encoded)
+		}
+	}
+
+	return fields
+}
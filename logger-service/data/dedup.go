@@ -0,0 +1,121 @@
+package data
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxDedupKeys bounds the memory used by the deduplication. Once that many
+// distinct entries are tracked, new entries are inserted without being
+// tracked until the oldest ones leave the window
+const maxDedupKeys = 100000
+
+// dedup folds identical entries together, it is nil when deduplication is
+// disabled. It is set by Deduplicate before the service starts
+var dedup *deduplicator
+
+// Repeat records that identical entries were folded into the entry with the
+// given id. Count includes the entry itself
+type Repeat struct {
+	ID        string    `json:"id"`
+	Count     int64     `json:"count"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// deduplicator remembers the entries inserted within the window, by the hash
+// of their content
+type deduplicator struct {
+	window time.Duration
+
+	mu    sync.Mutex
+	seen  map[string]*Repeat
+	swept time.Time
+}
+
+// Deduplicate folds the entries identical to an entry inserted less than
+// window ago into that entry, instead of inserting them. The folded entry
+// counts how many times it was received and when it was first and last seen.
+// Entries are identical when their tenant, name, level, data and attributes
+// are. A window of zero disables deduplication
+func (l *LogEntry) Deduplicate(window time.Duration) {
+	if window <= 0 {
+		dedup = nil
+		return
+	}
+
+	dedup = &deduplicator{
+		window: window,
+		seen:   make(map[string]*Repeat),
+		swept:  time.Now(),
+	}
+}
+
+// fold returns the entry an entry received at now is folded into, counting
+// it, or nil when the entry is new. A new entry is remembered under id, until
+// forget is called when it could not be inserted
+func (d *deduplicator) fold(key, id string, now time.Time) *Repeat {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if now.Sub(d.swept) >= d.window {
+		for k, repeat := range d.seen {
+			if now.Sub(repeat.FirstSeen) >= d.window {
+				delete(d.seen, k)
+			}
+		}
+		d.swept = now
+	}
+
+	if repeat, ok := d.seen[key]; ok && now.Sub(repeat.FirstSeen) < d.window {
+		repeat.Count++
+		repeat.LastSeen = now
+
+		folded := *repeat
+		return &folded
+	}
+
+	if len(d.seen) < maxDedupKeys {
+		d.seen[key] = &Repeat{ID: id, Count: 1, FirstSeen: now, LastSeen: now}
+	}
+
+	return nil
+}
+
+// forget stops folding entries into an entry that could not be inserted
+func (d *deduplicator) forget(key, id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if repeat, ok := d.seen[key]; ok && repeat.ID == id {
+		delete(d.seen, key)
+	}
+}
+
+// dedupKey hashes the fields that make two entries identical
+func dedupKey(tenant string, entry *LogEntry) string {
+	hash := sha256.New()
+
+	for _, field := range []string{tenant, entry.Name, entry.Level, entry.Data} {
+		hash.Write([]byte(field))
+		hash.Write([]byte{0})
+	}
+
+	keys := make([]string, 0, len(entry.Attributes))
+	for key := range entry.Attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		hash.Write([]byte(key))
+		hash.Write([]byte{0})
+		hash.Write([]byte(entry.Attributes[key]))
+		hash.Write([]byte{0})
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
@@ -0,0 +1,1253 @@
+package data
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	logFilePrefix = "logs-"
+	logFileSuffix = ".ndjson"
+
+	// logFileTimeFormat names the log files after the time they were created
+	// at, so that sorting their names sorts them from oldest to newest
+	logFileTimeFormat = "20060102T150405.000000000"
+
+	policiesFile = "retention_policies.json"
+	rulesFile    = "alert_rules.json"
+	webhooksFile = "webhooks.json"
+
+	deliveriesFile = "webhook_deliveries.ndjson"
+)
+
+// errStopScan stops going through the log files without reporting an error
+var errStopScan = errors.New("stop scan")
+
+// fileStore appends the log entries as NDJSON to files in a directory,
+// starting a new file once the current one reaches maxBytes and removing the
+// oldest files beyond maxFiles. Deleting entries appends a record of their
+// ids, and the expiry of an entry is calculated from the current policies
+// whenever it is read. Expired entries are removed with the oldest files once
+// every entry they hold has expired, and Compact rewrites the files without
+// the deleted entries
+type fileStore struct {
+	dir      string
+	maxBytes int64
+	maxFiles int
+
+	// mu guards the current file and the list of files
+	mu      sync.Mutex
+	current *os.File
+	size    int64
+
+	deletedMu sync.RWMutex
+	deleted   map[string]bool
+
+	// compactMu keeps deletions and restores from changing deleted while
+	// the files are compacted
+	compactMu sync.RWMutex
+
+	// repeats are the latest counts of the entries identical entries were
+	// folded into, by id
+	repeatsMu sync.RWMutex
+	repeats   map[string]Repeat
+
+	policiesMu   sync.Mutex
+	rulesMu      sync.Mutex
+	webhooksMu   sync.Mutex
+	deliveriesMu sync.Mutex
+}
+
+// fileRecord is one line of a log file: either a log entry, the ids of
+// entries deleted or restored at that point, or the repeats of entries
+type fileRecord struct {
+	*LogEntry
+	Deleted  []string `json:"deleted,omitempty"`
+	Restored []string `json:"restored,omitempty"`
+	Repeated []Repeat `json:"repeated,omitempty"`
+}
+
+// NewFileStore returns a store keeping the log entries in files in dir. A
+// maxFiles of zero keeps every file until retention removes it. The file store
+// does not support full-text search nor following inserts of other replicas
+func NewFileStore(dir string, maxBytes int64, maxFiles int) (Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	s := &fileStore{
+		dir:      dir,
+		maxBytes: maxBytes,
+		maxFiles: maxFiles,
+		deleted:  make(map[string]bool),
+		repeats:  make(map[string]Repeat),
+	}
+
+	paths, err := s.files()
+	if err != nil {
+		return nil, err
+	}
+
+	// replay the deletions, in order since a deleted entry may be restored,
+	// and the repeats
+	for _, path := range paths {
+		err = scanLogFile(path, -1, func(record *fileRecord) error {
+			for _, id := range record.Deleted {
+				s.deleted[id] = true
+			}
+			for _, id := range record.Restored {
+				delete(s.deleted, id)
+			}
+			for _, repeat := range record.Repeated {
+				s.addRepeat(repeat)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(paths) == 0 {
+		err = s.startFile()
+	} else {
+		err = s.openFile(paths[len(paths)-1])
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *fileStore) Insert(entries []LogEntry) (map[int]error, error) {
+	records := make([]fileRecord, len(entries))
+	for i := range entries {
+		records[i] = fileRecord{LogEntry: &entries[i]}
+	}
+
+	if err := s.append(records...); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// Each goes through the entries in the order they were written, which is the
+// order they were created in except for restored entries
+func (s *fileStore) Each(ctx context.Context, tenant string, filter Filter, fn func(*LogEntry) error) error {
+	return s.eachRecord(func(record *fileRecord) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		entry := record.LogEntry
+		if entry == nil || (tenant != "" && entry.Tenant != tenant) || s.isDeleted(entry.ID) {
+			return nil
+		}
+
+		entry.ExpireAt = expiryFor(entry.Name, entry.Level, entry.CreatedAt)
+		s.applyRepeat(entry)
+
+		if !filter.matches(entry) {
+			return nil
+		}
+
+		return fn(entry)
+	})
+}
+
+func (s *fileStore) GetOne(tenant, id string) (*LogEntry, error) {
+	var found *LogEntry
+
+	err := s.Each(context.Background(), tenant, Filter{}, func(entry *LogEntry) error {
+		if entry.ID != id {
+			return nil
+		}
+
+		found = entry
+		return errStopScan
+	})
+	if err != nil && !errors.Is(err, errStopScan) {
+		return nil, err
+	}
+
+	if found == nil {
+		return nil, ErrNotFound
+	}
+
+	return found, nil
+}
+
+// Update is not supported, entries are never rewritten
+func (s *fileStore) Update(tenant string, entry *LogEntry) error {
+	return ErrNotSupported
+}
+
+// DeleteByIDs records the deletion of the entries. Without a tenant the ids
+// are trusted to exist, which avoids going through every file
+func (s *fileStore) DeleteByIDs(tenant string, ids []string) (int64, error) {
+	s.compactMu.RLock()
+	defer s.compactMu.RUnlock()
+
+	targets := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		if !s.isDeleted(id) {
+			targets[id] = true
+		}
+	}
+
+	if tenant != "" {
+		owned := make(map[string]bool, len(targets))
+
+		err := s.Each(context.Background(), tenant, Filter{}, func(entry *LogEntry) error {
+			if targets[entry.ID] {
+				owned[entry.ID] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+
+		targets = owned
+	}
+
+	if len(targets) == 0 {
+		return 0, nil
+	}
+
+	deleted := make([]string, 0, len(targets))
+	for id := range targets {
+		deleted = append(deleted, id)
+	}
+
+	if err := s.append(fileRecord{Deleted: deleted}); err != nil {
+		return 0, err
+	}
+
+	s.deletedMu.Lock()
+	for _, id := range deleted {
+		s.deleted[id] = true
+	}
+	s.deletedMu.Unlock()
+
+	return int64(len(deleted)), nil
+}
+
+// Restore undoes the deletion of the entries still present in the files and
+// appends the others
+func (s *fileStore) Restore(entries []*LogEntry) (int, error) {
+	s.compactMu.RLock()
+	defer s.compactMu.RUnlock()
+
+	wanted := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		wanted[entry.ID] = true
+	}
+
+	present := make(map[string]bool)
+	err := s.eachRecord(func(record *fileRecord) error {
+		if record.LogEntry != nil && wanted[record.ID] {
+			present[record.ID] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var restored []string
+	var records []fileRecord
+	for _, entry := range entries {
+		switch {
+		case present[entry.ID] && s.isDeleted(entry.ID):
+			restored = append(restored, entry.ID)
+		case !present[entry.ID]:
+			records = append(records, fileRecord{LogEntry: entry})
+			// an entry may appear twice in the same batch
+			present[entry.ID] = true
+		}
+	}
+
+	appended := len(records)
+	if len(restored) > 0 {
+		records = append(records, fileRecord{Restored: restored})
+	}
+
+	if len(records) == 0 {
+		return 0, nil
+	}
+
+	if err = s.append(records...); err != nil {
+		return 0, err
+	}
+
+	s.deletedMu.Lock()
+	for _, id := range restored {
+		delete(s.deleted, id)
+	}
+	s.deletedMu.Unlock()
+
+	return appended + len(restored), nil
+}
+
+// Repeat appends a record of the repeats, which are applied to the entries
+// whenever they are read
+func (s *fileStore) Repeat(repeats []Repeat) error {
+	if err := s.append(fileRecord{Repeated: repeats}); err != nil {
+		return err
+	}
+
+	s.repeatsMu.Lock()
+	defer s.repeatsMu.Unlock()
+
+	for _, repeat := range repeats {
+		s.addRepeat(repeat)
+	}
+
+	return nil
+}
+
+func (s *fileStore) Drop(tenant string) error {
+	if tenant != "" {
+		var ids []string
+
+		err := s.Each(context.Background(), tenant, Filter{}, func(entry *LogEntry) error {
+			ids = append(ids, entry.ID)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		_, err = s.DeleteByIDs("", ids)
+
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	paths, err := s.files()
+	if err != nil {
+		return err
+	}
+
+	_ = s.current.Close()
+
+	for _, path := range paths {
+		if err = os.Remove(path); err != nil {
+			log.Println("Error removing log file:", err)
+			return err
+		}
+	}
+
+	s.deletedMu.Lock()
+	s.deleted = make(map[string]bool)
+	s.deletedMu.Unlock()
+
+	s.repeatsMu.Lock()
+	s.repeats = make(map[string]Repeat)
+	s.repeatsMu.Unlock()
+
+	return s.startFile()
+}
+
+func (s *fileStore) StorageUsed(tenant string) (int64, error) {
+	var used int64
+
+	err := s.Each(context.Background(), tenant, Filter{}, func(entry *LogEntry) error {
+		used += entry.Size()
+		return nil
+	})
+
+	return used, err
+}
+
+func (s *fileStore) Policies() ([]*RetentionPolicy, error) {
+	s.policiesMu.Lock()
+	defer s.policiesMu.Unlock()
+
+	return s.loadPolicies()
+}
+
+func (s *fileStore) UpsertPolicy(policy RetentionPolicy) (*RetentionPolicy, error) {
+	s.policiesMu.Lock()
+	defer s.policiesMu.Unlock()
+
+	all, err := s.loadPolicies()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+
+	var saved *RetentionPolicy
+	for _, existing := range all {
+		if existing.Name == policy.Name && existing.Level == policy.Level {
+			saved = existing
+		}
+	}
+
+	if saved == nil {
+		saved = &RetentionPolicy{
+			ID:        primitive.NewObjectID().Hex(),
+			Name:      policy.Name,
+			Level:     policy.Level,
+			CreatedAt: now,
+		}
+		all = append(all, saved)
+	}
+
+	saved.MaxAge = policy.MaxAge
+	saved.UpdatedAt = now
+
+	if err = s.savePolicies(all); err != nil {
+		return nil, err
+	}
+
+	return saved, nil
+}
+
+func (s *fileStore) DeletePolicy(id string) error {
+	s.policiesMu.Lock()
+	defer s.policiesMu.Unlock()
+
+	all, err := s.loadPolicies()
+	if err != nil {
+		return err
+	}
+
+	for i, policy := range all {
+		if policy.ID == id {
+			return s.savePolicies(append(all[:i], all[i+1:]...))
+		}
+	}
+
+	return ErrNotFound
+}
+
+func (s *fileStore) Rules() ([]*AlertRule, error) {
+	s.rulesMu.Lock()
+	defer s.rulesMu.Unlock()
+
+	return s.loadRules()
+}
+
+func (s *fileStore) SaveRule(rule *AlertRule) error {
+	s.rulesMu.Lock()
+	defer s.rulesMu.Unlock()
+
+	all, err := s.loadRules()
+	if err != nil {
+		return err
+	}
+
+	replaced := false
+	for i, existing := range all {
+		if existing.ID == rule.ID {
+			all[i] = rule
+			replaced = true
+		}
+	}
+
+	if !replaced {
+		all = append(all, rule)
+	}
+
+	return s.saveRules(all)
+}
+
+func (s *fileStore) DeleteRule(id string) error {
+	s.rulesMu.Lock()
+	defer s.rulesMu.Unlock()
+
+	all, err := s.loadRules()
+	if err != nil {
+		return err
+	}
+
+	for i, rule := range all {
+		if rule.ID == id {
+			return s.saveRules(append(all[:i], all[i+1:]...))
+		}
+	}
+
+	return ErrNotFound
+}
+
+func (s *fileStore) Webhooks() ([]*Webhook, error) {
+	s.webhooksMu.Lock()
+	defer s.webhooksMu.Unlock()
+
+	return s.loadWebhooks()
+}
+
+func (s *fileStore) SaveWebhook(hook *Webhook) error {
+	s.webhooksMu.Lock()
+	defer s.webhooksMu.Unlock()
+
+	all, err := s.loadWebhooks()
+	if err != nil {
+		return err
+	}
+
+	replaced := false
+	for i, existing := range all {
+		if existing.ID == hook.ID {
+			all[i] = hook
+			replaced = true
+		}
+	}
+
+	if !replaced {
+		all = append(all, hook)
+	}
+
+	return s.saveWebhooks(all)
+}
+
+func (s *fileStore) RecordWebhookResult(id string, success bool, limit int, now time.Time) (*Webhook, error) {
+	s.webhooksMu.Lock()
+	defer s.webhooksMu.Unlock()
+
+	all, err := s.loadWebhooks()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, hook := range all {
+		if hook.ID != id {
+			continue
+		}
+
+		if hook.recordResult(success, limit, now) {
+			if err = s.saveWebhooks(all); err != nil {
+				return nil, err
+			}
+		}
+
+		return hook, nil
+	}
+
+	return nil, ErrNotFound
+}
+
+func (s *fileStore) DeleteWebhook(id string) error {
+	s.webhooksMu.Lock()
+	defer s.webhooksMu.Unlock()
+
+	all, err := s.loadWebhooks()
+	if err != nil {
+		return err
+	}
+
+	for i, hook := range all {
+		if hook.ID != id {
+			continue
+		}
+
+		if err = s.saveWebhooks(append(all[:i], all[i+1:]...)); err != nil {
+			return err
+		}
+
+		s.deliveriesMu.Lock()
+		defer s.deliveriesMu.Unlock()
+
+		_, err = s.rewriteDeliveries(func(delivery *WebhookDelivery) bool {
+			return delivery.WebhookID != id
+		})
+
+		return err
+	}
+
+	return ErrNotFound
+}
+
+func (s *fileStore) InsertDelivery(delivery *WebhookDelivery) error {
+	line, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+
+	s.deliveriesMu.Lock()
+	defer s.deliveriesMu.Unlock()
+
+	file, err := os.OpenFile(filepath.Join(s.dir, deliveriesFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		log.Println("Error opening webhook deliveries:", err)
+		return err
+	}
+	defer file.Close()
+
+	if _, err = file.Write(append(line, '\n')); err != nil {
+		log.Println("Error writing webhook delivery:", err)
+		return err
+	}
+
+	return nil
+}
+
+func (s *fileStore) Deliveries(webhookID string, limit int) ([]*WebhookDelivery, error) {
+	s.deliveriesMu.Lock()
+	defer s.deliveriesMu.Unlock()
+
+	all, err := s.loadDeliveries()
+	if err != nil {
+		return nil, err
+	}
+
+	// the file is in the order the deliveries were made
+	var latest []*WebhookDelivery
+	for i := len(all) - 1; i >= 0 && len(latest) < limit; i-- {
+		if all[i].WebhookID == webhookID {
+			latest = append(latest, all[i])
+		}
+	}
+
+	return latest, nil
+}
+
+func (s *fileStore) DeleteDeliveries(before time.Time) (int64, error) {
+	s.deliveriesMu.Lock()
+	defer s.deliveriesMu.Unlock()
+
+	return s.rewriteDeliveries(func(delivery *WebhookDelivery) bool {
+		return !delivery.CreatedAt.Before(before)
+	})
+}
+
+// ApplyExpiry has nothing to do, the expiry of an entry is calculated with the
+// current policies whenever it is read
+func (s *fileStore) ApplyExpiry(policies []*RetentionPolicy) error {
+	return nil
+}
+
+// DeleteExpired removes the oldest files for as long as every entry they hold
+// has expired. The file being written to is never removed
+func (s *fileStore) DeleteExpired(now time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	paths, err := s.files()
+	if err != nil {
+		return 0, err
+	}
+
+	var removed int64
+	for _, path := range paths[:len(paths)-1] {
+		var live int64
+
+		err = scanLogFile(path, -1, func(record *fileRecord) error {
+			entry := record.LogEntry
+			if entry == nil || s.isDeleted(entry.ID) {
+				return nil
+			}
+
+			expiry := expiryFor(entry.Name, entry.Level, entry.CreatedAt)
+			if expiry == nil || expiry.After(now) {
+				return errStopScan
+			}
+
+			live++
+			return nil
+		})
+		if errors.Is(err, errStopScan) {
+			break
+		}
+		if err != nil {
+			return removed, err
+		}
+
+		if err = s.removeFile(path); err != nil {
+			return removed, err
+		}
+
+		removed += live
+	}
+
+	return removed, nil
+}
+
+// Compact rewrites the files but the current one without the deleted entries,
+// removing the files left empty. The records of deletions and restores go
+// with them: a deleted entry is dropped and the entry of a restore is kept.
+// The deletions left are those of the entries of the current file
+func (s *fileStore) Compact() (int64, error) {
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	paths, err := s.files()
+	if err != nil {
+		return 0, err
+	}
+
+	var compacted int64
+	for _, path := range paths[:len(paths)-1] {
+		dropped, err := s.compactFile(path)
+		compacted += dropped
+		if err != nil {
+			return compacted, err
+		}
+	}
+
+	current := make(map[string]bool)
+	err = scanLogFile(paths[len(paths)-1], s.size, func(record *fileRecord) error {
+		if record.LogEntry != nil && s.isDeleted(record.ID) {
+			current[record.ID] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return compacted, err
+	}
+
+	s.deletedMu.Lock()
+	s.deleted = current
+	s.deletedMu.Unlock()
+
+	return compacted, nil
+}
+
+// compactFile rewrites a file without its deleted entries and its records of
+// deletions and restores, and returns how many entries were dropped. The
+// caller must hold compactMu and mu
+func (s *fileStore) compactFile(path string) (int64, error) {
+	var (
+		kept    []fileRecord
+		dropped []string
+		changed bool
+	)
+
+	err := scanLogFile(path, -1, func(record *fileRecord) error {
+		switch {
+		case record.LogEntry != nil && s.isDeleted(record.ID):
+			dropped = append(dropped, record.ID)
+			changed = true
+			return nil
+		case len(record.Deleted) > 0 || len(record.Restored) > 0:
+			changed = true
+			return nil
+		}
+
+		if len(record.Repeated) > 0 {
+			var repeated []Repeat
+			for _, repeat := range record.Repeated {
+				if !s.isDeleted(repeat.ID) {
+					repeated = append(repeated, repeat)
+				}
+			}
+
+			if len(repeated) < len(record.Repeated) {
+				changed = true
+			}
+			if len(repeated) == 0 {
+				return nil
+			}
+			record.Repeated = repeated
+		}
+
+		kept = append(kept, *record)
+		return nil
+	})
+	if err != nil || !changed {
+		return 0, err
+	}
+
+	if len(kept) == 0 {
+		err = os.Remove(path)
+	} else {
+		err = rewriteLogFile(path, kept)
+	}
+	if err != nil {
+		log.Println("Error compacting log file:", err)
+		return 0, err
+	}
+
+	s.repeatsMu.Lock()
+	for _, id := range dropped {
+		delete(s.repeats, id)
+	}
+	s.repeatsMu.Unlock()
+
+	return int64(len(dropped)), nil
+}
+
+// rewriteLogFile replaces the records of a file. The new records are written
+// to a temporary file first, so that a reader sees either version
+func rewriteLogFile(path string, records []fileRecord) error {
+	var buf bytes.Buffer
+
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	for i := range records {
+		if err := encoder.Encode(&records[i]); err != nil {
+			return err
+		}
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o644); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+func (s *fileStore) isDeleted(id string) bool {
+	s.deletedMu.RLock()
+	defer s.deletedMu.RUnlock()
+
+	return s.deleted[id]
+}
+
+// addRepeat merges a repeat into the known ones, keeping the highest count.
+// The caller holds repeatsMu
+func (s *fileStore) addRepeat(repeat Repeat) {
+	known, ok := s.repeats[repeat.ID]
+	if !ok {
+		s.repeats[repeat.ID] = repeat
+		return
+	}
+
+	known.Count = max(known.Count, repeat.Count)
+	if repeat.FirstSeen.Before(known.FirstSeen) {
+		known.FirstSeen = repeat.FirstSeen
+	}
+	if repeat.LastSeen.After(known.LastSeen) {
+		known.LastSeen = repeat.LastSeen
+	}
+
+	s.repeats[repeat.ID] = known
+}
+
+// applyRepeat sets the count and the first and last seen dates of an entry
+// identical entries were folded into
+func (s *fileStore) applyRepeat(entry *LogEntry) {
+	s.repeatsMu.RLock()
+	repeat, ok := s.repeats[entry.ID]
+	s.repeatsMu.RUnlock()
+
+	if !ok || repeat.Count <= entry.Count {
+		return
+	}
+
+	entry.Count = repeat.Count
+	entry.FirstSeen = &repeat.FirstSeen
+	entry.LastSeen = &repeat.LastSeen
+}
+
+// append writes records at the end of the current file, starting a new file
+// when it is full
+func (s *fileStore) append(records ...fileRecord) error {
+	var buf bytes.Buffer
+
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	for i := range records {
+		if err := encoder.Encode(&records[i]); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, err := s.current.Write(buf.Bytes())
+	s.size += int64(n)
+	if err != nil {
+		log.Println("Error writing log file:", err)
+		return err
+	}
+
+	if s.maxBytes > 0 && s.size >= s.maxBytes {
+		return s.rotate()
+	}
+
+	return nil
+}
+
+// rotate starts a new file and removes the oldest files beyond maxFiles. The
+// caller must hold mu
+func (s *fileStore) rotate() error {
+	if err := s.current.Close(); err != nil {
+		log.Println("Error closing log file:", err)
+	}
+
+	if err := s.startFile(); err != nil {
+		return err
+	}
+
+	if s.maxFiles <= 0 {
+		return nil
+	}
+
+	paths, err := s.files()
+	if err != nil {
+		return err
+	}
+
+	for len(paths) > s.maxFiles {
+		if err = s.removeFile(paths[0]); err != nil {
+			return err
+		}
+		paths = paths[1:]
+	}
+
+	return nil
+}
+
+// startFile creates a new file and makes it the current one
+func (s *fileStore) startFile() error {
+	name := logFilePrefix + time.Now().UTC().Format(logFileTimeFormat) + logFileSuffix
+
+	return s.openFile(filepath.Join(s.dir, name))
+}
+
+func (s *fileStore) openFile(path string) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		log.Println("Error opening log file:", err)
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	s.current = file
+	s.size = info.Size()
+
+	return nil
+}
+
+// removeFile deletes a file and forgets the deletion of the entries it held.
+// The caller must hold mu
+func (s *fileStore) removeFile(path string) error {
+	var ids []string
+	err := scanLogFile(path, -1, func(record *fileRecord) error {
+		if record.LogEntry != nil {
+			ids = append(ids, record.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = os.Remove(path); err != nil {
+		log.Println("Error removing log file:", err)
+		return err
+	}
+
+	s.deletedMu.Lock()
+	for _, id := range ids {
+		delete(s.deleted, id)
+	}
+	s.deletedMu.Unlock()
+
+	s.repeatsMu.Lock()
+	for _, id := range ids {
+		delete(s.repeats, id)
+	}
+	s.repeatsMu.Unlock()
+
+	return nil
+}
+
+// files returns the paths of the log files, oldest first
+func (s *fileStore) files() ([]string, error) {
+	dirEntries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		if strings.HasPrefix(name, logFilePrefix) && strings.HasSuffix(name, logFileSuffix) {
+			paths = append(paths, filepath.Join(s.dir, name))
+		}
+	}
+
+	sort.Strings(paths)
+
+	return paths, nil
+}
+
+// eachRecord calls fn with every record of every file, oldest first. The
+// current file is only read up to its size when the scan starts, so the
+// records written in the meantime are not seen half written
+func (s *fileStore) eachRecord(fn func(*fileRecord) error) error {
+	s.mu.Lock()
+	paths, err := s.files()
+	size := s.size
+	s.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	for i, path := range paths {
+		limit := int64(-1)
+		if i == len(paths)-1 {
+			limit = size
+		}
+
+		err = scanLogFile(path, limit, fn)
+		if errors.Is(err, os.ErrNotExist) {
+			// removed by the sweeper or a rotation since the scan started
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// scanLogFile calls fn with every record of a file, reading at most limit
+// bytes unless limit is negative
+func scanLogFile(path string, limit int64, fn func(*fileRecord) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if limit >= 0 {
+		r = io.LimitReader(file, limit)
+	}
+
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			var record fileRecord
+			if decodeErr := json.Unmarshal(line, &record); decodeErr != nil {
+				log.Printf("Error decoding record of %s: %v\n", path, decodeErr)
+			} else if fnErr := fn(&record); fnErr != nil {
+				return fnErr
+			}
+		}
+
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *fileStore) loadPolicies() ([]*RetentionPolicy, error) {
+	var all []*RetentionPolicy
+	if err := s.readJSON(policiesFile, &all); err != nil {
+		log.Println("Error reading retention policies:", err)
+		return nil, err
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Name != all[j].Name {
+			return all[i].Name < all[j].Name
+		}
+		return all[i].Level < all[j].Level
+	})
+
+	return all, nil
+}
+
+func (s *fileStore) savePolicies(all []*RetentionPolicy) error {
+	if err := s.writeJSON(policiesFile, all); err != nil {
+		log.Println("Error saving retention policies:", err)
+		return err
+	}
+
+	return nil
+}
+
+func (s *fileStore) loadRules() ([]*AlertRule, error) {
+	var all []*AlertRule
+	if err := s.readJSON(rulesFile, &all); err != nil {
+		log.Println("Error reading alert rules:", err)
+		return nil, err
+	}
+
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].Name < all[j].Name
+	})
+
+	return all, nil
+}
+
+func (s *fileStore) saveRules(all []*AlertRule) error {
+	if err := s.writeJSON(rulesFile, all); err != nil {
+		log.Println("Error saving alert rules:", err)
+		return err
+	}
+
+	return nil
+}
+
+func (s *fileStore) loadWebhooks() ([]*Webhook, error) {
+	var all []*Webhook
+	if err := s.readJSON(webhooksFile, &all); err != nil {
+		log.Println("Error reading webhooks:", err)
+		return nil, err
+	}
+
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].URL < all[j].URL
+	})
+
+	return all, nil
+}
+
+func (s *fileStore) saveWebhooks(all []*Webhook) error {
+	if err := s.writeJSON(webhooksFile, all); err != nil {
+		log.Println("Error saving webhooks:", err)
+		return err
+	}
+
+	return nil
+}
+
+// loadDeliveries reads every webhook delivery. The caller must hold
+// deliveriesMu
+func (s *fileStore) loadDeliveries() ([]*WebhookDelivery, error) {
+	file, err := os.Open(filepath.Join(s.dir, deliveriesFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		log.Println("Error reading webhook deliveries:", err)
+		return nil, err
+	}
+	defer file.Close()
+
+	var all []*WebhookDelivery
+
+	decoder := json.NewDecoder(file)
+	for {
+		var delivery WebhookDelivery
+		err := decoder.Decode(&delivery)
+		if errors.Is(err, io.EOF) {
+			return all, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", deliveriesFile, err)
+		}
+
+		all = append(all, &delivery)
+	}
+}
+
+// rewriteDeliveries replaces the deliveries file with the deliveries kept by
+// keep and returns how many were dropped. The caller must hold deliveriesMu
+func (s *fileStore) rewriteDeliveries(keep func(*WebhookDelivery) bool) (int64, error) {
+	all, err := s.loadDeliveries()
+	if err != nil {
+		return 0, err
+	}
+
+	var buf bytes.Buffer
+	var dropped int64
+
+	encoder := json.NewEncoder(&buf)
+	for _, delivery := range all {
+		if !keep(delivery) {
+			dropped++
+			continue
+		}
+
+		if err = encoder.Encode(delivery); err != nil {
+			return 0, err
+		}
+	}
+
+	if dropped == 0 {
+		return 0, nil
+	}
+
+	if err = s.writeFile(deliveriesFile, buf.Bytes()); err != nil {
+		log.Println("Error saving webhook deliveries:", err)
+		return 0, err
+	}
+
+	return dropped, nil
+}
+
+// readJSON decodes a file of the directory into v, leaving v untouched when
+// the file does not exist
+func (s *fileStore) readJSON(name string, v any) error {
+	content, err := os.ReadFile(filepath.Join(s.dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = json.Unmarshal(content, v); err != nil {
+		return fmt.Errorf("reading %s: %w", name, err)
+	}
+
+	return nil
+}
+
+// writeJSON replaces a file of the directory with v encoded as JSON
+func (s *fileStore) writeJSON(name string, v any) error {
+	content, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return s.writeFile(name, content)
+}
+
+// writeFile replaces a file of the directory, through a temporary file so
+// that it is never left half written
+func (s *fileStore) writeFile(name string, content []byte) error {
+	temp, err := os.CreateTemp(s.dir, name+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	if _, err = temp.Write(content); err != nil {
+		_ = temp.Close()
+		return err
+	}
+	if err = temp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(temp.Name(), filepath.Join(s.dir, name))
+}
@@ -0,0 +1,45 @@
+package data
+
+import (
+	"time"
+)
+
+// Filter selects log entries. Fields left at their zero value are ignored
+type Filter struct {
+	Name      string
+	Level     string
+	RequestID string    // entries whose request_id attribute has this value
+	From      time.Time // entries created at or after this time
+	To        time.Time // entries created before this time
+	ExpiredBy time.Time // entries whose expiry date is at or before this time
+}
+
+// matches reports whether the filter selects the entry, for the stores that
+// can not query their entries
+func (f Filter) matches(entry *LogEntry) bool {
+	if f.Name != "" && entry.Name != f.Name {
+		return false
+	}
+
+	if f.Level != "" && entry.Level != f.Level {
+		return false
+	}
+
+	if f.RequestID != "" && entry.Attributes["request_id"] != f.RequestID {
+		return false
+	}
+
+	if !f.From.IsZero() && entry.CreatedAt.Before(f.From) {
+		return false
+	}
+
+	if !f.To.IsZero() && !entry.CreatedAt.Before(f.To) {
+		return false
+	}
+
+	if !f.ExpiredBy.IsZero() && (entry.ExpireAt == nil || entry.ExpireAt.After(f.ExpiredBy)) {
+		return false
+	}
+
+	return true
+}
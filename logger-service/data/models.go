@@ -2,156 +2,316 @@ package data
 
 import (
 	"context"
-	"log"
+	"fmt"
 	"time"
 
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-const dbTimeout = time.Second * 3
+const (
+	dbTimeout = time.Second * 3
 
-var client *mongo.Client
+	// bulkTimeout is used for the operations that go through a large part of
+	// the logs collection, which take considerably longer than a single insert
+	// or lookup
+	bulkTimeout = time.Minute * 5
+)
+
+// store is where the models keep their data, set by New
+var store Store
 
 type Models struct {
-	LogEntry LogEntry
+	LogEntry        LogEntry
+	RetentionPolicy RetentionPolicy
+	AlertRule       AlertRule
+	Webhook         Webhook
 }
 
+// LogEntry is one log entry. When Tenant is set on the receiver of a method,
+// the method only sees and creates the entries of that tenant
 type LogEntry struct {
-	ID        string    `bson:"_id,omitempty" json:"id,omitempty"`
-	Name      string    `bson:"name" json:"name"`
-	Data      string    `bson:"data" json:"data"`
-	CreatedAt time.Time `bson:"created_at" json:"created_at"`
-	UpdatedAt time.Time `bson:"updated_at" json:"updated_at"`
+	ID        string     `bson:"_id,omitempty" json:"id,omitempty"`
+	Tenant    string     `bson:"tenant,omitempty" json:"tenant,omitempty"`
+	Name      string     `bson:"name" json:"name"`
+	Level     string     `bson:"level,omitempty" json:"level,omitempty"`
+	Data      string     `bson:"data" json:"data"`
+	CreatedAt time.Time  `bson:"created_at" json:"created_at"`
+	UpdatedAt time.Time  `bson:"updated_at" json:"updated_at"`
+	ExpireAt  *time.Time `bson:"expire_at,omitempty" json:"expire_at,omitempty"`
+
+	// Attributes keeps the structured fields of entries received from syslog
+	// or OpenTelemetry, which have no counterpart in the other fields
+	Attributes map[string]string `bson:"attributes,omitempty" json:"attributes,omitempty"`
+
+	// Count, FirstSeen and LastSeen are set once identical entries have been
+	// folded into this one, see Deduplicate. Count includes the entry itself
+	Count     int64      `bson:"count,omitempty" json:"count,omitempty"`
+	FirstSeen *time.Time `bson:"first_seen,omitempty" json:"first_seen,omitempty"`
+	LastSeen  *time.Time `bson:"last_seen,omitempty" json:"last_seen,omitempty"`
 }
 
-func New(mongo *mongo.Client) Models {
-	client = mongo
+func New(s Store) Models {
+	store = s
 
 	return Models{
-		LogEntry: LogEntry{},
+		LogEntry:        LogEntry{},
+		RetentionPolicy: RetentionPolicy{},
+		AlertRule:       AlertRule{},
+		Webhook:         Webhook{},
 	}
 }
 
-func (l *LogEntry) Insert(entry LogEntry) error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
-	defer cancel()
+// ForTenant returns a copy of the models restricted to the entries, alert
+// rules and webhooks of one tenant. An empty tenant sees everything
+func (m Models) ForTenant(tenant string) Models {
+	m.LogEntry = LogEntry{Tenant: tenant}
+	m.AlertRule = AlertRule{Tenant: tenant}
+	m.Webhook = Webhook{Tenant: tenant}
 
-	collection := client.Database("logs").Collection("logs")
+	return m
+}
 
-	_, err := collection.InsertOne(ctx, LogEntry{
-		Name:      entry.Name,
-		Data:      entry.Data,
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
-	})
+// Insert inserts one entry, and reports whether it was folded into an
+// identical recent entry rather than stored on its own
+func (l *LogEntry) Insert(entry LogEntry) (bool, error) {
+	_, folded, failed, err := l.InsertMany([]LogEntry{entry})
 	if err != nil {
-		log.Println("Error inserting into logs:", err)
-		return err
+		return false, err
 	}
 
-	return nil
+	return folded[0], failed[0]
 }
 
-func (l *LogEntry) All() ([]*LogEntry, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
-	defer cancel()
+// InsertMany inserts several entries in one round trip. It returns the id
+// given to every entry, in order, whether each entry was folded, and the
+// errors of the entries that could not be inserted keyed by their position.
+// The error is only set when the insert failed as a whole. When deduplication
+// is enabled, an entry identical to a recent one is folded into it and gets
+// its id
+func (l *LogEntry) InsertMany(entries []LogEntry) ([]string, []bool, map[int]error, error) {
+	now := time.Now()
+
+	ids := make([]string, len(entries))
+	folded := make([]bool, len(entries))
+	keys := make([]string, len(entries))
+	// stored is what every entry became: a new entry, or the entry it was
+	// folded into
+	stored := make([]*LogEntry, len(entries))
+
+	var inserted []LogEntry
+	var positions []int
+	repeats := make(map[string]Repeat)
+
+	for i, entry := range entries {
+		ids[i] = primitive.NewObjectID().Hex()
+
+		if dedup != nil {
+			keys[i] = dedupKey(l.Tenant, &entry)
+
+			if repeat := dedup.fold(keys[i], ids[i], now); repeat != nil {
+				ids[i] = repeat.ID
+				folded[i] = true
+				if repeat.Count > repeats[repeat.ID].Count {
+					repeats[repeat.ID] = *repeat
+				}
+
+				stored[i] = &LogEntry{
+					ID:         repeat.ID,
+					Tenant:     l.Tenant,
+					Name:       entry.Name,
+					Level:      entry.Level,
+					Data:       entry.Data,
+					Attributes: entry.Attributes,
+					CreatedAt:  repeat.FirstSeen,
+					UpdatedAt:  now,
+					Count:      repeat.Count,
+					FirstSeen:  &repeat.FirstSeen,
+					LastSeen:   &repeat.LastSeen,
+				}
+				continue
+			}
+		}
 
-	collection := client.Database("logs").Collection("logs")
+		inserted = append(inserted, LogEntry{
+			ID:         ids[i],
+			Tenant:     l.Tenant,
+			Name:       entry.Name,
+			Level:      entry.Level,
+			Data:       entry.Data,
+			Attributes: entry.Attributes,
+			CreatedAt:  now,
+			UpdatedAt:  now,
+			ExpireAt:   expiryFor(entry.Name, entry.Level, now),
+		})
+		positions = append(positions, i)
+	}
 
-	opts := options.Find()
-	opts.SetSort(bson.D{{Key: "created_at", Value: -1}})
+	failed := make(map[int]error)
 
-	cursor, err := collection.Find(ctx, bson.D{}, opts)
-	if err != nil {
-		log.Println("Error retrieving all logs:", err)
-		return nil, err
+	if len(inserted) > 0 {
+		insertFailed, err := store.Insert(inserted)
+		if err != nil {
+			for _, i := range positions {
+				l.forget(keys[i], ids[i])
+			}
+			return nil, nil, nil, err
+		}
+
+		// entries folded into an entry that could not be inserted fail with it
+		failedIDs := make(map[string]error)
+		for j, i := range positions {
+			if itemErr, ok := insertFailed[j]; ok {
+				failed[i] = itemErr
+				failedIDs[ids[i]] = itemErr
+				l.forget(keys[i], ids[i])
+				continue
+			}
+
+			stored[i] = &inserted[j]
+		}
+
+		for i, entry := range stored {
+			if itemErr, ok := failedIDs[ids[i]]; ok && entry != nil {
+				failed[i] = itemErr
+				delete(repeats, ids[i])
+			}
+		}
 	}
-	defer cursor.Close(ctx)
 
-	var logs []*LogEntry
-	for cursor.Next(ctx) {
-		var item LogEntry
+	if len(repeats) > 0 {
+		list := make([]Repeat, 0, len(repeats))
+		for _, repeat := range repeats {
+			list = append(list, repeat)
+		}
 
-		err := cursor.Decode(&item)
-		if err != nil {
-			log.Println("Error decoding log into slice:", err)
-			return nil, err
+		if err := store.Repeat(list); err != nil {
+			for i, entry := range stored {
+				if _, ok := repeats[ids[i]]; ok && entry != nil && entry.Count > 0 {
+					failed[i] = err
+				}
+			}
 		}
+	}
 
-		logs = append(logs, &item)
+	for i, entry := range stored {
+		if _, ok := failed[i]; !ok && entry != nil {
+			notifyInsert(entry)
+		}
 	}
 
-	return logs, nil
+	return ids, folded, failed, nil
 }
 
-func (l *LogEntry) GetOne(id string) (*LogEntry, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
-	defer cancel()
+// forget stops folding entries into an entry that could not be inserted
+func (l *LogEntry) forget(key, id string) {
+	if dedup != nil {
+		dedup.forget(key, id)
+	}
+}
 
-	collection := client.Database("logs").Collection("logs")
+// All returns every log entry, the most recent first
+func (l *LogEntry) All() ([]*LogEntry, error) {
+	var logs []*LogEntry
 
-	bsonID, err := primitive.ObjectIDFromHex(id)
+	err := l.Each(Filter{}, func(entry *LogEntry) error {
+		logs = append(logs, entry)
+		return nil
+	})
 	if err != nil {
-		log.Println("Error converting id into bson:", err)
 		return nil, err
 	}
 
-	filter := bson.M{"_id": bsonID}
-
-	var entry LogEntry
-	err = collection.FindOne(ctx, filter).Decode(&entry)
-	if err != nil {
-		log.Printf("Error retrieving log with bsonID of %s: %v\n", bsonID, err)
-		return nil, err
+	for i, j := 0, len(logs)-1; i < j; i, j = i+1, j-1 {
+		logs[i], logs[j] = logs[j], logs[i]
 	}
 
-	return &entry, nil
+	return logs, nil
 }
 
-func (l *LogEntry) Update() (*mongo.UpdateResult, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+// Each calls fn for every log entry matched by the filter, oldest first,
+// without loading them all into memory. It stops at the first error, or when
+// bulkTimeout has passed
+func (l *LogEntry) Each(filter Filter, fn func(*LogEntry) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), bulkTimeout)
 	defer cancel()
 
-	collection := client.Database("logs").Collection("logs")
+	return l.EachContext(ctx, filter, fn)
+}
 
-	bsonID, err := primitive.ObjectIDFromHex(l.ID)
-	if err != nil {
-		log.Println("Error converting id into bson:", err)
-		return nil, err
-	}
+// EachContext is Each stopping when ctx is done rather than after
+// bulkTimeout, for the callers going as slow as a client reads
+func (l *LogEntry) EachContext(ctx context.Context, filter Filter, fn func(*LogEntry) error) error {
+	return store.Each(ctx, l.Tenant, filter, fn)
+}
+
+func (l *LogEntry) GetOne(id string) (*LogEntry, error) {
+	return store.GetOne(l.Tenant, id)
+}
+
+// Update saves the name, level and data of the receiver
+func (l *LogEntry) Update() error {
+	l.UpdatedAt = time.Now()
+
+	return store.Update(l.Tenant, l)
+}
 
-	filter := bson.M{"_id": bsonID}
-	update := bson.D{
-		{Key: "$set", Value: bson.D{
-			{Key: "name", Value: l.Name},
-			{Key: "data", Value: l.Data},
-			{Key: "updated_at", Value: time.Now()},
-		}},
+// DeleteByIDs deletes the log entries with the given ids and returns how many
+// were deleted
+func (l *LogEntry) DeleteByIDs(ids []string) (int64, error) {
+	return store.DeleteByIDs(l.Tenant, ids)
+}
+
+// Restore inserts previously exported log entries, keeping their original id
+// and timestamps. Entries that still exist are skipped. The expiry of the
+// restored entries starts counting again from the moment they are restored
+func (l *LogEntry) Restore(entries []*LogEntry) (int, error) {
+	now := time.Now()
+
+	restored := make([]*LogEntry, 0, len(entries))
+	for _, entry := range entries {
+		if !primitive.IsValidObjectID(entry.ID) {
+			return 0, fmt.Errorf("invalid log entry id %q", entry.ID)
+		}
+
+		copied := *entry
+		copied.ExpireAt = expiryFor(entry.Name, entry.Level, now)
+
+		restored = append(restored, &copied)
 	}
 
-	result, err := collection.UpdateOne(ctx, filter, update)
-	if err != nil {
-		log.Printf("Error updating log with bsonID of %s: %v\n", bsonID, err)
-		return nil, err
+	if len(restored) == 0 {
+		return 0, nil
 	}
 
-	return result, nil
+	return store.Restore(restored)
 }
 
+// DropCollection deletes every log entry. When the receiver is restricted to
+// a tenant, only the entries of that tenant are deleted
 func (l *LogEntry) DropCollection() error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
-	defer cancel()
+	return store.Drop(l.Tenant)
+}
 
-	collection := client.Database("logs").Collection("logs")
+// StorageUsed returns the number of bytes taken by the names, messages and
+// attributes of the entries, which is what the storage quota of a tenant is
+// measured in
+func (l *LogEntry) StorageUsed() (int64, error) {
+	return store.StorageUsed(l.Tenant)
+}
 
-	err := collection.Drop(ctx)
-	if err != nil {
-		log.Println("Error dropping collection:", err)
-		return err
+// occurrences is the number of times the entry was received, counting the
+// identical entries folded into it
+func (l *LogEntry) occurrences() int64 {
+	return max(l.Count, 1)
+}
+
+// Size is the number of bytes the entry counts for in StorageUsed, and so in
+// the storage quota of its tenant
+func (l *LogEntry) Size() int64 {
+	size := len(l.Name) + len(l.Data)
+	for key, value := range l.Attributes {
+		size += len(key) + len(value)
 	}
 
-	return nil
+	return int64(size)
 }
@@ -0,0 +1,1179 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// bucketFormats maps the supported time buckets to the $dateToString format
+// that truncates a date to the start of its bucket
+var bucketFormats = map[string]string{
+	"minute": "%Y-%m-%dT%H:%M:00Z",
+	"hour":   "%Y-%m-%dT%H:00:00Z",
+	"day":    "%Y-%m-%dT00:00:00Z",
+}
+
+// mongoIndexes are the indexes of the collections, ensured at startup by
+// EnsureIndexes. The TTL index on expire_at is managed separately, since it
+// is dropped while archiving is enabled, and so is the text index, which
+// replaces an older one
+var mongoIndexes = map[string][]mongo.IndexModel{
+	"logs": {
+		{
+			Keys:    bson.D{{Key: "created_at", Value: 1}},
+			Options: options.Index().SetName("created_at"),
+		},
+		{
+			Keys:    bson.D{{Key: "tenant", Value: 1}, {Key: "created_at", Value: 1}},
+			Options: options.Index().SetName("tenant_created_at"),
+		},
+		{
+			Keys:    bson.D{{Key: "name", Value: 1}, {Key: "created_at", Value: 1}},
+			Options: options.Index().SetName("name_created_at"),
+		},
+		{
+			Keys:    bson.D{{Key: "attributes.request_id", Value: 1}},
+			Options: options.Index().SetName("request_id").SetSparse(true),
+		},
+	},
+	"retention_policies": {
+		{
+			Keys:    bson.D{{Key: "name", Value: 1}, {Key: "level", Value: 1}},
+			Options: options.Index().SetName("name_level").SetUnique(true),
+		},
+	},
+	"webhook_deliveries": {
+		{
+			Keys:    bson.D{{Key: "webhook_id", Value: 1}, {Key: "created_at", Value: -1}},
+			Options: options.Index().SetName("webhook_id_created_at"),
+		},
+	},
+}
+
+// mongoTextIndex is the text index used by Search. It covers every string
+// field, so that the values of the attributes are searched too, and weighs
+// the name of an entry above its level and the other fields
+var mongoTextIndex = mongo.IndexModel{
+	Keys: bson.D{{Key: "$**", Value: "text"}},
+	Options: options.Index().
+		SetName("logs_text_all").
+		SetWeights(bson.D{{Key: "name", Value: 5}, {Key: "level", Value: 2}}),
+}
+
+// mongoOldTextIndex is the text index covering only the name, level and data
+// of the entries, which mongoTextIndex replaces
+const mongoOldTextIndex = "logs_text"
+
+// mongoStore keeps the log entries in the logs collection and the retention
+// policies in the retention_policies collection of the logs database
+type mongoStore struct {
+	client *mongo.Client
+}
+
+// NewMongoStore returns a store backed by MongoDB. It supports every feature
+// of the service
+func NewMongoStore(client *mongo.Client) Store {
+	return &mongoStore{client: client}
+}
+
+func (s *mongoStore) logs() *mongo.Collection {
+	return s.client.Database("logs").Collection("logs")
+}
+
+func (s *mongoStore) policies() *mongo.Collection {
+	return s.client.Database("logs").Collection("retention_policies")
+}
+
+func (s *mongoStore) rules() *mongo.Collection {
+	return s.client.Database("logs").Collection("alert_rules")
+}
+
+func (s *mongoStore) webhooks() *mongo.Collection {
+	return s.client.Database("logs").Collection("webhooks")
+}
+
+func (s *mongoStore) deliveries() *mongo.Collection {
+	return s.client.Database("logs").Collection("webhook_deliveries")
+}
+
+func (s *mongoStore) Insert(entries []LogEntry) (map[int]error, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), bulkTimeout)
+	defer cancel()
+
+	documents := make([]any, len(entries))
+	for i := range entries {
+		document, err := mongoDocument(&entries[i])
+		if err != nil {
+			return nil, err
+		}
+
+		documents[i] = document
+	}
+
+	failed := make(map[int]error)
+
+	opts := options.InsertMany().SetOrdered(false)
+
+	_, err := s.logs().InsertMany(ctx, documents, opts)
+	if err != nil {
+		var writeErr mongo.BulkWriteException
+		if !errors.As(err, &writeErr) || writeErr.WriteConcernError != nil {
+			log.Println("Error inserting into logs:", err)
+			return nil, err
+		}
+
+		for _, itemErr := range writeErr.WriteErrors {
+			failed[itemErr.Index] = errors.New(itemErr.Message)
+		}
+	}
+
+	return failed, nil
+}
+
+func (s *mongoStore) Each(ctx context.Context, tenant string, filter Filter, fn func(*LogEntry) error) error {
+	opts := options.Find()
+	opts.SetSort(bson.D{{Key: "created_at", Value: 1}})
+
+	cursor, err := s.logs().Find(ctx, scoped(tenant, mongoQuery(filter)), opts)
+	if err != nil {
+		log.Println("Error retrieving logs:", err)
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var item LogEntry
+
+		err := cursor.Decode(&item)
+		if err != nil {
+			log.Println("Error decoding log:", err)
+			return err
+		}
+
+		if err = fn(&item); err != nil {
+			return err
+		}
+	}
+
+	return cursor.Err()
+}
+
+func (s *mongoStore) GetOne(tenant, id string) (*LogEntry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	bsonID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		log.Println("Error converting id into bson:", err)
+		return nil, err
+	}
+
+	var entry LogEntry
+	err = s.logs().FindOne(ctx, scoped(tenant, bson.M{"_id": bsonID})).Decode(&entry)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrNotFound
+		}
+
+		log.Printf("Error retrieving log with bsonID of %s: %v\n", bsonID, err)
+		return nil, err
+	}
+
+	return &entry, nil
+}
+
+func (s *mongoStore) Update(tenant string, entry *LogEntry) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	bsonID, err := primitive.ObjectIDFromHex(entry.ID)
+	if err != nil {
+		log.Println("Error converting id into bson:", err)
+		return err
+	}
+
+	update := bson.D{
+		{Key: "$set", Value: bson.D{
+			{Key: "name", Value: entry.Name},
+			{Key: "level", Value: entry.Level},
+			{Key: "data", Value: entry.Data},
+			{Key: "updated_at", Value: entry.UpdatedAt},
+		}},
+	}
+
+	result, err := s.logs().UpdateOne(ctx, scoped(tenant, bson.M{"_id": bsonID}), update)
+	if err != nil {
+		log.Printf("Error updating log with bsonID of %s: %v\n", bsonID, err)
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (s *mongoStore) DeleteByIDs(tenant string, ids []string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), bulkTimeout)
+	defer cancel()
+
+	bsonIDs := make([]primitive.ObjectID, 0, len(ids))
+	for _, id := range ids {
+		bsonID, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			log.Println("Error converting id into bson:", err)
+			return 0, err
+		}
+
+		bsonIDs = append(bsonIDs, bsonID)
+	}
+
+	result, err := s.logs().DeleteMany(ctx, scoped(tenant, bson.M{"_id": bson.M{"$in": bsonIDs}}))
+	if err != nil {
+		log.Println("Error deleting logs:", err)
+		return 0, err
+	}
+
+	return result.DeletedCount, nil
+}
+
+func (s *mongoStore) Restore(entries []*LogEntry) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), bulkTimeout)
+	defer cancel()
+
+	documents := make([]any, 0, len(entries))
+	for _, entry := range entries {
+		document, err := mongoDocument(entry)
+		if err != nil {
+			return 0, err
+		}
+
+		documents = append(documents, document)
+	}
+
+	opts := options.InsertMany().SetOrdered(false)
+
+	_, err := s.logs().InsertMany(ctx, documents, opts)
+	if err != nil {
+		var writeErr mongo.BulkWriteException
+		if !errors.As(err, &writeErr) || !onlyDuplicateKeys(writeErr) {
+			log.Println("Error restoring logs:", err)
+			return 0, err
+		}
+
+		return len(documents) - len(writeErr.WriteErrors), nil
+	}
+
+	return len(documents), nil
+}
+
+func (s *mongoStore) Drop(tenant string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	if tenant != "" {
+		_, err := s.logs().DeleteMany(ctx, scoped(tenant, bson.M{}))
+		if err != nil {
+			log.Println("Error deleting logs of tenant:", err)
+			return err
+		}
+
+		return nil
+	}
+
+	err := s.logs().Drop(ctx)
+	if err != nil {
+		log.Println("Error dropping collection:", err)
+		return err
+	}
+
+	return nil
+}
+
+func (s *mongoStore) Repeat(repeats []Repeat) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	writes := make([]mongo.WriteModel, 0, len(repeats))
+	for _, repeat := range repeats {
+		bsonID, err := primitive.ObjectIDFromHex(repeat.ID)
+		if err != nil {
+			log.Println("Error converting id into bson:", err)
+			return err
+		}
+
+		update := bson.D{
+			{Key: "$max", Value: bson.D{
+				{Key: "count", Value: repeat.Count},
+				{Key: "last_seen", Value: repeat.LastSeen},
+			}},
+			{Key: "$min", Value: bson.D{
+				{Key: "first_seen", Value: repeat.FirstSeen},
+			}},
+		}
+
+		writes = append(writes, mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": bsonID}).SetUpdate(update))
+	}
+
+	_, err := s.logs().BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		log.Println("Error counting repeated logs:", err)
+		return err
+	}
+
+	return nil
+}
+
+func (s *mongoStore) StorageUsed(tenant string) (int64, error) {
+	attributes := bson.D{{Key: "$reduce", Value: bson.D{
+		{Key: "input", Value: bson.D{{Key: "$objectToArray", Value: bson.D{{Key: "$ifNull", Value: bson.A{"$attributes", bson.D{}}}}}}},
+		{Key: "initialValue", Value: 0},
+		{Key: "in", Value: bson.D{{Key: "$add", Value: bson.A{
+			"$$value",
+			bson.D{{Key: "$strLenBytes", Value: "$$this.k"}},
+			bson.D{{Key: "$strLenBytes", Value: "$$this.v"}},
+		}}}},
+	}}}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: scoped(tenant, bson.M{})}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: nil},
+			{Key: "bytes", Value: bson.D{{Key: "$sum", Value: bson.D{{Key: "$add", Value: bson.A{
+				bson.D{{Key: "$strLenBytes", Value: "$name"}},
+				bson.D{{Key: "$strLenBytes", Value: "$data"}},
+				attributes,
+			}}}}}},
+		}}},
+	}
+
+	var rows []struct {
+		Bytes int64 `bson:"bytes"`
+	}
+
+	if err := s.aggregate(pipeline, &rows); err != nil {
+		return 0, err
+	}
+
+	if len(rows) == 0 {
+		return 0, nil
+	}
+
+	return rows[0].Bytes, nil
+}
+
+func (s *mongoStore) Policies() ([]*RetentionPolicy, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	opts := options.Find()
+	opts.SetSort(bson.D{{Key: "name", Value: 1}, {Key: "level", Value: 1}})
+
+	cursor, err := s.policies().Find(ctx, bson.D{}, opts)
+	if err != nil {
+		log.Println("Error retrieving retention policies:", err)
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var all []*RetentionPolicy
+	for cursor.Next(ctx) {
+		var item RetentionPolicy
+
+		err := cursor.Decode(&item)
+		if err != nil {
+			log.Println("Error decoding retention policy into slice:", err)
+			return nil, err
+		}
+
+		all = append(all, &item)
+	}
+
+	return all, nil
+}
+
+func (s *mongoStore) UpsertPolicy(policy RetentionPolicy) (*RetentionPolicy, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	filter := bson.M{"name": policy.Name, "level": policy.Level}
+	update := bson.D{
+		{Key: "$set", Value: bson.D{
+			{Key: "max_age_seconds", Value: policy.MaxAge},
+			{Key: "updated_at", Value: time.Now()},
+		}},
+		{Key: "$setOnInsert", Value: bson.D{
+			{Key: "created_at", Value: time.Now()},
+		}},
+	}
+
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	var saved RetentionPolicy
+	err := s.policies().FindOneAndUpdate(ctx, filter, update, opts).Decode(&saved)
+	if err != nil {
+		log.Println("Error saving retention policy:", err)
+		return nil, err
+	}
+
+	return &saved, nil
+}
+
+func (s *mongoStore) DeletePolicy(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	bsonID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		log.Println("Error converting id into bson:", err)
+		return err
+	}
+
+	result, err := s.policies().DeleteOne(ctx, bson.M{"_id": bsonID})
+	if err != nil {
+		log.Printf("Error deleting retention policy with bsonID of %s: %v\n", bsonID, err)
+		return err
+	}
+
+	if result.DeletedCount == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (s *mongoStore) Rules() ([]*AlertRule, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	opts := options.Find()
+	opts.SetSort(bson.D{{Key: "name", Value: 1}})
+
+	cursor, err := s.rules().Find(ctx, bson.D{}, opts)
+	if err != nil {
+		log.Println("Error retrieving alert rules:", err)
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var all []*AlertRule
+	for cursor.Next(ctx) {
+		var item AlertRule
+
+		err := cursor.Decode(&item)
+		if err != nil {
+			log.Println("Error decoding alert rule into slice:", err)
+			return nil, err
+		}
+
+		all = append(all, &item)
+	}
+
+	return all, nil
+}
+
+// SaveRule stores the rule with its id as a string, unlike the log entries
+// the rules never had ObjectIDs
+func (s *mongoStore) SaveRule(rule *AlertRule) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	opts := options.Replace().SetUpsert(true)
+
+	_, err := s.rules().ReplaceOne(ctx, bson.M{"_id": rule.ID}, rule, opts)
+	if err != nil {
+		log.Println("Error saving alert rule:", err)
+		return err
+	}
+
+	return nil
+}
+
+func (s *mongoStore) DeleteRule(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	result, err := s.rules().DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		log.Printf("Error deleting alert rule with id of %s: %v\n", id, err)
+		return err
+	}
+
+	if result.DeletedCount == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (s *mongoStore) Webhooks() ([]*Webhook, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	opts := options.Find()
+	opts.SetSort(bson.D{{Key: "url", Value: 1}})
+
+	cursor, err := s.webhooks().Find(ctx, bson.D{}, opts)
+	if err != nil {
+		log.Println("Error retrieving webhooks:", err)
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var all []*Webhook
+	for cursor.Next(ctx) {
+		var item Webhook
+
+		err := cursor.Decode(&item)
+		if err != nil {
+			log.Println("Error decoding webhook into slice:", err)
+			return nil, err
+		}
+
+		all = append(all, &item)
+	}
+
+	return all, nil
+}
+
+func (s *mongoStore) SaveWebhook(hook *Webhook) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	opts := options.Replace().SetUpsert(true)
+
+	_, err := s.webhooks().ReplaceOne(ctx, bson.M{"_id": hook.ID}, hook, opts)
+	if err != nil {
+		log.Println("Error saving webhook:", err)
+		return err
+	}
+
+	return nil
+}
+
+// RecordWebhookResult updates the webhook with a single findAndModify, a
+// failure being counted by an update pipeline which disables the webhook once
+// the count reaches the limit
+func (s *mongoStore) RecordWebhookResult(id string, success bool, limit int, now time.Time) (*Webhook, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	filter := bson.M{"_id": id}
+
+	var update any
+	if success {
+		// a webhook without failures is left as it is
+		filter["failures"] = bson.M{"$ne": 0}
+		update = bson.M{"$set": bson.M{"failures": 0, "updated_at": now}}
+	} else {
+		reached := bson.M{"$and": bson.A{
+			bson.M{"$gte": bson.A{"$failures", limit}},
+			bson.M{"$ne": bson.A{"$disabled", true}},
+		}}
+
+		update = mongo.Pipeline{
+			{{Key: "$set", Value: bson.M{
+				"failures":   bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$failures", 0}}, 1}},
+				"updated_at": now,
+			}}},
+			{{Key: "$set", Value: bson.M{
+				"disabled":        bson.M{"$or": bson.A{bson.M{"$eq": bson.A{"$disabled", true}}, reached}},
+				"disabled_reason": bson.M{"$cond": bson.A{reached, webhookDisabledReason, "$disabled_reason"}},
+			}}},
+		}
+	}
+
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var hook Webhook
+	err := s.webhooks().FindOneAndUpdate(ctx, filter, update, opts).Decode(&hook)
+	if errors.Is(err, mongo.ErrNoDocuments) && success {
+		err = s.webhooks().FindOne(ctx, bson.M{"_id": id}).Decode(&hook)
+	}
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		log.Printf("Error recording result of webhook with id of %s: %v\n", id, err)
+		return nil, err
+	}
+
+	return &hook, nil
+}
+
+func (s *mongoStore) DeleteWebhook(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	result, err := s.webhooks().DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		log.Printf("Error deleting webhook with id of %s: %v\n", id, err)
+		return err
+	}
+
+	if result.DeletedCount == 0 {
+		return ErrNotFound
+	}
+
+	_, err = s.deliveries().DeleteMany(ctx, bson.M{"webhook_id": id})
+	if err != nil {
+		log.Printf("Error deleting deliveries of webhook with id of %s: %v\n", id, err)
+		return err
+	}
+
+	return nil
+}
+
+func (s *mongoStore) InsertDelivery(delivery *WebhookDelivery) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	_, err := s.deliveries().InsertOne(ctx, delivery)
+	if err != nil {
+		log.Println("Error inserting webhook delivery:", err)
+		return err
+	}
+
+	return nil
+}
+
+func (s *mongoStore) Deliveries(webhookID string, limit int) ([]*WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	opts := options.Find()
+	opts.SetSort(bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}})
+	opts.SetLimit(int64(limit))
+
+	cursor, err := s.deliveries().Find(ctx, bson.M{"webhook_id": webhookID}, opts)
+	if err != nil {
+		log.Println("Error retrieving webhook deliveries:", err)
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var all []*WebhookDelivery
+	for cursor.Next(ctx) {
+		var item WebhookDelivery
+
+		err := cursor.Decode(&item)
+		if err != nil {
+			log.Println("Error decoding webhook delivery into slice:", err)
+			return nil, err
+		}
+
+		all = append(all, &item)
+	}
+
+	return all, nil
+}
+
+func (s *mongoStore) DeleteDeliveries(before time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), bulkTimeout)
+	defer cancel()
+
+	result, err := s.deliveries().DeleteMany(ctx, bson.M{"created_at": bson.M{"$lt": before}})
+	if err != nil {
+		log.Println("Error deleting webhook deliveries:", err)
+		return 0, err
+	}
+
+	return result.DeletedCount, nil
+}
+
+func (s *mongoStore) ApplyExpiry(policies []*RetentionPolicy) error {
+	ctx, cancel := context.WithTimeout(context.Background(), bulkTimeout)
+	defer cancel()
+
+	var unmatched bson.A
+	for _, policy := range policies {
+		filter := policyQuery(policy)
+		unmatched = append(unmatched, filter)
+
+		update := mongo.Pipeline{
+			{{Key: "$set", Value: bson.D{
+				{Key: "expire_at", Value: bson.D{
+					{Key: "$add", Value: bson.A{"$created_at", policy.MaxAge * 1000}},
+				}},
+			}}},
+		}
+
+		_, err := s.logs().UpdateMany(ctx, filter, update)
+		if err != nil {
+			log.Println("Error applying retention policy:", err)
+			return err
+		}
+	}
+
+	// entries that no longer match any policy are kept forever
+	filter := bson.M{"expire_at": bson.M{"$exists": true}}
+	if len(unmatched) > 0 {
+		filter["$nor"] = unmatched
+	}
+
+	_, err := s.logs().UpdateMany(ctx, filter, bson.M{"$unset": bson.M{"expire_at": ""}})
+	if err != nil {
+		log.Println("Error clearing expiry of log entries:", err)
+		return err
+	}
+
+	return nil
+}
+
+func (s *mongoStore) DeleteExpired(now time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), bulkTimeout)
+	defer cancel()
+
+	result, err := s.logs().DeleteMany(ctx, bson.M{"expire_at": bson.M{"$lte": now}})
+	if err != nil {
+		log.Println("Error deleting expired logs:", err)
+		return 0, err
+	}
+
+	return result.DeletedCount, nil
+}
+
+// EnsureTTLIndex creates the TTL index that makes MongoDB delete log entries
+// once their expire_at date is reached
+func (s *mongoStore) EnsureTTLIndex() error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	_, err := s.logs().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expire_at", Value: 1}},
+		Options: options.Index().SetName("expire_at_ttl").SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		log.Println("Error creating TTL index:", err)
+		return err
+	}
+
+	return nil
+}
+
+// DropTTLIndex removes the TTL index, so that expired log entries are only
+// deleted by the sweeper
+func (s *mongoStore) DropTTLIndex() error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	_, err := s.logs().Indexes().DropOne(ctx, "expire_at_ttl")
+	if err != nil {
+		var cmdErr mongo.CommandError
+		if errors.As(err, &cmdErr) && cmdErr.Name == "IndexNotFound" {
+			return nil
+		}
+
+		log.Println("Error dropping TTL index:", err)
+		return err
+	}
+
+	return nil
+}
+
+// EnsureIndexes creates the missing indexes of every collection and the text
+// index. Indexes that already exist with the same keys and options are left
+// untouched
+func (s *mongoStore) EnsureIndexes() error {
+	ctx, cancel := context.WithTimeout(context.Background(), bulkTimeout)
+	defer cancel()
+
+	for collection, models := range mongoIndexes {
+		_, err := s.client.Database("logs").Collection(collection).Indexes().CreateMany(ctx, models)
+		if err != nil {
+			log.Printf("Error creating indexes of %s: %v\n", collection, err)
+			return err
+		}
+	}
+
+	// the text index replaces an older one, which has to be dropped first
+	return s.EnsureTextIndex()
+}
+
+// EnsureTextIndex creates the text index used by Search, dropping the one it
+// replaces first since a collection has at most one text index
+func (s *mongoStore) EnsureTextIndex() error {
+	ctx, cancel := context.WithTimeout(context.Background(), bulkTimeout)
+	defer cancel()
+
+	_, err := s.logs().Indexes().DropOne(ctx, mongoOldTextIndex)
+	if err != nil {
+		var cmdErr mongo.CommandError
+		if !errors.As(err, &cmdErr) || cmdErr.Name != "IndexNotFound" {
+			log.Println("Error dropping old text index:", err)
+			return err
+		}
+	}
+
+	_, err = s.logs().Indexes().CreateOne(ctx, mongoTextIndex)
+	if err != nil {
+		log.Println("Error creating text index:", err)
+		return err
+	}
+
+	return nil
+}
+
+// Search uses the MongoDB $text syntax, so it supports "quoted phrases" and
+// -negated terms
+func (s *mongoStore) Search(tenant, query string, limit int, after *SearchCursor) ([]*SearchResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: scoped(tenant, bson.M{"$text": bson.M{"$search": query}})}},
+		{{Key: "$addFields", Value: bson.M{"score": bson.M{"$meta": "textScore"}}}},
+	}
+
+	if after != nil {
+		bsonID, err := primitive.ObjectIDFromHex(after.ID)
+		if err != nil {
+			return nil, ErrInvalidCursor
+		}
+
+		// results are sorted by score and then id, so the next page starts
+		// with a lower score or the same score and a lower id
+		pipeline = append(pipeline, bson.D{{Key: "$match", Value: bson.M{
+			"$or": bson.A{
+				bson.M{"score": bson.M{"$lt": after.Score}},
+				bson.M{"score": after.Score, "_id": bson.M{"$lt": bsonID}},
+			},
+		}}})
+	}
+
+	pipeline = append(pipeline,
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "score", Value: -1}, {Key: "_id", Value: -1}}}},
+		bson.D{{Key: "$limit", Value: limit}},
+	)
+
+	cursor, err := s.logs().Aggregate(ctx, pipeline)
+	if err != nil {
+		log.Println("Error searching logs:", err)
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var results []*SearchResult
+	for cursor.Next(ctx) {
+		var item SearchResult
+
+		err := cursor.Decode(&item)
+		if err != nil {
+			log.Println("Error decoding search result into slice:", err)
+			return nil, err
+		}
+
+		results = append(results, &item)
+	}
+
+	return results, nil
+}
+
+// mongoOccurrences is the number of times an entry was received, which the
+// statistics sum rather than counting the documents. Entries never folded by
+// the deduplication have no count
+var mongoOccurrences = bson.D{{Key: "$ifNull", Value: bson.A{"$count", 1}}}
+
+func (s *mongoStore) CountsOverTime(tenant string, filter Filter, bucket string) ([]*NameCount, error) {
+	format, ok := bucketFormats[bucket]
+	if !ok {
+		return nil, ErrInvalidBucket
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: scoped(tenant, mongoQuery(filter))}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: bson.D{
+				{Key: "bucket", Value: bson.D{{Key: "$dateToString", Value: bson.D{
+					{Key: "format", Value: format},
+					{Key: "date", Value: "$created_at"},
+				}}}},
+				{Key: "name", Value: "$name"},
+			}},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: mongoOccurrences}}},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "_id.bucket", Value: 1}, {Key: "_id.name", Value: 1}}}},
+	}
+
+	var rows []struct {
+		ID struct {
+			Bucket string `bson:"bucket"`
+			Name   string `bson:"name"`
+		} `bson:"_id"`
+		Count int64 `bson:"count"`
+	}
+
+	if err := s.aggregate(pipeline, &rows); err != nil {
+		return nil, err
+	}
+
+	counts := make([]*NameCount, 0, len(rows))
+	for _, row := range rows {
+		start, err := time.Parse(time.RFC3339, row.ID.Bucket)
+		if err != nil {
+			return nil, err
+		}
+
+		counts = append(counts, &NameCount{Bucket: &start, Name: row.ID.Name, Count: row.Count})
+	}
+
+	return counts, nil
+}
+
+func (s *mongoStore) TopNames(tenant string, filter Filter, limit int) ([]*NameCount, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: scoped(tenant, mongoQuery(filter))}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$name"},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: mongoOccurrences}}},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}}},
+		{{Key: "$limit", Value: limit}},
+		{{Key: "$project", Value: bson.D{{Key: "_id", Value: 0}, {Key: "name", Value: "$_id"}, {Key: "count", Value: 1}}}},
+	}
+
+	var counts []*NameCount
+	if err := s.aggregate(pipeline, &counts); err != nil {
+		return nil, err
+	}
+
+	return counts, nil
+}
+
+func (s *mongoStore) ErrorRate(tenant string, filter Filter, bucket string) ([]*ErrorRatePoint, error) {
+	format, ok := bucketFormats[bucket]
+	if !ok {
+		return nil, ErrInvalidBucket
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: scoped(tenant, mongoQuery(filter))}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: bson.D{{Key: "$dateToString", Value: bson.D{
+				{Key: "format", Value: format},
+				{Key: "date", Value: "$created_at"},
+			}}}},
+			{Key: "total", Value: bson.D{{Key: "$sum", Value: mongoOccurrences}}},
+			{Key: "errors", Value: bson.D{{Key: "$sum", Value: bson.D{{Key: "$cond", Value: bson.A{
+				bson.D{{Key: "$in", Value: bson.A{"$level", ErrorLevels}}}, mongoOccurrences, 0,
+			}}}}}},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+	}
+
+	var rows []struct {
+		Bucket string `bson:"_id"`
+		Total  int64  `bson:"total"`
+		Errors int64  `bson:"errors"`
+	}
+
+	if err := s.aggregate(pipeline, &rows); err != nil {
+		return nil, err
+	}
+
+	points := make([]*ErrorRatePoint, 0, len(rows))
+	for _, row := range rows {
+		start, err := time.Parse(time.RFC3339, row.Bucket)
+		if err != nil {
+			return nil, err
+		}
+
+		points = append(points, newErrorRatePoint(start, row.Total, row.Errors))
+	}
+
+	return points, nil
+}
+
+// Watch opens a change stream on the logs collection. Change streams are only
+// supported when MongoDB runs as a replica set, otherwise an error is
+// returned
+func (s *mongoStore) Watch() (*LogStream, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	// repeats folded into an entry update its count and last seen date, and
+	// are streamed like the fan-out of this process streams them
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"$or": bson.A{
+			bson.M{"operationType": "insert"},
+			bson.M{
+				"operationType": "update",
+				"$or": bson.A{
+					bson.M{"updateDescription.updatedFields.count": bson.M{"$exists": true}},
+					bson.M{"updateDescription.updatedFields.last_seen": bson.M{"$exists": true}},
+				},
+			},
+		}}}},
+	}
+
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+
+	stream, err := s.logs().Watch(ctx, pipeline, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LogStream{each: func(ctx context.Context, fn func(*LogEntry)) error {
+		defer stream.Close(context.Background())
+
+		for stream.Next(ctx) {
+			var event struct {
+				FullDocument LogEntry `bson:"fullDocument"`
+			}
+
+			err := stream.Decode(&event)
+			if err != nil {
+				log.Println("Error decoding change stream event:", err)
+				continue
+			}
+
+			// the entry of an update may have been deleted since
+			if event.FullDocument.ID == "" {
+				continue
+			}
+
+			fn(&event.FullDocument)
+		}
+
+		return stream.Err()
+	}}, nil
+}
+
+// aggregate runs the pipeline on the logs collection and decodes every
+// resulting document into results, which must be a pointer to a slice
+func (s *mongoStore) aggregate(pipeline mongo.Pipeline, results any) error {
+	ctx, cancel := context.WithTimeout(context.Background(), bulkTimeout)
+	defer cancel()
+
+	cursor, err := s.logs().Aggregate(ctx, pipeline)
+	if err != nil {
+		log.Println("Error aggregating logs:", err)
+		return err
+	}
+
+	err = cursor.All(ctx, results)
+	if err != nil {
+		log.Println("Error decoding aggregated logs:", err)
+		return err
+	}
+
+	return nil
+}
+
+// mongoDocument converts an entry into the document stored in the logs
+// collection, whose _id is an ObjectID
+func mongoDocument(entry *LogEntry) (bson.M, error) {
+	bsonID, err := primitive.ObjectIDFromHex(entry.ID)
+	if err != nil {
+		log.Println("Error converting id into bson:", err)
+		return nil, err
+	}
+
+	document := bson.M{
+		"_id":        bsonID,
+		"name":       entry.Name,
+		"data":       entry.Data,
+		"created_at": entry.CreatedAt,
+		"updated_at": entry.UpdatedAt,
+	}
+	if entry.Tenant != "" {
+		document["tenant"] = entry.Tenant
+	}
+	if entry.Level != "" {
+		document["level"] = entry.Level
+	}
+	if len(entry.Attributes) > 0 {
+		document["attributes"] = entry.Attributes
+	}
+	if entry.ExpireAt != nil {
+		document["expire_at"] = entry.ExpireAt
+	}
+	if entry.Count > 0 {
+		document["count"] = entry.Count
+		document["first_seen"] = entry.FirstSeen
+		document["last_seen"] = entry.LastSeen
+	}
+
+	return document, nil
+}
+
+// mongoQuery converts a filter into a MongoDB query document
+func mongoQuery(f Filter) bson.M {
+	query := bson.M{}
+
+	if f.Name != "" {
+		query["name"] = f.Name
+	}
+
+	if f.Level != "" {
+		query["level"] = f.Level
+	}
+
+	if f.RequestID != "" {
+		query["attributes.request_id"] = f.RequestID
+	}
+
+	created := bson.M{}
+	if !f.From.IsZero() {
+		created["$gte"] = f.From
+	}
+	if !f.To.IsZero() {
+		created["$lt"] = f.To
+	}
+	if len(created) > 0 {
+		query["created_at"] = created
+	}
+
+	if !f.ExpiredBy.IsZero() {
+		query["expire_at"] = bson.M{"$lte": f.ExpiredBy}
+	}
+
+	return query
+}
+
+// policyQuery returns the query selecting the log entries a retention policy
+// applies to
+func policyQuery(policy *RetentionPolicy) bson.M {
+	filter := bson.M{}
+	if policy.Name != "" {
+		filter["name"] = policy.Name
+	}
+	if policy.Level != "" {
+		filter["level"] = policy.Level
+	}
+
+	return filter
+}
+
+// scoped restricts a query to a tenant, if one is given
+func scoped(tenant string, query bson.M) bson.M {
+	if tenant != "" {
+		query["tenant"] = tenant
+	}
+
+	return query
+}
+
+// onlyDuplicateKeys reports whether every error of a bulk write is caused by a
+// document that already exists
+func onlyDuplicateKeys(err mongo.BulkWriteException) bool {
+	if err.WriteConcernError != nil {
+		return false
+	}
+
+	for _, writeErr := range err.WriteErrors {
+		if !mongo.IsDuplicateKeyError(writeErr) {
+			return false
+		}
+	}
+
+	return true
+}
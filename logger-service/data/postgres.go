@@ -0,0 +1,1208 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// postgresSearch is the document searched by Search, indexed by
+// EnsureTextIndex
+const postgresSearch = `(search || attributes_search)`
+
+// postgresInsertChunk is how many entries are inserted per statement, which
+// keeps the number of parameters well below the limit of PostgreSQL
+const postgresInsertChunk = 1000
+
+// postgresSchema creates the tables of the store. The search column weighs
+// the name of an entry above its level and its data, like the MongoDB text
+// index does, and attributes_search holds the values of its attributes
+const postgresSchema = `
+	CREATE TABLE IF NOT EXISTS logs (
+		id text PRIMARY KEY,
+		tenant text NOT NULL DEFAULT '',
+		name text NOT NULL,
+		level text NOT NULL DEFAULT '',
+		data text NOT NULL,
+		attributes jsonb,
+		created_at timestamptz NOT NULL,
+		updated_at timestamptz NOT NULL,
+		expire_at timestamptz,
+		search tsvector GENERATED ALWAYS AS (
+			setweight(to_tsvector('english', name), 'A') ||
+			setweight(to_tsvector('english', level), 'B') ||
+			to_tsvector('english', data)
+		) STORED
+	);
+
+	-- count, first_seen and last_seen were added with the deduplication
+	ALTER TABLE logs ADD COLUMN IF NOT EXISTS count bigint NOT NULL DEFAULT 0;
+	ALTER TABLE logs ADD COLUMN IF NOT EXISTS first_seen timestamptz;
+	ALTER TABLE logs ADD COLUMN IF NOT EXISTS last_seen timestamptz;
+
+	-- the values of the attributes are searched with the search column
+	ALTER TABLE logs ADD COLUMN IF NOT EXISTS attributes_search tsvector GENERATED ALWAYS AS (
+		to_tsvector('english', COALESCE(attributes, '{}'::jsonb))
+	) STORED;
+
+	CREATE INDEX IF NOT EXISTS logs_created_at ON logs (created_at);
+	CREATE INDEX IF NOT EXISTS logs_tenant_created_at ON logs (tenant, created_at);
+	CREATE INDEX IF NOT EXISTS logs_name_created_at ON logs (name, created_at);
+	CREATE INDEX IF NOT EXISTS logs_request_id ON logs ((attributes->>'request_id')) WHERE attributes->>'request_id' IS NOT NULL;
+	CREATE INDEX IF NOT EXISTS logs_expire_at ON logs (expire_at) WHERE expire_at IS NOT NULL;
+
+	CREATE TABLE IF NOT EXISTS retention_policies (
+		id text PRIMARY KEY,
+		name text NOT NULL DEFAULT '',
+		level text NOT NULL DEFAULT '',
+		max_age_seconds bigint NOT NULL,
+		created_at timestamptz NOT NULL,
+		updated_at timestamptz NOT NULL,
+		UNIQUE (name, level)
+	);
+
+	CREATE TABLE IF NOT EXISTS alert_rules (
+		id text PRIMARY KEY,
+		name text NOT NULL,
+		rule jsonb NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS webhooks (
+		id text PRIMARY KEY,
+		url text NOT NULL,
+		webhook jsonb NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id text PRIMARY KEY,
+		webhook_id text NOT NULL,
+		created_at timestamptz NOT NULL,
+		delivery jsonb NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook_id ON webhook_deliveries (webhook_id, created_at);
+`
+
+const logColumns = `id, tenant, name, level, data, attributes, created_at, updated_at, expire_at, count, first_seen, last_seen`
+
+const policyColumns = `id, name, level, max_age_seconds, created_at, updated_at`
+
+// postgresStore keeps the log entries in the logs table and the retention
+// policies in the retention_policies table
+type postgresStore struct {
+	db *sql.DB
+}
+
+// NewPostgresStore returns a store backed by PostgreSQL, creating its tables
+// when they do not exist yet. It supports every feature of the service except
+// following the inserts of other replicas
+func NewPostgresStore(db *sql.DB) (Store, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), bulkTimeout)
+	defer cancel()
+
+	if _, err := db.ExecContext(ctx, postgresSchema); err != nil {
+		log.Println("Error creating logs tables:", err)
+		return nil, err
+	}
+
+	return &postgresStore{db: db}, nil
+}
+
+func (s *postgresStore) Insert(entries []LogEntry) (map[int]error, error) {
+	rows := make([]*LogEntry, len(entries))
+	for i := range entries {
+		rows[i] = &entries[i]
+	}
+
+	if _, err := s.insert(rows, ""); err != nil {
+		log.Println("Error inserting into logs:", err)
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (s *postgresStore) Each(ctx context.Context, tenant string, filter Filter, fn func(*LogEntry) error) error {
+	where := postgresConditions(tenant, filter)
+
+	query := `
+	SELECT
+		` + logColumns + `
+	FROM
+		logs
+	WHERE
+		` + where.String() + `
+	ORDER BY
+		created_at, id
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, where.args...)
+	if err != nil {
+		log.Println("Error retrieving logs:", err)
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		entry, err := scanLogEntry(rows)
+		if err != nil {
+			log.Println("Error scanning log:", err)
+			return err
+		}
+
+		if err = fn(entry); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func (s *postgresStore) GetOne(tenant, id string) (*LogEntry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	where := postgresConditions(tenant, Filter{})
+	where.add("id = ?", id)
+
+	query := `
+	SELECT
+		` + logColumns + `
+	FROM
+		logs
+	WHERE
+		` + where.String() + `
+	`
+
+	entry, err := scanLogEntry(s.db.QueryRowContext(ctx, query, where.args...))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		log.Printf("Error retrieving log with id of %s: %v\n", id, err)
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+func (s *postgresStore) Update(tenant string, entry *LogEntry) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	where := postgresConditions(tenant, Filter{})
+	where.add("id = ?", entry.ID)
+
+	query := `
+	UPDATE
+		logs
+	SET
+		name = ` + where.arg(entry.Name) + `,
+		level = ` + where.arg(entry.Level) + `,
+		data = ` + where.arg(entry.Data) + `,
+		updated_at = ` + where.arg(entry.UpdatedAt) + `
+	WHERE
+		` + where.String() + `
+	`
+
+	result, err := s.db.ExecContext(ctx, query, where.args...)
+	if err != nil {
+		log.Printf("Error updating log with id of %s: %v\n", entry.ID, err)
+		return err
+	}
+
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (s *postgresStore) DeleteByIDs(tenant string, ids []string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), bulkTimeout)
+	defer cancel()
+
+	where := postgresConditions(tenant, Filter{})
+	where.add("id = ANY(?)", ids)
+
+	result, err := s.db.ExecContext(ctx, `DELETE FROM logs WHERE `+where.String(), where.args...)
+	if err != nil {
+		log.Println("Error deleting logs:", err)
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+func (s *postgresStore) Restore(entries []*LogEntry) (int, error) {
+	restored, err := s.insert(entries, "ON CONFLICT (id) DO NOTHING")
+	if err != nil {
+		log.Println("Error restoring logs:", err)
+		return 0, err
+	}
+
+	return int(restored), nil
+}
+
+func (s *postgresStore) Repeat(repeats []Repeat) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+	UPDATE
+		logs
+	SET
+		count = GREATEST(count, $2),
+		first_seen = LEAST(first_seen, $3),
+		last_seen = GREATEST(last_seen, $4)
+	WHERE
+		id = $1
+	`
+
+	for _, repeat := range repeats {
+		_, err = tx.ExecContext(ctx, query, repeat.ID, repeat.Count, repeat.FirstSeen, repeat.LastSeen)
+		if err != nil {
+			log.Println("Error counting repeated logs:", err)
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *postgresStore) Drop(tenant string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), bulkTimeout)
+	defer cancel()
+
+	if tenant != "" {
+		_, err := s.db.ExecContext(ctx, `DELETE FROM logs WHERE tenant = $1`, tenant)
+		if err != nil {
+			log.Println("Error deleting logs of tenant:", err)
+			return err
+		}
+
+		return nil
+	}
+
+	if _, err := s.db.ExecContext(ctx, `TRUNCATE logs`); err != nil {
+		log.Println("Error truncating logs:", err)
+		return err
+	}
+
+	return nil
+}
+
+func (s *postgresStore) StorageUsed(tenant string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), bulkTimeout)
+	defer cancel()
+
+	where := postgresConditions(tenant, Filter{})
+
+	query := `
+	SELECT
+		COALESCE(SUM(
+			octet_length(name) + octet_length(data) + (
+				SELECT
+					COALESCE(SUM(octet_length(key) + octet_length(value)), 0)
+				FROM
+					jsonb_each_text(attributes)
+			)
+		), 0)::bigint
+	FROM
+		logs
+	WHERE
+		` + where.String() + `
+	`
+
+	var used int64
+	if err := s.db.QueryRowContext(ctx, query, where.args...).Scan(&used); err != nil {
+		log.Println("Error calculating storage used:", err)
+		return 0, err
+	}
+
+	return used, nil
+}
+
+func (s *postgresStore) Policies() ([]*RetentionPolicy, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `
+	SELECT
+		` + policyColumns + `
+	FROM
+		retention_policies
+	ORDER BY
+		name, level
+	`
+
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		log.Println("Error retrieving retention policies:", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var all []*RetentionPolicy
+	for rows.Next() {
+		policy, err := scanPolicy(rows)
+		if err != nil {
+			log.Println("Error scanning retention policy:", err)
+			return nil, err
+		}
+
+		all = append(all, policy)
+	}
+
+	return all, rows.Err()
+}
+
+func (s *postgresStore) UpsertPolicy(policy RetentionPolicy) (*RetentionPolicy, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `
+	INSERT INTO retention_policies
+		(` + policyColumns + `)
+	VALUES
+		($1, $2, $3, $4, $5, $5)
+	ON CONFLICT (name, level) DO UPDATE SET
+		max_age_seconds = EXCLUDED.max_age_seconds,
+		updated_at = EXCLUDED.updated_at
+	RETURNING
+		` + policyColumns + `
+	`
+
+	row := s.db.QueryRowContext(ctx, query,
+		primitive.NewObjectID().Hex(),
+		policy.Name,
+		policy.Level,
+		policy.MaxAge,
+		time.Now(),
+	)
+
+	saved, err := scanPolicy(row)
+	if err != nil {
+		log.Println("Error saving retention policy:", err)
+		return nil, err
+	}
+
+	return saved, nil
+}
+
+func (s *postgresStore) DeletePolicy(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	result, err := s.db.ExecContext(ctx, `DELETE FROM retention_policies WHERE id = $1`, id)
+	if err != nil {
+		log.Printf("Error deleting retention policy with id of %s: %v\n", id, err)
+		return err
+	}
+
+	if deleted, _ := result.RowsAffected(); deleted == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (s *postgresStore) Rules() ([]*AlertRule, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, `SELECT rule FROM alert_rules ORDER BY name`)
+	if err != nil {
+		log.Println("Error retrieving alert rules:", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var all []*AlertRule
+	for rows.Next() {
+		var encoded []byte
+		if err := rows.Scan(&encoded); err != nil {
+			log.Println("Error scanning alert rule:", err)
+			return nil, err
+		}
+
+		var rule AlertRule
+		if err := json.Unmarshal(encoded, &rule); err != nil {
+			return nil, err
+		}
+
+		all = append(all, &rule)
+	}
+
+	return all, rows.Err()
+}
+
+// SaveRule stores the rule as a JSON document, only its id and name have
+// their own column
+func (s *postgresStore) SaveRule(rule *AlertRule) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	encoded, err := json.Marshal(rule)
+	if err != nil {
+		return err
+	}
+
+	query := `
+	INSERT INTO alert_rules
+		(id, name, rule)
+	VALUES
+		($1, $2, $3::jsonb)
+	ON CONFLICT (id) DO UPDATE SET
+		name = EXCLUDED.name,
+		rule = EXCLUDED.rule
+	`
+
+	if _, err = s.db.ExecContext(ctx, query, rule.ID, rule.Name, string(encoded)); err != nil {
+		log.Println("Error saving alert rule:", err)
+		return err
+	}
+
+	return nil
+}
+
+func (s *postgresStore) DeleteRule(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	result, err := s.db.ExecContext(ctx, `DELETE FROM alert_rules WHERE id = $1`, id)
+	if err != nil {
+		log.Printf("Error deleting alert rule with id of %s: %v\n", id, err)
+		return err
+	}
+
+	if deleted, _ := result.RowsAffected(); deleted == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (s *postgresStore) Webhooks() ([]*Webhook, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, `SELECT webhook FROM webhooks ORDER BY url`)
+	if err != nil {
+		log.Println("Error retrieving webhooks:", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var all []*Webhook
+	for rows.Next() {
+		var encoded []byte
+		if err := rows.Scan(&encoded); err != nil {
+			log.Println("Error scanning webhook:", err)
+			return nil, err
+		}
+
+		var hook Webhook
+		if err := json.Unmarshal(encoded, &hook); err != nil {
+			return nil, err
+		}
+
+		all = append(all, &hook)
+	}
+
+	return all, rows.Err()
+}
+
+// SaveWebhook stores the webhook as a JSON document, only its id and URL have
+// their own column
+func (s *postgresStore) SaveWebhook(hook *Webhook) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	encoded, err := json.Marshal(hook)
+	if err != nil {
+		return err
+	}
+
+	query := `
+	INSERT INTO webhooks
+		(id, url, webhook)
+	VALUES
+		($1, $2, $3::jsonb)
+	ON CONFLICT (id) DO UPDATE SET
+		url = EXCLUDED.url,
+		webhook = EXCLUDED.webhook
+	`
+
+	if _, err = s.db.ExecContext(ctx, query, hook.ID, hook.URL, string(encoded)); err != nil {
+		log.Println("Error saving webhook:", err)
+		return err
+	}
+
+	return nil
+}
+
+// RecordWebhookResult updates the document of the webhook in a single
+// statement, which locks its row until the failures are counted
+func (s *postgresStore) RecordWebhookResult(id string, success bool, limit int, now time.Time) (*Webhook, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	updatedAt := now.Format(time.RFC3339Nano)
+
+	var (
+		row   *sql.Row
+		query string
+	)
+	if success {
+		// a webhook without failures is left as it is
+		query = `
+		UPDATE webhooks SET
+			webhook = webhook || jsonb_build_object('failures', 0, 'updated_at', $2::text)
+		WHERE
+			id = $1 AND COALESCE((webhook->>'failures')::int, 0) <> 0
+		RETURNING webhook
+		`
+		row = s.db.QueryRowContext(ctx, query, id, updatedAt)
+	} else {
+		query = `
+		UPDATE webhooks SET
+			webhook = webhook ||
+				jsonb_build_object('failures', COALESCE((webhook->>'failures')::int, 0) + 1, 'updated_at', $2::text) ||
+				CASE
+					WHEN COALESCE((webhook->>'failures')::int, 0) + 1 >= $3 AND NOT COALESCE((webhook->>'disabled')::boolean, false)
+					THEN jsonb_build_object('disabled', true, 'disabled_reason', $4::text)
+					ELSE '{}'::jsonb
+				END
+		WHERE
+			id = $1
+		RETURNING webhook
+		`
+		row = s.db.QueryRowContext(ctx, query, id, updatedAt, limit, webhookDisabledReason)
+	}
+
+	var encoded []byte
+	err := row.Scan(&encoded)
+	if errors.Is(err, sql.ErrNoRows) && success {
+		err = s.db.QueryRowContext(ctx, `SELECT webhook FROM webhooks WHERE id = $1`, id).Scan(&encoded)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		log.Printf("Error recording result of webhook with id of %s: %v\n", id, err)
+		return nil, err
+	}
+
+	var hook Webhook
+	if err = json.Unmarshal(encoded, &hook); err != nil {
+		return nil, err
+	}
+
+	return &hook, nil
+}
+
+func (s *postgresStore) DeleteWebhook(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM webhooks WHERE id = $1`, id)
+	if err != nil {
+		log.Printf("Error deleting webhook with id of %s: %v\n", id, err)
+		return err
+	}
+
+	if deleted, _ := result.RowsAffected(); deleted == 0 {
+		return ErrNotFound
+	}
+
+	if _, err = tx.ExecContext(ctx, `DELETE FROM webhook_deliveries WHERE webhook_id = $1`, id); err != nil {
+		log.Printf("Error deleting deliveries of webhook with id of %s: %v\n", id, err)
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *postgresStore) InsertDelivery(delivery *WebhookDelivery) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	encoded, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+
+	query := `
+	INSERT INTO webhook_deliveries
+		(id, webhook_id, created_at, delivery)
+	VALUES
+		($1, $2, $3, $4::jsonb)
+	`
+
+	_, err = s.db.ExecContext(ctx, query, delivery.ID, delivery.WebhookID, delivery.CreatedAt, string(encoded))
+	if err != nil {
+		log.Println("Error inserting webhook delivery:", err)
+		return err
+	}
+
+	return nil
+}
+
+func (s *postgresStore) Deliveries(webhookID string, limit int) ([]*WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `
+	SELECT
+		delivery
+	FROM
+		webhook_deliveries
+	WHERE
+		webhook_id = $1
+	ORDER BY
+		created_at DESC, id DESC
+	LIMIT $2
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, webhookID, limit)
+	if err != nil {
+		log.Println("Error retrieving webhook deliveries:", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var all []*WebhookDelivery
+	for rows.Next() {
+		var encoded []byte
+		if err := rows.Scan(&encoded); err != nil {
+			log.Println("Error scanning webhook delivery:", err)
+			return nil, err
+		}
+
+		var delivery WebhookDelivery
+		if err := json.Unmarshal(encoded, &delivery); err != nil {
+			return nil, err
+		}
+
+		all = append(all, &delivery)
+	}
+
+	return all, rows.Err()
+}
+
+func (s *postgresStore) DeleteDeliveries(before time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), bulkTimeout)
+	defer cancel()
+
+	result, err := s.db.ExecContext(ctx, `DELETE FROM webhook_deliveries WHERE created_at < $1`, before)
+	if err != nil {
+		log.Println("Error deleting webhook deliveries:", err)
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+func (s *postgresStore) ApplyExpiry(policies []*RetentionPolicy) error {
+	ctx, cancel := context.WithTimeout(context.Background(), bulkTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	unmatched := &pgConditions{}
+	unmatched.where = append(unmatched.where, "expire_at IS NOT NULL")
+
+	for _, policy := range policies {
+		where := policyConditions(policy, &pgConditions{})
+		maxAge := where.arg(policy.MaxAge)
+
+		query := `UPDATE logs SET expire_at = created_at + ` + maxAge + ` * interval '1 second' WHERE ` + where.String()
+
+		if _, err = tx.ExecContext(ctx, query, where.args...); err != nil {
+			log.Println("Error applying retention policy:", err)
+			return err
+		}
+
+		// the placeholders of the policy continue after those of the previous
+		// policies
+		matched := policyConditions(policy, &pgConditions{args: unmatched.args})
+		unmatched.where = append(unmatched.where, "NOT ("+matched.String()+")")
+		unmatched.args = matched.args
+	}
+
+	// entries that no longer match any policy are kept forever
+	query := `UPDATE logs SET expire_at = NULL WHERE ` + unmatched.String()
+
+	if _, err = tx.ExecContext(ctx, query, unmatched.args...); err != nil {
+		log.Println("Error clearing expiry of log entries:", err)
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *postgresStore) DeleteExpired(now time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), bulkTimeout)
+	defer cancel()
+
+	result, err := s.db.ExecContext(ctx, `DELETE FROM logs WHERE expire_at <= $1`, now)
+	if err != nil {
+		log.Println("Error deleting expired logs:", err)
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// EnsureTextIndex creates the index used by Search
+func (s *postgresStore) EnsureTextIndex() error {
+	ctx, cancel := context.WithTimeout(context.Background(), bulkTimeout)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS logs_search_all ON logs USING GIN (`+postgresSearch+`)`)
+	if err != nil {
+		log.Println("Error creating text index:", err)
+		return err
+	}
+
+	// the index of the search column alone is replaced by logs_search_all
+	_, err = s.db.ExecContext(ctx, `DROP INDEX IF EXISTS logs_search`)
+	if err != nil {
+		log.Println("Error dropping old text index:", err)
+		return err
+	}
+
+	return nil
+}
+
+// Search uses the websearch syntax of PostgreSQL, which like MongoDB supports
+// "quoted phrases" and -negated terms
+func (s *postgresStore) Search(tenant, query string, limit int, after *SearchCursor) ([]*SearchResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	where := postgresConditions(tenant, Filter{})
+	where.add(postgresSearch+" @@ websearch_to_tsquery('english', ?)", query)
+	terms := "$" + strconv.Itoa(len(where.args))
+
+	page := &pgConditions{args: where.args}
+	if after != nil {
+		// results are sorted by score and then id, so the next page starts
+		// with a lower score or the same score and a lower id
+		score := page.arg(after.Score)
+		page.where = append(page.where, "(score < "+score+" OR (score = "+score+" AND id < "+page.arg(after.ID)+"))")
+	}
+
+	statement := `
+	SELECT
+		` + logColumns + `, score
+	FROM (
+		SELECT
+			` + logColumns + `,
+			ts_rank(` + postgresSearch + `, websearch_to_tsquery('english', ` + terms + `)) AS score
+		FROM
+			logs
+		WHERE
+			` + where.String() + `
+	) ranked
+	WHERE
+		` + page.String() + `
+	ORDER BY
+		score DESC, id DESC
+	LIMIT ` + page.arg(limit) + `
+	`
+
+	rows, err := s.db.QueryContext(ctx, statement, page.args...)
+	if err != nil {
+		log.Println("Error searching logs:", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []*SearchResult
+	for rows.Next() {
+		var result SearchResult
+
+		if err := scanLogEntryInto(rows, &result.LogEntry, &result.Score); err != nil {
+			log.Println("Error scanning search result:", err)
+			return nil, err
+		}
+
+		results = append(results, &result)
+	}
+
+	return results, rows.Err()
+}
+
+// postgresOccurrences sums the number of times the entries were received,
+// rather than counting the rows. Entries never folded by the deduplication
+// have a count of 0
+const postgresOccurrences = `sum(GREATEST(count, 1))::bigint`
+
+func (s *postgresStore) CountsOverTime(tenant string, filter Filter, bucket string) ([]*NameCount, error) {
+	if !validBucket(bucket) {
+		return nil, ErrInvalidBucket
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), bulkTimeout)
+	defer cancel()
+
+	where := postgresConditions(tenant, filter)
+
+	query := `
+	SELECT
+		date_trunc(` + where.arg(bucket) + `, created_at, 'UTC') AS bucket,
+		name,
+		` + postgresOccurrences + `
+	FROM
+		logs
+	WHERE
+		` + where.String() + `
+	GROUP BY
+		bucket, name
+	ORDER BY
+		bucket, name
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, where.args...)
+	if err != nil {
+		log.Println("Error counting logs:", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var counts []*NameCount
+	for rows.Next() {
+		var start time.Time
+		var count NameCount
+
+		if err := rows.Scan(&start, &count.Name, &count.Count); err != nil {
+			log.Println("Error scanning log count:", err)
+			return nil, err
+		}
+
+		start = start.UTC()
+		count.Bucket = &start
+
+		counts = append(counts, &count)
+	}
+
+	return counts, rows.Err()
+}
+
+func (s *postgresStore) TopNames(tenant string, filter Filter, limit int) ([]*NameCount, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), bulkTimeout)
+	defer cancel()
+
+	where := postgresConditions(tenant, filter)
+
+	query := `
+	SELECT
+		name,
+		` + postgresOccurrences + ` AS total
+	FROM
+		logs
+	WHERE
+		` + where.String() + `
+	GROUP BY
+		name
+	ORDER BY
+		total DESC, name
+	LIMIT ` + where.arg(limit) + `
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, where.args...)
+	if err != nil {
+		log.Println("Error counting logs:", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var counts []*NameCount
+	for rows.Next() {
+		var count NameCount
+
+		if err := rows.Scan(&count.Name, &count.Count); err != nil {
+			log.Println("Error scanning log count:", err)
+			return nil, err
+		}
+
+		counts = append(counts, &count)
+	}
+
+	return counts, rows.Err()
+}
+
+func (s *postgresStore) ErrorRate(tenant string, filter Filter, bucket string) ([]*ErrorRatePoint, error) {
+	if !validBucket(bucket) {
+		return nil, ErrInvalidBucket
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), bulkTimeout)
+	defer cancel()
+
+	where := postgresConditions(tenant, filter)
+
+	query := `
+	SELECT
+		date_trunc(` + where.arg(bucket) + `, created_at, 'UTC') AS bucket,
+		` + postgresOccurrences + `,
+		COALESCE(sum(GREATEST(count, 1)) FILTER (WHERE level = ANY(` + where.arg(ErrorLevels) + `)), 0)::bigint
+	FROM
+		logs
+	WHERE
+		` + where.String() + `
+	GROUP BY
+		bucket
+	ORDER BY
+		bucket
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, where.args...)
+	if err != nil {
+		log.Println("Error calculating error rate:", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var points []*ErrorRatePoint
+	for rows.Next() {
+		var start time.Time
+		var total, errorCount int64
+
+		if err := rows.Scan(&start, &total, &errorCount); err != nil {
+			log.Println("Error scanning error rate:", err)
+			return nil, err
+		}
+
+		points = append(points, newErrorRatePoint(start.UTC(), total, errorCount))
+	}
+
+	return points, rows.Err()
+}
+
+// insert adds the entries in chunks within one transaction and returns how
+// many rows were inserted. The suffix is appended to every statement
+func (s *postgresStore) insert(entries []*LogEntry, suffix string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), bulkTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var inserted int64
+	for start := 0; start < len(entries); start += postgresInsertChunk {
+		chunk := entries[start:min(start+postgresInsertChunk, len(entries))]
+
+		values := &pgConditions{}
+		rows := make([]string, len(chunk))
+		for i, entry := range chunk {
+			var attributes any
+			if len(entry.Attributes) > 0 {
+				encoded, err := json.Marshal(entry.Attributes)
+				if err != nil {
+					return 0, err
+				}
+				attributes = string(encoded)
+			}
+
+			rows[i] = "(" + strings.Join([]string{
+				values.arg(entry.ID),
+				values.arg(entry.Tenant),
+				values.arg(entry.Name),
+				values.arg(entry.Level),
+				values.arg(entry.Data),
+				values.arg(attributes) + "::jsonb",
+				values.arg(entry.CreatedAt),
+				values.arg(entry.UpdatedAt),
+				values.arg(entry.ExpireAt),
+				values.arg(entry.Count),
+				values.arg(entry.FirstSeen),
+				values.arg(entry.LastSeen),
+			}, ", ") + ")"
+		}
+
+		query := `INSERT INTO logs (` + logColumns + `) VALUES ` + strings.Join(rows, ", ") + ` ` + suffix
+
+		result, err := tx.ExecContext(ctx, query, values.args...)
+		if err != nil {
+			return 0, err
+		}
+
+		count, _ := result.RowsAffected()
+		inserted += count
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return inserted, nil
+}
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanLogEntry(row rowScanner) (*LogEntry, error) {
+	var entry LogEntry
+	if err := scanLogEntryInto(row, &entry); err != nil {
+		return nil, err
+	}
+
+	return &entry, nil
+}
+
+// scanLogEntryInto scans the logColumns into entry, followed by the extra
+// columns of the query
+func scanLogEntryInto(row rowScanner, entry *LogEntry, extra ...any) error {
+	var attributes []byte
+
+	dest := append([]any{
+		&entry.ID,
+		&entry.Tenant,
+		&entry.Name,
+		&entry.Level,
+		&entry.Data,
+		&attributes,
+		&entry.CreatedAt,
+		&entry.UpdatedAt,
+		&entry.ExpireAt,
+		&entry.Count,
+		&entry.FirstSeen,
+		&entry.LastSeen,
+	}, extra...)
+
+	if err := row.Scan(dest...); err != nil {
+		return err
+	}
+
+	if len(attributes) > 0 {
+		return json.Unmarshal(attributes, &entry.Attributes)
+	}
+
+	return nil
+}
+
+func scanPolicy(row rowScanner) (*RetentionPolicy, error) {
+	var policy RetentionPolicy
+
+	err := row.Scan(
+		&policy.ID,
+		&policy.Name,
+		&policy.Level,
+		&policy.MaxAge,
+		&policy.CreatedAt,
+		&policy.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &policy, nil
+}
+
+// pgConditions collects the conditions of a WHERE clause and their
+// arguments, numbering the placeholders in the order they are added
+type pgConditions struct {
+	where []string
+	args  []any
+}
+
+// arg adds an argument and returns its placeholder
+func (c *pgConditions) arg(value any) string {
+	c.args = append(c.args, value)
+
+	return "$" + strconv.Itoa(len(c.args))
+}
+
+// add adds a condition whose ? is replaced by the placeholder of value
+func (c *pgConditions) add(condition string, value any) {
+	c.where = append(c.where, strings.Replace(condition, "?", c.arg(value), 1))
+}
+
+func (c *pgConditions) String() string {
+	if len(c.where) == 0 {
+		return "TRUE"
+	}
+
+	return strings.Join(c.where, " AND ")
+}
+
+// postgresConditions converts a filter into conditions on the logs table,
+// restricted to a tenant if one is given
+func postgresConditions(tenant string, f Filter) *pgConditions {
+	c := &pgConditions{}
+
+	if tenant != "" {
+		c.add("tenant = ?", tenant)
+	}
+
+	if f.Name != "" {
+		c.add("name = ?", f.Name)
+	}
+
+	if f.Level != "" {
+		c.add("level = ?", f.Level)
+	}
+
+	if f.RequestID != "" {
+		c.add("attributes->>'request_id' = ?", f.RequestID)
+	}
+
+	if !f.From.IsZero() {
+		c.add("created_at >= ?", f.From)
+	}
+
+	if !f.To.IsZero() {
+		c.add("created_at < ?", f.To)
+	}
+
+	if !f.ExpiredBy.IsZero() {
+		c.add("expire_at <= ?", f.ExpiredBy)
+	}
+
+	return c
+}
+
+// policyConditions adds to c the conditions selecting the log entries a
+// retention policy applies to
+func policyConditions(policy *RetentionPolicy, c *pgConditions) *pgConditions {
+	if policy.Name != "" {
+		c.add("name = ?", policy.Name)
+	}
+
+	if policy.Level != "" {
+		c.add("level = ?", policy.Level)
+	}
+
+	return c
+}
@@ -0,0 +1,179 @@
+package data
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// policies is an in memory copy of the retention policies, used to stamp
+	// the expiry date on new log entries without querying the database
+	policies   []*RetentionPolicy
+	policiesMu sync.RWMutex
+)
+
+// RetentionPolicy describes how long log entries are kept before they expire.
+// An empty Name or Level matches any value of that field. When more than one
+// policy matches an entry the most specific one wins: name and level, then
+// name only, then level only and finally the default policy with neither set
+type RetentionPolicy struct {
+	ID        string    `bson:"_id,omitempty" json:"id,omitempty"`
+	Name      string    `bson:"name" json:"name"`
+	Level     string    `bson:"level" json:"level"`
+	MaxAge    int64     `bson:"max_age_seconds" json:"max_age_seconds"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+	UpdatedAt time.Time `bson:"updated_at" json:"updated_at"`
+}
+
+// All returns every retention policy stored in the database
+func (r *RetentionPolicy) All() ([]*RetentionPolicy, error) {
+	return store.Policies()
+}
+
+// Upsert creates the policy for the name and level of the given policy, or
+// replaces the max age of the existing one, and refreshes the in memory copy
+func (r *RetentionPolicy) Upsert(policy RetentionPolicy) (*RetentionPolicy, error) {
+	saved, err := store.UpsertPolicy(policy)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = r.Refresh(); err != nil {
+		return nil, err
+	}
+
+	return saved, nil
+}
+
+// DeleteByID removes one retention policy by id and refreshes the in memory
+// copy. It returns ErrNotFound when the policy does not exist
+func (r *RetentionPolicy) DeleteByID(id string) error {
+	if err := store.DeletePolicy(id); err != nil {
+		return err
+	}
+
+	_, err := r.Refresh()
+
+	return err
+}
+
+// Refresh reloads the in memory copy of the retention policies from the
+// database. It reports whether the policies changed since the last refresh,
+// which happens when another replica of the service modified them
+func (r *RetentionPolicy) Refresh() (bool, error) {
+	all, err := r.All()
+	if err != nil {
+		return false, err
+	}
+
+	policiesMu.Lock()
+	defer policiesMu.Unlock()
+
+	changed := !reflect.DeepEqual(policies, all)
+	policies = all
+
+	return changed, nil
+}
+
+// EnsureTTLIndex makes the store delete log entries on its own once their
+// expiry date is reached, when it is able to
+func (r *RetentionPolicy) EnsureTTLIndex() error {
+	if indexer, ok := store.(ExpiryIndexer); ok {
+		return indexer.EnsureTTLIndex()
+	}
+
+	return nil
+}
+
+// DropTTLIndex stops the store from deleting expired log entries on its own,
+// so that they are only deleted by the sweeper. Used when expired entries
+// have to be archived first
+func (r *RetentionPolicy) DropTTLIndex() error {
+	if indexer, ok := store.(ExpiryIndexer); ok {
+		return indexer.DropTTLIndex()
+	}
+
+	return nil
+}
+
+// Compact reclaims the space held by the deleted log entries, for the stores
+// that keep them until then
+func (r *RetentionPolicy) Compact() (int64, error) {
+	if compacter, ok := store.(Compacter); ok {
+		return compacter.Compact()
+	}
+
+	return 0, nil
+}
+
+// ApplyExpiry recalculates the expiry date of the existing log entries using
+// the current policies. It is needed after a policy changes, because the
+// expiry date of an entry is otherwise only set when it is inserted
+func (r *RetentionPolicy) ApplyExpiry() error {
+	current := snapshotPolicies()
+
+	// apply the least specific policies first, so that the more specific ones
+	// overwrite them for the entries matched by both
+	sort.SliceStable(current, func(i, j int) bool {
+		return current[i].specificity() < current[j].specificity()
+	})
+
+	return store.ApplyExpiry(current)
+}
+
+// Sweep deletes the log entries whose expiry date has passed. MongoDB only
+// runs its TTL monitor once a minute, so this is a backstop that also covers
+// entries that expired while the TTL index did not exist yet, and the only
+// way expired entries are deleted from the other stores
+func (r *RetentionPolicy) Sweep() (int64, error) {
+	return store.DeleteExpired(time.Now())
+}
+
+// specificity ranks how specific the policy is, a higher value wins when more
+// than one policy matches the same entry
+func (r *RetentionPolicy) specificity() int {
+	rank := 0
+	if r.Name != "" {
+		rank += 2
+	}
+	if r.Level != "" {
+		rank++
+	}
+
+	return rank
+}
+
+// matches reports whether the policy applies to an entry with the given name
+// and level
+func (r *RetentionPolicy) matches(name, level string) bool {
+	return (r.Name == "" || r.Name == name) && (r.Level == "" || r.Level == level)
+}
+
+// snapshotPolicies returns a copy of the in memory retention policies
+func snapshotPolicies() []*RetentionPolicy {
+	policiesMu.RLock()
+	defer policiesMu.RUnlock()
+
+	return append([]*RetentionPolicy(nil), policies...)
+}
+
+// expiryFor returns the date at which an entry with the given name and level,
+// created at the given time, expires. It returns nil when no policy matches
+func expiryFor(name, level string, created time.Time) *time.Time {
+	var match *RetentionPolicy
+	for _, policy := range snapshotPolicies() {
+		if policy.matches(name, level) && (match == nil || policy.specificity() > match.specificity()) {
+			match = policy
+		}
+	}
+
+	if match == nil {
+		return nil
+	}
+
+	expiry := created.Add(time.Duration(match.MaxAge) * time.Second)
+
+	return &expiry
+}
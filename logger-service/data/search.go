@@ -0,0 +1,79 @@
+package data
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErrInvalidCursor is returned when a search cursor can not be decoded
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// SearchResult is a log entry matched by a full-text search, together with
+// its relevance score
+type SearchResult struct {
+	LogEntry `bson:",inline"`
+	Score    float64 `bson:"score" json:"score"`
+}
+
+// SearchCursor points at the last result of a page of search results, the
+// next page starts right after it
+type SearchCursor struct {
+	Score float64 `json:"s"`
+	ID    string  `json:"i"`
+}
+
+// Encode returns the cursor as an opaque string that is safe to use in a URL
+func (c SearchCursor) Encode() string {
+	out, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(out)
+}
+
+// DecodeSearchCursor parses a cursor created by SearchCursor.Encode
+func DecodeSearchCursor(s string) (*SearchCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	var cursor SearchCursor
+	if err = json.Unmarshal(raw, &cursor); err != nil || !primitive.IsValidObjectID(cursor.ID) {
+		return nil, ErrInvalidCursor
+	}
+
+	return &cursor, nil
+}
+
+// EnsureIndexes creates the indexes of the store that are missing, including
+// the text index used by Search when the store supports full-text search
+func (l *LogEntry) EnsureIndexes() error {
+	if indexer, ok := store.(Indexer); ok {
+		return indexer.EnsureIndexes()
+	}
+
+	return l.EnsureTextIndex()
+}
+
+// EnsureTextIndex creates the text index used by Search, when the store
+// supports full-text search
+func (l *LogEntry) EnsureTextIndex() error {
+	if searcher, ok := store.(Searcher); ok {
+		return searcher.EnsureTextIndex()
+	}
+
+	return nil
+}
+
+// Search returns up to limit log entries matching the text query, the most
+// relevant first. Pass the cursor of the last result of a page to get the
+// next one. It returns ErrNotSupported when the store has no full-text search
+func (l *LogEntry) Search(query string, limit int, after *SearchCursor) ([]*SearchResult, error) {
+	searcher, ok := store.(Searcher)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+
+	return searcher.Search(l.Tenant, query, limit, after)
+}
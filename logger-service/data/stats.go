@@ -0,0 +1,178 @@
+package data
+
+import (
+	"errors"
+	"slices"
+	"sort"
+	"time"
+)
+
+// ErrInvalidBucket is returned when a time bucket is not one of minute, hour
+// or day
+var ErrInvalidBucket = errors.New("bucket must be one of minute, hour or day")
+
+// ErrorLevels are the levels counted as errors by ErrorRate
+var ErrorLevels = []string{"error", "fatal", "critical", "alert", "emergency"}
+
+// NameCount is the number of entries logged under one name, optionally within
+// one time bucket
+type NameCount struct {
+	Bucket *time.Time `bson:"-" json:"bucket,omitempty"`
+	Name   string     `bson:"name" json:"name"`
+	Count  int64      `bson:"count" json:"count"`
+}
+
+// ErrorRatePoint is the share of error entries within one time bucket
+type ErrorRatePoint struct {
+	Bucket time.Time `json:"bucket"`
+	Total  int64     `json:"total"`
+	Errors int64     `json:"errors"`
+	Rate   float64   `json:"rate"`
+}
+
+// CountsOverTime returns the number of entries per name and time bucket,
+// ordered by bucket and then name. The entries folded by the deduplication
+// are counted as many times as they were received, as in every statistic
+func (l *LogEntry) CountsOverTime(filter Filter, bucket string) ([]*NameCount, error) {
+	if aggregator, ok := store.(Aggregator); ok {
+		return aggregator.CountsOverTime(l.Tenant, filter, bucket)
+	}
+
+	if !validBucket(bucket) {
+		return nil, ErrInvalidBucket
+	}
+
+	type key struct {
+		bucket time.Time
+		name   string
+	}
+
+	totals := make(map[key]int64)
+	err := l.Each(filter, func(entry *LogEntry) error {
+		totals[key{bucketStart(entry.CreatedAt, bucket), entry.Name}] += entry.occurrences()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make([]*NameCount, 0, len(totals))
+	for k, count := range totals {
+		start := k.bucket
+		counts = append(counts, &NameCount{Bucket: &start, Name: k.name, Count: count})
+	}
+
+	sort.Slice(counts, func(i, j int) bool {
+		if !counts[i].Bucket.Equal(*counts[j].Bucket) {
+			return counts[i].Bucket.Before(*counts[j].Bucket)
+		}
+		return counts[i].Name < counts[j].Name
+	})
+
+	return counts, nil
+}
+
+// TopNames returns the limit names with the most entries, most entries first
+func (l *LogEntry) TopNames(filter Filter, limit int) ([]*NameCount, error) {
+	if aggregator, ok := store.(Aggregator); ok {
+		return aggregator.TopNames(l.Tenant, filter, limit)
+	}
+
+	totals := make(map[string]int64)
+	err := l.Each(filter, func(entry *LogEntry) error {
+		totals[entry.Name] += entry.occurrences()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make([]*NameCount, 0, len(totals))
+	for name, count := range totals {
+		counts = append(counts, &NameCount{Name: name, Count: count})
+	}
+
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Name < counts[j].Name
+	})
+
+	if len(counts) > limit {
+		counts = counts[:limit]
+	}
+
+	return counts, nil
+}
+
+// ErrorRate returns, per time bucket, the number of entries and how many of
+// them have one of the ErrorLevels
+func (l *LogEntry) ErrorRate(filter Filter, bucket string) ([]*ErrorRatePoint, error) {
+	if aggregator, ok := store.(Aggregator); ok {
+		return aggregator.ErrorRate(l.Tenant, filter, bucket)
+	}
+
+	if !validBucket(bucket) {
+		return nil, ErrInvalidBucket
+	}
+
+	totals := make(map[time.Time]*ErrorRatePoint)
+	err := l.Each(filter, func(entry *LogEntry) error {
+		start := bucketStart(entry.CreatedAt, bucket)
+
+		point, ok := totals[start]
+		if !ok {
+			point = &ErrorRatePoint{Bucket: start}
+			totals[start] = point
+		}
+
+		point.Total += entry.occurrences()
+		if slices.Contains(ErrorLevels, entry.Level) {
+			point.Errors += entry.occurrences()
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	points := make([]*ErrorRatePoint, 0, len(totals))
+	for _, point := range totals {
+		points = append(points, newErrorRatePoint(point.Bucket, point.Total, point.Errors))
+	}
+
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].Bucket.Before(points[j].Bucket)
+	})
+
+	return points, nil
+}
+
+func newErrorRatePoint(bucket time.Time, total, errors int64) *ErrorRatePoint {
+	return &ErrorRatePoint{
+		Bucket: bucket,
+		Total:  total,
+		Errors: errors,
+		Rate:   float64(errors) / float64(total),
+	}
+}
+
+func validBucket(bucket string) bool {
+	return bucket == "minute" || bucket == "hour" || bucket == "day"
+}
+
+// bucketStart truncates a date to the start of its bucket, in UTC
+func bucketStart(t time.Time, bucket string) time.Time {
+	t = t.UTC()
+
+	switch bucket {
+	case "minute":
+		return t.Truncate(time.Minute)
+	case "hour":
+		return t.Truncate(time.Hour)
+	default:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+}
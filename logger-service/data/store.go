@@ -0,0 +1,115 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned when a log entry or retention policy does not
+	// exist
+	ErrNotFound = errors.New("not found")
+
+	// ErrNotSupported is returned for the operations the configured store
+	// can not perform
+	ErrNotSupported = errors.New("not supported by the configured log store")
+)
+
+// Store keeps the log entries, the retention policies, the alert rules and
+// the webhooks. The methods taking a tenant only see the entries of that
+// tenant, or every entry when it is empty. The models stamp the ids, dates and
+// tenant of new entries before passing them to the store
+type Store interface {
+	// Insert stores new entries. It returns the errors of the entries that
+	// could not be stored keyed by their position, the error is only set when
+	// the insert failed as a whole
+	Insert(entries []LogEntry) (map[int]error, error)
+	// Each stops when ctx is done, returning its error
+	Each(ctx context.Context, tenant string, filter Filter, fn func(*LogEntry) error) error
+	GetOne(tenant, id string) (*LogEntry, error)
+	Update(tenant string, entry *LogEntry) error
+	DeleteByIDs(tenant string, ids []string) (int64, error)
+	// Restore stores previously exported entries as they are, skipping the
+	// ones that still exist, and returns how many were stored
+	Restore(entries []*LogEntry) (int, error)
+	Drop(tenant string) error
+	// Repeat records the entries folded into existing ones by the
+	// deduplication. Counts and last seen dates never decrease, so repeats
+	// stored out of order are harmless
+	Repeat(repeats []Repeat) error
+	StorageUsed(tenant string) (int64, error)
+
+	Policies() ([]*RetentionPolicy, error)
+	UpsertPolicy(policy RetentionPolicy) (*RetentionPolicy, error)
+	DeletePolicy(id string) error
+	// ApplyExpiry recalculates the expiry date of the stored entries, the
+	// policies are sorted from the least to the most specific
+	ApplyExpiry(policies []*RetentionPolicy) error
+	// DeleteExpired deletes the entries whose expiry date is at or before now
+	DeleteExpired(now time.Time) (int64, error)
+
+	// Rules returns the alert rules of every tenant, ordered by name
+	Rules() ([]*AlertRule, error)
+	// SaveRule creates the rule, or replaces the rule with the same id
+	SaveRule(rule *AlertRule) error
+	DeleteRule(id string) error
+
+	// Webhooks returns the webhooks of every tenant, ordered by URL
+	Webhooks() ([]*Webhook, error)
+	// SaveWebhook creates the webhook, or replaces the webhook with the same
+	// id
+	SaveWebhook(hook *Webhook) error
+	// DeleteWebhook deletes a webhook together with its deliveries
+	DeleteWebhook(id string) error
+	// RecordWebhookResult atomically counts the outcome of delivering an
+	// event to a webhook, see Webhook.RecordResult, and returns the webhook
+	// as updated
+	RecordWebhookResult(id string, success bool, limit int, now time.Time) (*Webhook, error)
+	InsertDelivery(delivery *WebhookDelivery) error
+	// Deliveries returns the latest deliveries of a webhook, the most recent
+	// first
+	Deliveries(webhookID string, limit int) ([]*WebhookDelivery, error)
+	DeleteDeliveries(before time.Time) (int64, error)
+}
+
+// Indexer is implemented by the stores whose indexes are created by the
+// service rather than together with the tables
+type Indexer interface {
+	EnsureIndexes() error
+}
+
+// Searcher is implemented by the stores supporting full-text search
+type Searcher interface {
+	EnsureTextIndex() error
+	Search(tenant, query string, limit int, after *SearchCursor) ([]*SearchResult, error)
+}
+
+// Aggregator is implemented by the stores computing statistics themselves.
+// For the other stores they are computed by going through the entries
+type Aggregator interface {
+	CountsOverTime(tenant string, filter Filter, bucket string) ([]*NameCount, error)
+	TopNames(tenant string, filter Filter, limit int) ([]*NameCount, error)
+	ErrorRate(tenant string, filter Filter, bucket string) ([]*ErrorRatePoint, error)
+}
+
+// Watcher is implemented by the stores that can notify the entries inserted
+// by every replica of the service
+type Watcher interface {
+	Watch() (*LogStream, error)
+}
+
+// ExpiryIndexer is implemented by the stores that can delete expired entries
+// on their own, without waiting for the sweeper
+type ExpiryIndexer interface {
+	EnsureTTLIndex() error
+	DropTTLIndex() error
+}
+
+// Compacter is implemented by the stores that keep deleted entries until they
+// are compacted away
+type Compacter interface {
+	// Compact reclaims the space held by the deleted entries and returns how
+	// many were removed
+	Compact() (int64, error)
+}
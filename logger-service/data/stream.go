@@ -0,0 +1,55 @@
+package data
+
+import (
+	"context"
+	"sync"
+)
+
+var (
+	// insertListeners are called with every entry inserted by this process
+	insertListeners   []func(*LogEntry)
+	insertListenersMu sync.RWMutex
+)
+
+// LogStream delivers the log entries inserted by any replica of the service,
+// for instance using a MongoDB change stream
+type LogStream struct {
+	each func(ctx context.Context, fn func(*LogEntry)) error
+}
+
+// OnInsert registers fn to be called with every entry inserted by this
+// process, for instance to evaluate the alert rules. It is also the fallback
+// for Watch when change streams are not available
+func (l *LogEntry) OnInsert(fn func(*LogEntry)) {
+	insertListenersMu.Lock()
+	defer insertListenersMu.Unlock()
+
+	insertListeners = append(insertListeners, fn)
+}
+
+// Watch opens a stream of the inserted entries. Only MongoDB supports it, and
+// only when it runs as a replica set, otherwise an error is returned
+func (l *LogEntry) Watch() (*LogStream, error) {
+	watcher, ok := store.(Watcher)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+
+	return watcher.Watch()
+}
+
+// Each calls fn with every inserted entry until ctx is cancelled or the
+// stream fails
+func (s *LogStream) Each(ctx context.Context, fn func(*LogEntry)) error {
+	return s.each(ctx, fn)
+}
+
+// notifyInsert passes an inserted entry to the insert listeners
+func notifyInsert(entry *LogEntry) {
+	insertListenersMu.RLock()
+	defer insertListenersMu.RUnlock()
+
+	for _, listener := range insertListeners {
+		listener(entry)
+	}
+}
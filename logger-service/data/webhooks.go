@@ -0,0 +1,194 @@
+package data
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// webhookDisabledReason is the reason given to a webhook disabled by
+// RecordResult
+const webhookDisabledReason = "disabled after too many failed deliveries"
+
+// Webhook is a subscription of a URL to events. Payloads are signed with
+// Secret, and a webhook whose events keep failing is disabled until it is
+// enabled again. When Tenant is set on the receiver of a method, the method
+// only sees and creates the webhooks of that tenant
+type Webhook struct {
+	ID     string   `bson:"_id,omitempty" json:"id,omitempty"`
+	Tenant string   `bson:"tenant,omitempty" json:"tenant,omitempty"`
+	URL    string   `bson:"url" json:"url"`
+	Events []string `bson:"events" json:"events"`
+	// Match narrows down the log entries that trigger the webhook
+	Match  AlertMatch `bson:"match" json:"match"`
+	Secret string     `bson:"secret" json:"secret"`
+
+	Disabled       bool   `bson:"disabled,omitempty" json:"disabled,omitempty"`
+	DisabledReason string `bson:"disabled_reason,omitempty" json:"disabled_reason,omitempty"`
+	// Failures is the number of events in a row whose delivery failed after
+	// every retry
+	Failures int `bson:"failures" json:"failures"`
+
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+	UpdatedAt time.Time `bson:"updated_at" json:"updated_at"`
+}
+
+// WebhookDelivery is one attempt at delivering an event to a webhook
+type WebhookDelivery struct {
+	ID         string    `bson:"_id,omitempty" json:"id,omitempty"`
+	WebhookID  string    `bson:"webhook_id" json:"webhook_id"`
+	EventID    string    `bson:"event_id" json:"event_id"`
+	Event      string    `bson:"event" json:"event"`
+	Attempt    int       `bson:"attempt" json:"attempt"`
+	StatusCode int       `bson:"status_code,omitempty" json:"status_code,omitempty"`
+	Error      string    `bson:"error,omitempty" json:"error,omitempty"`
+	Success    bool      `bson:"success" json:"success"`
+	Duration   int64     `bson:"duration_ms" json:"duration_ms"`
+	CreatedAt  time.Time `bson:"created_at" json:"created_at"`
+}
+
+// All returns the webhooks, ordered by URL
+func (h *Webhook) All() ([]*Webhook, error) {
+	all, err := store.Webhooks()
+	if err != nil {
+		return nil, err
+	}
+
+	if h.Tenant == "" {
+		return all, nil
+	}
+
+	var own []*Webhook
+	for _, hook := range all {
+		if hook.Tenant == h.Tenant {
+			own = append(own, hook)
+		}
+	}
+
+	return own, nil
+}
+
+// GetOne returns one webhook by id, or ErrNotFound
+func (h *Webhook) GetOne(id string) (*Webhook, error) {
+	all, err := h.All()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, hook := range all {
+		if hook.ID == id {
+			return hook, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+// Insert saves a new webhook and returns it with its id
+func (h *Webhook) Insert(hook Webhook) (*Webhook, error) {
+	now := time.Now().UTC()
+
+	hook.ID = primitive.NewObjectID().Hex()
+	hook.Tenant = h.Tenant
+	hook.CreatedAt = now
+	hook.UpdatedAt = now
+
+	if err := store.SaveWebhook(&hook); err != nil {
+		return nil, err
+	}
+
+	return &hook, nil
+}
+
+// Update replaces the webhook with the id of the given webhook, or returns
+// ErrNotFound. Enabling a webhook resets its failures
+func (h *Webhook) Update(hook Webhook) (*Webhook, error) {
+	existing, err := h.GetOne(hook.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	hook.Tenant = existing.Tenant
+	hook.CreatedAt = existing.CreatedAt
+	hook.UpdatedAt = time.Now().UTC()
+
+	if hook.Disabled {
+		hook.DisabledReason = existing.DisabledReason
+		hook.Failures = existing.Failures
+	}
+
+	if err = store.SaveWebhook(&hook); err != nil {
+		return nil, err
+	}
+
+	return &hook, nil
+}
+
+// DeleteByID removes one webhook and its deliveries by id, or returns
+// ErrNotFound
+func (h *Webhook) DeleteByID(id string) error {
+	if _, err := h.GetOne(id); err != nil {
+		return err
+	}
+
+	return store.DeleteWebhook(id)
+}
+
+// RecordResult counts the outcome of delivering an event to the webhook with
+// the given id. A success resets the failures, and the webhook is disabled
+// once limit events in a row have failed. It returns the updated webhook. The
+// store updates the webhook atomically, as deliveries finish concurrently
+func (h *Webhook) RecordResult(id string, success bool, limit int) (*Webhook, error) {
+	if h.Tenant != "" {
+		if _, err := h.GetOne(id); err != nil {
+			return nil, err
+		}
+	}
+
+	return store.RecordWebhookResult(id, success, limit, time.Now().UTC())
+}
+
+// recordResult applies the outcome of a delivery to the webhook, for the
+// stores updating webhooks in memory. It reports whether the webhook changed
+func (h *Webhook) recordResult(success bool, limit int, now time.Time) bool {
+	if success {
+		if h.Failures == 0 {
+			return false
+		}
+
+		h.Failures = 0
+	} else {
+		h.Failures++
+
+		if h.Failures >= limit && !h.Disabled {
+			h.Disabled = true
+			h.DisabledReason = webhookDisabledReason
+		}
+	}
+
+	h.UpdatedAt = now
+
+	return true
+}
+
+// AddDelivery records one delivery attempt
+func (h *Webhook) AddDelivery(delivery WebhookDelivery) error {
+	delivery.ID = primitive.NewObjectID().Hex()
+
+	return store.InsertDelivery(&delivery)
+}
+
+// Deliveries returns the latest delivery attempts of a webhook, the most
+// recent first
+func (h *Webhook) Deliveries(id string, limit int) ([]*WebhookDelivery, error) {
+	if _, err := h.GetOne(id); err != nil {
+		return nil, err
+	}
+
+	return store.Deliveries(id, limit)
+}
+
+// PruneDeliveries deletes the delivery attempts older than the given time
+func (h *Webhook) PruneDeliveries(before time.Time) (int64, error) {
+	return store.DeleteDeliveries(before)
+}
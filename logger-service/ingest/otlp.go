@@ -0,0 +1,285 @@
+package ingest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"logger-service/data"
+	"strconv"
+	"strings"
+	"time"
+
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// ErrUnsupportedEncoding is returned for OTLP payloads that are neither
+// protobuf nor JSON
+var ErrUnsupportedEncoding = errors.New("OTLP logs must be sent as application/x-protobuf or application/json")
+
+// otlpLevels are the levels of the ranges of OTLP severity numbers, four
+// numbers per range starting at 1
+var otlpLevels = []string{"trace", "debug", "info", "warning", "error", "fatal"}
+
+// DecodeOTLP reads the body of an OTLP/HTTP logs export. An export request has
+// the same fields as LogsData, so it is decoded as one
+func DecodeOTLP(body []byte, mediaType string) (*logspb.LogsData, error) {
+	logs := &logspb.LogsData{}
+
+	switch mediaType {
+	case "application/x-protobuf":
+		if err := proto.Unmarshal(body, logs); err != nil {
+			return nil, err
+		}
+	case "application/json":
+		body, err := hexIDsToBase64(body)
+		if err != nil {
+			return nil, err
+		}
+
+		opts := protojson.UnmarshalOptions{DiscardUnknown: true}
+		if err = opts.Unmarshal(body, logs); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, ErrUnsupportedEncoding
+	}
+
+	return logs, nil
+}
+
+// EncodeOTLPResponse builds the export response reporting the number of
+// rejected records, in the encoding of the request
+func EncodeOTLPResponse(mediaType string, rejected int64, message string) []byte {
+	if mediaType == "application/json" {
+		if rejected == 0 && message == "" {
+			return []byte("{}")
+		}
+
+		out, _ := json.Marshal(map[string]any{
+			"partialSuccess": map[string]any{
+				"rejectedLogRecords": strconv.FormatInt(rejected, 10),
+				"errorMessage":       message,
+			},
+		})
+		return out
+	}
+
+	if rejected == 0 && message == "" {
+		return nil
+	}
+
+	// ExportLogsServiceResponse holds an ExportLogsPartialSuccess in field 1,
+	// which holds rejected_log_records in field 1 and error_message in field 2
+	var partial []byte
+	partial = protowire.AppendTag(partial, 1, protowire.VarintType)
+	partial = protowire.AppendVarint(partial, uint64(rejected))
+	partial = protowire.AppendTag(partial, 2, protowire.BytesType)
+	partial = protowire.AppendString(partial, message)
+
+	var out []byte
+	out = protowire.AppendTag(out, 1, protowire.BytesType)
+	out = protowire.AppendBytes(out, partial)
+
+	return out
+}
+
+// OTLPEntries converts OTLP log records into log entries. An entry is named
+// after the service.name resource attribute, or the instrumentation scope
+// when it is not set, and holds the body of the record as its data. The
+// attributes of the record are kept as they are, the resource attributes
+// under resource.<key> and the other fields of the record under otel.<field>
+func OTLPEntries(logs *logspb.LogsData) []data.LogEntry {
+	var entries []data.LogEntry
+
+	for _, resourceLogs := range logs.GetResourceLogs() {
+		resource := make(map[string]string)
+		flatten(resource, "resource.", resourceLogs.GetResource().GetAttributes())
+
+		for _, scopeLogs := range resourceLogs.GetScopeLogs() {
+			scope := scopeLogs.GetScope()
+
+			name := resource["resource.service.name"]
+			if name == "" {
+				name = scope.GetName()
+			}
+			if name == "" {
+				name = "otlp"
+			}
+
+			for _, record := range scopeLogs.GetLogRecords() {
+				attributes := make(map[string]string, len(resource)+len(record.GetAttributes())+4)
+				for key, value := range resource {
+					attributes[key] = value
+				}
+				flatten(attributes, "", record.GetAttributes())
+
+				if scope.GetName() != "" {
+					attributes["otel.scope.name"] = scope.GetName()
+				}
+				if scope.GetVersion() != "" {
+					attributes["otel.scope.version"] = scope.GetVersion()
+				}
+				if len(record.GetTraceId()) > 0 {
+					attributes["otel.trace_id"] = hex.EncodeToString(record.GetTraceId())
+				}
+				if len(record.GetSpanId()) > 0 {
+					attributes["otel.span_id"] = hex.EncodeToString(record.GetSpanId())
+				}
+				if record.GetSeverityText() != "" {
+					attributes["otel.severity_text"] = record.GetSeverityText()
+				}
+
+				timestamp := record.GetTimeUnixNano()
+				if timestamp == 0 {
+					timestamp = record.GetObservedTimeUnixNano()
+				}
+				if timestamp != 0 {
+					attributes["otel.timestamp"] = time.Unix(0, int64(timestamp)).UTC().Format(time.RFC3339Nano)
+				}
+
+				entries = append(entries, data.LogEntry{
+					Name:       name,
+					Level:      otlpLevel(record),
+					Data:       anyValue(record.GetBody()),
+					Attributes: attributes,
+				})
+			}
+		}
+	}
+
+	return entries
+}
+
+// otlpLevel returns the level of a record from its severity number, or from
+// its severity text when the number is not set
+func otlpLevel(record *logspb.LogRecord) string {
+	number := int(record.GetSeverityNumber())
+	if number >= 1 && number <= 4*len(otlpLevels) {
+		return otlpLevels[(number-1)/4]
+	}
+
+	return strings.ToLower(record.GetSeverityText())
+}
+
+// flatten adds the attributes to into, prefixing their keys with prefix.
+// Nested key-value lists are flattened into dotted keys
+func flatten(into map[string]string, prefix string, attributes []*commonpb.KeyValue) {
+	for _, attribute := range attributes {
+		key := prefix + attribute.GetKey()
+
+		if list := attribute.GetValue().GetKvlistValue(); list != nil {
+			flatten(into, key+".", list.GetValues())
+			continue
+		}
+
+		into[key] = anyValue(attribute.GetValue())
+	}
+}
+
+// anyValue returns the text of an OTLP value. Arrays and key-value lists are
+// written as JSON
+func anyValue(value *commonpb.AnyValue) string {
+	if value == nil {
+		return ""
+	}
+
+	switch v := value.GetValue().(type) {
+	case *commonpb.AnyValue_StringValue:
+		return v.StringValue
+	case *commonpb.AnyValue_BoolValue:
+		return strconv.FormatBool(v.BoolValue)
+	case *commonpb.AnyValue_IntValue:
+		return strconv.FormatInt(v.IntValue, 10)
+	case *commonpb.AnyValue_DoubleValue:
+		return strconv.FormatFloat(v.DoubleValue, 'g', -1, 64)
+	case *commonpb.AnyValue_BytesValue:
+		return base64.StdEncoding.EncodeToString(v.BytesValue)
+	}
+
+	out, _ := json.Marshal(jsonValue(value))
+	return string(out)
+}
+
+// jsonValue converts an OTLP value into the equivalent JSON value
+func jsonValue(value *commonpb.AnyValue) any {
+	switch v := value.GetValue().(type) {
+	case *commonpb.AnyValue_ArrayValue:
+		values := make([]any, 0, len(v.ArrayValue.GetValues()))
+		for _, child := range v.ArrayValue.GetValues() {
+			values = append(values, jsonValue(child))
+		}
+		return values
+	case *commonpb.AnyValue_KvlistValue:
+		values := make(map[string]any, len(v.KvlistValue.GetValues()))
+		for _, child := range v.KvlistValue.GetValues() {
+			values[child.GetKey()] = jsonValue(child.GetValue())
+		}
+		return values
+	case *commonpb.AnyValue_StringValue:
+		return v.StringValue
+	case *commonpb.AnyValue_BoolValue:
+		return v.BoolValue
+	case *commonpb.AnyValue_IntValue:
+		return v.IntValue
+	case *commonpb.AnyValue_DoubleValue:
+		return v.DoubleValue
+	case *commonpb.AnyValue_BytesValue:
+		return v.BytesValue
+	default:
+		return nil
+	}
+}
+
+// hexIDsToBase64 rewrites the trace and span ids of a JSON export. OTLP sends
+// them hex encoded while the protobuf JSON mapping expects base64
+func hexIDsToBase64(body []byte) ([]byte, error) {
+	var document map[string]any
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&document); err != nil {
+		return nil, err
+	}
+
+	for _, resourceLogs := range objects(document["resourceLogs"]) {
+		for _, scopeLogs := range objects(resourceLogs["scopeLogs"]) {
+			for _, record := range objects(scopeLogs["logRecords"]) {
+				for _, field := range []string{"traceId", "spanId"} {
+					id, ok := record[field].(string)
+					if !ok || id == "" {
+						continue
+					}
+
+					raw, err := hex.DecodeString(id)
+					if err != nil {
+						return nil, fmt.Errorf("invalid %s %q", field, id)
+					}
+					record[field] = base64.StdEncoding.EncodeToString(raw)
+				}
+			}
+		}
+	}
+
+	return json.Marshal(document)
+}
+
+// objects returns the JSON objects of a decoded JSON array
+func objects(value any) []map[string]any {
+	array, _ := value.([]any)
+
+	var out []map[string]any
+	for _, element := range array {
+		if object, ok := element.(map[string]any); ok {
+			out = append(out, object)
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,238 @@
+// Package ingest converts the logs of third-party components into log
+// entries. It understands RFC 5424 syslog messages and OTLP log exports
+package ingest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"logger-service/data"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidSyslog is returned for messages that are not RFC 5424 syslog
+var ErrInvalidSyslog = errors.New("invalid syslog message")
+
+// syslogSeverities are the levels of the syslog severities, which are also
+// the level names used by the rest of the logger-service
+var syslogSeverities = []string{
+	"emergency", "alert", "critical", "error", "warning", "notice", "info", "debug",
+}
+
+var syslogFacilities = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+const nilValue = "-"
+
+// ParseSyslog converts an RFC 5424 message into a log entry. The entry is
+// named after the app name of the message and takes its level from the
+// severity. The header fields and the structured data are kept in the
+// attributes, under syslog.<field> and <sd-id>.<param-name>
+func ParseSyslog(message []byte) (*data.LogEntry, error) {
+	p := &syslogParser{in: bytes.TrimRight(message, "\r\n\x00")}
+
+	priority, err := p.priority()
+	if err != nil {
+		return nil, err
+	}
+
+	if version := p.field(); version != "1" {
+		return nil, fmt.Errorf("%w: unsupported version %q", ErrInvalidSyslog, version)
+	}
+
+	timestamp := p.field()
+	hostname := p.field()
+	appName := p.field()
+	procID := p.field()
+	msgID := p.field()
+
+	if p.eof() {
+		return nil, fmt.Errorf("%w: incomplete header", ErrInvalidSyslog)
+	}
+
+	attributes := map[string]string{
+		"syslog.facility": syslogFacilities[priority/8],
+	}
+
+	if timestamp != nilValue {
+		if _, err := time.Parse(time.RFC3339Nano, timestamp); err != nil {
+			return nil, fmt.Errorf("%w: invalid timestamp %q", ErrInvalidSyslog, timestamp)
+		}
+		attributes["syslog.timestamp"] = timestamp
+	}
+
+	for key, value := range map[string]string{
+		"syslog.hostname": hostname,
+		"syslog.procid":   procID,
+		"syslog.msgid":    msgID,
+	} {
+		if value != nilValue {
+			attributes[key] = value
+		}
+	}
+
+	if err = p.structuredData(attributes); err != nil {
+		return nil, err
+	}
+
+	name := appName
+	if name == nilValue {
+		name = "syslog"
+	}
+
+	// the message may start with a BOM to announce UTF-8
+	text := strings.TrimPrefix(string(p.rest()), "\ufeff")
+
+	return &data.LogEntry{
+		Name:       name,
+		Level:      syslogSeverities[priority%8],
+		Data:       text,
+		Attributes: attributes,
+	}, nil
+}
+
+type syslogParser struct {
+	in  []byte
+	pos int
+}
+
+func (p *syslogParser) eof() bool {
+	return p.pos >= len(p.in)
+}
+
+// priority reads the <PRI> at the start of the message
+func (p *syslogParser) priority() (int, error) {
+	end := bytes.IndexByte(p.in, '>')
+	if len(p.in) == 0 || p.in[0] != '<' || end < 2 || end > 4 {
+		return 0, fmt.Errorf("%w: missing priority", ErrInvalidSyslog)
+	}
+
+	priority, err := strconv.Atoi(string(p.in[1:end]))
+	if err != nil || priority < 0 || priority > 191 {
+		return 0, fmt.Errorf("%w: invalid priority", ErrInvalidSyslog)
+	}
+
+	p.pos = end + 1
+
+	return priority, nil
+}
+
+// field reads the header field at the current position and the space
+// following it
+func (p *syslogParser) field() string {
+	start := p.pos
+	for !p.eof() && p.in[p.pos] != ' ' {
+		p.pos++
+	}
+
+	value := string(p.in[start:p.pos])
+	if !p.eof() {
+		p.pos++
+	}
+
+	return value
+}
+
+// structuredData reads the structured data elements into attributes
+func (p *syslogParser) structuredData(attributes map[string]string) error {
+	if p.in[p.pos] == '-' {
+		p.pos++
+		p.skipSpace()
+		return nil
+	}
+
+	for !p.eof() && p.in[p.pos] == '[' {
+		p.pos++
+
+		id := p.name()
+		if id == "" {
+			return fmt.Errorf("%w: structured data without id", ErrInvalidSyslog)
+		}
+
+		for !p.eof() && p.in[p.pos] == ' ' {
+			p.pos++
+
+			param := p.name()
+			if param == "" || p.eof() || p.in[p.pos] != '=' {
+				return fmt.Errorf("%w: invalid parameter in %s", ErrInvalidSyslog, id)
+			}
+			p.pos++
+
+			value, err := p.quoted()
+			if err != nil {
+				return err
+			}
+
+			key := id + "." + param
+			if previous, ok := attributes[key]; ok {
+				// a parameter may be repeated within an element
+				value = previous + ", " + value
+			}
+			attributes[key] = value
+		}
+
+		if p.eof() || p.in[p.pos] != ']' {
+			return fmt.Errorf("%w: unterminated structured data %s", ErrInvalidSyslog, id)
+		}
+		p.pos++
+	}
+
+	p.skipSpace()
+
+	return nil
+}
+
+// name reads an SD-ID or a PARAM-NAME
+func (p *syslogParser) name() string {
+	start := p.pos
+	for !p.eof() && !strings.ContainsRune(" =]\"", rune(p.in[p.pos])) {
+		p.pos++
+	}
+
+	return string(p.in[start:p.pos])
+}
+
+// quoted reads a PARAM-VALUE, in which ", \ and ] are escaped with a backslash
+func (p *syslogParser) quoted() (string, error) {
+	if p.eof() || p.in[p.pos] != '"' {
+		return "", fmt.Errorf("%w: parameter value must be quoted", ErrInvalidSyslog)
+	}
+	p.pos++
+
+	var value strings.Builder
+	for !p.eof() {
+		c := p.in[p.pos]
+		p.pos++
+
+		switch {
+		case c == '"':
+			return value.String(), nil
+		case c == '\\' && !p.eof() && strings.ContainsRune(`"\]`, rune(p.in[p.pos])):
+			value.WriteByte(p.in[p.pos])
+			p.pos++
+		default:
+			value.WriteByte(c)
+		}
+	}
+
+	return "", fmt.Errorf("%w: unterminated parameter value", ErrInvalidSyslog)
+}
+
+func (p *syslogParser) skipSpace() {
+	if !p.eof() && p.in[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+func (p *syslogParser) rest() []byte {
+	if p.eof() {
+		return nil
+	}
+
+	return p.in[p.pos:]
+}
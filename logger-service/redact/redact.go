@@ -0,0 +1,339 @@
+// Package redact removes personal data and secrets from log entries before
+// they are stored. Values are found either by a regular expression or by the
+// name of the field holding them, and are masked or replaced with a keyed
+// hash, which keeps equal values correlatable without revealing them
+package redact
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Mode is the way a matched value is replaced
+type Mode string
+
+const (
+	// Mask replaces the value with a fixed marker naming the rule
+	Mask Mode = "mask"
+	// Hash replaces the value with a keyed hash of it
+	Hash Mode = "hash"
+)
+
+// Rule describes the values to redact. A rule matches either the values
+// found by Pattern anywhere in the text, or the values of the fields listed
+// in Fields, both in JSON documents and in key=value pairs
+type Rule struct {
+	Name    string   `json:"name"`
+	Pattern string   `json:"pattern,omitempty"`
+	Fields  []string `json:"fields,omitempty"`
+	// Luhn only keeps the matches of Pattern that pass the Luhn checksum,
+	// which filters out most numbers that are not card numbers
+	Luhn bool `json:"luhn,omitempty"`
+	// Mode overrides the mode of the redactor for this rule
+	Mode Mode `json:"mode,omitempty"`
+
+	pattern *regexp.Regexp
+	fields  *regexp.Regexp
+	names   map[string]bool
+}
+
+// DefaultRules redact email addresses, JWTs, card numbers and the values of
+// the fields commonly holding secrets
+var DefaultRules = []Rule{
+	{
+		Name:    "email",
+		Pattern: `[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`,
+	},
+	{
+		Name:    "jwt",
+		Pattern: `eyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`,
+	},
+	{
+		Name:    "card",
+		Pattern: `\b(?:\d[ -]?){12,18}\d\b`,
+		Luhn:    true,
+	},
+	{
+		Name: "secret",
+		Fields: []string{
+			"password", "passwd", "secret", "token", "access_token",
+			"refresh_token", "api_key", "apikey", "authorization",
+		},
+	},
+}
+
+// authSchemes are the HTTP authentication schemes preceding the credentials
+// in an authorization value
+const authSchemes = `Bearer|Basic|Digest|Token|Negotiate|NTLM|AWS4-HMAC-SHA256`
+
+// Redactor applies a set of rules
+type Redactor struct {
+	key   []byte
+	rules []Rule
+}
+
+// New compiles the rules. A hash key is required when the mode, or the mode of
+// any rule, is Hash
+func New(mode Mode, hashKey string, rules []Rule) (*Redactor, error) {
+	r := &Redactor{key: []byte(hashKey)}
+
+	for _, rule := range rules {
+		if rule.Name == "" {
+			return nil, errors.New("every redaction rule needs a name")
+		}
+
+		if rule.Pattern == "" && len(rule.Fields) == 0 {
+			return nil, fmt.Errorf("redaction rule %s needs a pattern or fields", rule.Name)
+		}
+
+		if rule.Mode == "" {
+			rule.Mode = mode
+		}
+
+		switch rule.Mode {
+		case Mask:
+		case Hash:
+			if hashKey == "" {
+				return nil, fmt.Errorf("redaction rule %s hashes values but no hash key is set", rule.Name)
+			}
+		default:
+			return nil, fmt.Errorf("redaction rule %s has unknown mode %q", rule.Name, rule.Mode)
+		}
+
+		if rule.Pattern != "" {
+			pattern, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("redaction rule %s: %w", rule.Name, err)
+			}
+			rule.pattern = pattern
+		}
+
+		if len(rule.Fields) > 0 {
+			rule.names = make(map[string]bool)
+
+			quoted := make([]string, 0, len(rule.Fields))
+			for _, field := range rule.Fields {
+				rule.names[strings.ToLower(field)] = true
+				quoted = append(quoted, regexp.QuoteMeta(field))
+			}
+
+			// matches key=value and key: value pairs, the value being quoted
+			// or running until the next separator. The scheme of an
+			// authorization, as in "Bearer xyz", is part of the value
+			rule.fields = regexp.MustCompile(`(?i)\b(` + strings.Join(quoted, "|") + `)("?\s*[=:]\s*)("[^"]*"|(?:` + authSchemes + `)\s+[^\s,;&]+|[^\s,;&]+)`)
+		}
+
+		r.rules = append(r.rules, rule)
+	}
+
+	return r, nil
+}
+
+// FromEnv creates the redactor configured by the environment. REDACTION_MODE
+// is off, mask (default) or hash, REDACTION_HASH_KEY is the key of the hash
+// and REDACTION_RULES_FILE points at a JSON array of rules replacing the
+// default ones. It returns nil when redaction is turned off
+func FromEnv() (*Redactor, error) {
+	mode := Mode(os.Getenv("REDACTION_MODE"))
+	switch mode {
+	case "off":
+		return nil, nil
+	case "":
+		mode = Mask
+	}
+
+	rules := DefaultRules
+	if path := os.Getenv("REDACTION_RULES_FILE"); path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		rules = nil
+		if err = json.Unmarshal(content, &rules); err != nil {
+			return nil, fmt.Errorf("reading %s: %w", path, err)
+		}
+	}
+
+	return New(mode, os.Getenv("REDACTION_HASH_KEY"), rules)
+}
+
+// String redacts a log message. When it is a JSON document the values of the
+// sensitive fields are redacted wherever they are nested, otherwise the text is
+// searched for key=value pairs. A document with nothing to redact is returned
+// as it is, rather than re-encoded
+func (r *Redactor) String(s string) string {
+	trimmed := strings.TrimSpace(s)
+	if strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[") {
+		decoder := json.NewDecoder(strings.NewReader(trimmed))
+		decoder.UseNumber()
+
+		var document any
+		if err := decoder.Decode(&document); err == nil && !decoder.More() {
+			document, changed := r.value(document)
+			if !changed {
+				return s
+			}
+
+			var out bytes.Buffer
+
+			encoder := json.NewEncoder(&out)
+			encoder.SetEscapeHTML(false)
+			if err = encoder.Encode(document); err == nil {
+				return strings.TrimSuffix(out.String(), "\n")
+			}
+		}
+	}
+
+	return r.text(s)
+}
+
+// Attributes redacts the values of a set of attributes in place. Dotted keys
+// are matched against the field rules on their last segment, so that
+// http.request.header.authorization is treated like authorization
+func (r *Redactor) Attributes(attributes map[string]string) {
+	for key, value := range attributes {
+		name := key[strings.LastIndex(key, ".")+1:]
+		if rule := r.fieldRule(name); rule != nil {
+			attributes[key] = r.replace(rule, value)
+			continue
+		}
+		attributes[key] = r.String(value)
+	}
+}
+
+// value redacts a decoded JSON value, and reports whether anything was
+// redacted
+func (r *Redactor) value(v any) (any, bool) {
+	switch v := v.(type) {
+	case map[string]any:
+		changed := false
+		for key, child := range v {
+			if rule := r.fieldRule(key); rule != nil {
+				v[key] = r.replace(rule, scalar(child))
+				changed = true
+				continue
+			}
+
+			var childChanged bool
+			v[key], childChanged = r.value(child)
+			changed = changed || childChanged
+		}
+		return v, changed
+	case []any:
+		changed := false
+		for i, child := range v {
+			var childChanged bool
+			v[i], childChanged = r.value(child)
+			changed = changed || childChanged
+		}
+		return v, changed
+	case string:
+		redacted := r.text(v)
+		return redacted, redacted != v
+	default:
+		return v, false
+	}
+}
+
+// text applies the patterns and the key=value field rules to plain text
+func (r *Redactor) text(s string) string {
+	for i := range r.rules {
+		rule := &r.rules[i]
+
+		if rule.fields != nil {
+			s = rule.fields.ReplaceAllStringFunc(s, func(match string) string {
+				parts := rule.fields.FindStringSubmatch(match)
+
+				value := parts[3]
+				if strings.HasPrefix(value, `"`) {
+					return parts[1] + parts[2] + `"` + r.replace(rule, strings.Trim(value, `"`)) + `"`
+				}
+
+				return parts[1] + parts[2] + r.replace(rule, value)
+			})
+		}
+
+		if rule.pattern != nil {
+			s = rule.pattern.ReplaceAllStringFunc(s, func(match string) string {
+				if rule.Luhn && !luhn(match) {
+					return match
+				}
+				return r.replace(rule, match)
+			})
+		}
+	}
+
+	return s
+}
+
+// fieldRule returns the rule redacting the field with the given name, if any
+func (r *Redactor) fieldRule(name string) *Rule {
+	name = strings.ToLower(name)
+
+	for i := range r.rules {
+		if r.rules[i].names[name] {
+			return &r.rules[i]
+		}
+	}
+
+	return nil
+}
+
+// replace returns the redacted form of a value
+func (r *Redactor) replace(rule *Rule, value string) string {
+	if rule.Mode == Hash {
+		mac := hmac.New(sha256.New, r.key)
+		mac.Write([]byte(value))
+
+		return fmt.Sprintf("[%s:%s]", rule.Name, hex.EncodeToString(mac.Sum(nil))[:16])
+	}
+
+	return fmt.Sprintf("[REDACTED:%s]", rule.Name)
+}
+
+// scalar turns a JSON value into the text that gets hashed
+func scalar(v any) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+
+	out, _ := json.Marshal(v)
+	return string(out)
+}
+
+// luhn reports whether the digits of s pass the Luhn checksum
+func luhn(s string) bool {
+	sum := 0
+	double := false
+	digits := 0
+
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+
+		d := int(c - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+
+		sum += d
+		double = !double
+		digits++
+	}
+
+	return digits >= 13 && sum%10 == 0
+}
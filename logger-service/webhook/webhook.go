@@ -0,0 +1,256 @@
+// Package webhook delivers events to the URLs subscribed to them. Every
+// payload is signed with the secret of the webhook, failed deliveries are
+// retried with an exponential backoff and a webhook whose events keep failing
+// is disabled
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"logger-service/data"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// EventLog is sent for every inserted log entry
+	EventLog = "log"
+	// EventSignIn is sent when a user signs in
+	EventSignIn = "auth.signin"
+
+	// signInLogName is the name of the entries the authentication-service
+	// logs when a user signs in
+	signInLogName = "User Authenticated"
+
+	// MaxAttempts is the number of times delivering an event is attempted
+	MaxAttempts = 5
+	// FailureLimit is the number of events in a row whose delivery may fail
+	// before the webhook is disabled
+	FailureLimit = 10
+
+	// retryBackoff is the wait before the first retry, it doubles with every
+	// following attempt
+	retryBackoff = time.Second * 5
+
+	workers   = 4
+	queueSize = 1000
+)
+
+// Events are the events a webhook can subscribe to
+var Events = []string{EventLog, EventSignIn}
+
+// Event is the payload posted to the webhooks
+type Event struct {
+	ID        string         `json:"id"`
+	Type      string         `json:"type"`
+	CreatedAt time.Time      `json:"created_at"`
+	Data      *data.LogEntry `json:"data"`
+}
+
+// Dispatcher delivers the events of the entries inserted by this process to
+// the webhooks subscribed to them
+type Dispatcher struct {
+	models data.Models
+	client *http.Client
+	jobs   chan *job
+
+	mu    sync.RWMutex
+	hooks map[string]*data.Webhook
+}
+
+// job is one attempt at delivering an event
+type job struct {
+	hookID  string
+	event   string
+	eventID string
+	body    []byte
+	attempt int
+}
+
+// NewDispatcher returns a dispatcher without webhooks and starts its workers
+func NewDispatcher(models data.Models) *Dispatcher {
+	d := &Dispatcher{
+		models: models,
+		client: &http.Client{Timeout: time.Second * 10},
+		jobs:   make(chan *job, queueSize),
+		hooks:  make(map[string]*data.Webhook),
+	}
+
+	for i := 0; i < workers; i++ {
+		go d.work()
+	}
+
+	return d
+}
+
+// SetWebhooks replaces the webhooks events are delivered to
+func (d *Dispatcher) SetWebhooks(hooks []*data.Webhook) {
+	byID := make(map[string]*data.Webhook, len(hooks))
+	for _, hook := range hooks {
+		byID[hook.ID] = hook
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.hooks = byID
+}
+
+// Publish queues the events of an inserted entry for the webhooks subscribed
+// to them. A webhook of a tenant only receives the events of that tenant
+func (d *Dispatcher) Publish(entry *data.LogEntry) {
+	events := []string{EventLog}
+	if entry.Name == signInLogName {
+		events = append(events, EventSignIn)
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	for _, hook := range d.hooks {
+		if hook.Disabled || (hook.Tenant != "" && hook.Tenant != entry.Tenant) || !hook.Match.Matches(entry) {
+			continue
+		}
+
+		for _, event := range events {
+			if !slices.Contains(hook.Events, event) {
+				continue
+			}
+
+			payload := Event{
+				ID:        primitive.NewObjectID().Hex(),
+				Type:      event,
+				CreatedAt: time.Now().UTC(),
+				Data:      entry,
+			}
+
+			body, err := json.Marshal(payload)
+			if err != nil {
+				log.Println("Error encoding webhook event:", err)
+				continue
+			}
+
+			d.enqueue(&job{hookID: hook.ID, event: event, eventID: payload.ID, body: body, attempt: 1})
+		}
+	}
+}
+
+// Sign returns the signature sent in the X-Webhook-Signature header. Receivers
+// recompute it with their secret over the timestamp and the raw body
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+
+	return fmt.Sprintf("t=%d,v1=%s", timestamp, hex.EncodeToString(mac.Sum(nil)))
+}
+
+func (d *Dispatcher) enqueue(j *job) {
+	select {
+	case d.jobs <- j:
+	default:
+		log.Printf("Webhook queue full, dropping %s event %s\n", j.event, j.eventID)
+	}
+}
+
+func (d *Dispatcher) work() {
+	for j := range d.jobs {
+		d.deliver(j)
+	}
+}
+
+// deliver attempts to deliver an event once, and schedules the next attempt
+// when it fails
+func (d *Dispatcher) deliver(j *job) {
+	d.mu.RLock()
+	hook := d.hooks[j.hookID]
+	d.mu.RUnlock()
+
+	// the webhook was deleted or disabled since the event was queued
+	if hook == nil || hook.Disabled {
+		return
+	}
+
+	delivery := data.WebhookDelivery{
+		WebhookID: hook.ID,
+		EventID:   j.eventID,
+		Event:     j.event,
+		Attempt:   j.attempt,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	status, err := d.post(hook, j)
+	delivery.Duration = time.Since(delivery.CreatedAt).Milliseconds()
+	delivery.StatusCode = status
+	delivery.Success = err == nil
+	if err != nil {
+		delivery.Error = err.Error()
+	}
+
+	if err := d.models.Webhook.AddDelivery(delivery); err != nil {
+		log.Println("Error recording webhook delivery:", err)
+	}
+
+	if !delivery.Success && j.attempt < MaxAttempts {
+		backoff := retryBackoff << (j.attempt - 1)
+		next := *j
+		next.attempt++
+
+		time.AfterFunc(backoff, func() { d.enqueue(&next) })
+		return
+	}
+
+	updated, err := d.models.Webhook.RecordResult(hook.ID, delivery.Success, FailureLimit)
+	if err != nil {
+		log.Println("Error recording webhook result:", err)
+		return
+	}
+
+	if updated.Disabled {
+		log.Printf("Disabled webhook %s after %d failed events\n", updated.ID, updated.Failures)
+	}
+
+	d.mu.Lock()
+	if _, ok := d.hooks[updated.ID]; ok {
+		d.hooks[updated.ID] = updated
+	}
+	d.mu.Unlock()
+}
+
+// post sends the event and returns the status code of the response, it fails
+// unless the status is 2xx
+func (d *Dispatcher) post(hook *data.Webhook, j *job) (int, error) {
+	request, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(j.body))
+	if err != nil {
+		return 0, err
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "logger-service-webhooks")
+	request.Header.Set("X-Webhook-ID", j.eventID)
+	request.Header.Set("X-Webhook-Event", j.event)
+	request.Header.Set("X-Webhook-Attempt", strconv.Itoa(j.attempt))
+	request.Header.Set("X-Webhook-Signature", Sign(hook.Secret, time.Now().Unix(), j.body))
+
+	response, err := d.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("unexpected status %s", response.Status)
+	}
+
+	return response.StatusCode, nil
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mail-service/data"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// defaultAttachmentsDir is where the attachments wait for their message
+	// to be sent when ATTACHMENTS_DIR is not set
+	defaultAttachmentsDir = "/var/lib/mail/attachments"
+
+	// defaultMaxAttachmentSize is the total size of the attachments of a
+	// message, in bytes, when MAX_ATTACHMENT_SIZE is not set
+	defaultMaxAttachmentSize = 10 << 20
+
+	// defaultAttachmentTypes are the MIME types allowed when
+	// ATTACHMENT_TYPES is not set
+	defaultAttachmentTypes = "image/*,text/*,application/pdf,application/zip,application/json"
+
+	// multipartMemory is how much of a multipart upload is kept in memory,
+	// the rest is buffered in temporary files
+	multipartMemory = 1 << 20
+)
+
+// attachmentPart is an attachment uploaded with a message, before it is
+// stored
+type attachmentPart struct {
+	Name        string
+	ContentType string
+	Inline      bool
+	Data        []byte
+}
+
+// Attachments stores the attachments of the queued messages in files, until
+// their message has been sent or has failed for good. With the postgres
+// outbox, the replicas must share the directory
+type Attachments struct {
+	dir     string
+	maxSize int64
+	types   []string
+}
+
+// createAttachments reads the directory of the attachments from
+// ATTACHMENTS_DIR, the total size of the attachments of a message from
+// MAX_ATTACHMENT_SIZE and the allowed MIME types from ATTACHMENT_TYPES, a comma
+// separated list in which image/* allows every image type
+func createAttachments() *Attachments {
+	dir := os.Getenv("ATTACHMENTS_DIR")
+	if dir == "" {
+		dir = defaultAttachmentsDir
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		log.Panic(err)
+	}
+
+	types := os.Getenv("ATTACHMENT_TYPES")
+	if types == "" {
+		types = defaultAttachmentTypes
+	}
+
+	a := &Attachments{
+		dir:     dir,
+		maxSize: int64(envInt("MAX_ATTACHMENT_SIZE", defaultMaxAttachmentSize)),
+	}
+
+	for _, t := range strings.Split(types, ",") {
+		if t = strings.TrimSpace(strings.ToLower(t)); t != "" {
+			a.types = append(a.types, t)
+		}
+	}
+
+	return a
+}
+
+// maxRequestSize is the size of a send request carrying attachments of the
+// maximum size, base64 encoded, with room for the rest of the message
+func (a *Attachments) maxRequestSize() int {
+	return int(base64.StdEncoding.EncodedLen(int(a.maxSize))) + multipartMemory
+}
+
+// decode decodes the base64 attachments of a JSON send request
+func (a *Attachments) decode(attachments []jsonAttachment) ([]attachmentPart, error) {
+	var parts []attachmentPart
+	for _, attachment := range attachments {
+		content, err := base64.StdEncoding.DecodeString(attachment.Content)
+		if err != nil {
+			return nil, fmt.Errorf("attachment %q is not valid base64: %v", attachment.Name, err)
+		}
+
+		parts = append(parts, attachmentPart{
+			Name:        attachment.Name,
+			ContentType: attachment.ContentType,
+			Inline:      attachment.Inline,
+			Data:        content,
+		})
+	}
+
+	return parts, nil
+}
+
+// readMultipart reads the files of a multipart/form-data send request, from
+// the attachments and inline fields
+func (a *Attachments) readMultipart(form *multipart.Form) ([]attachmentPart, error) {
+	fields := []struct {
+		name   string
+		inline bool
+	}{
+		{"attachments", false},
+		{"inline", true},
+	}
+
+	var parts []attachmentPart
+	for _, field := range fields {
+		for _, header := range form.File[field.name] {
+			content, err := readFormFile(header)
+			if err != nil {
+				return nil, err
+			}
+
+			parts = append(parts, attachmentPart{
+				Name:        header.Filename,
+				ContentType: header.Header.Get("Content-Type"),
+				Inline:      field.inline,
+				Data:        content,
+			})
+		}
+	}
+
+	return parts, nil
+}
+
+// validate checks the names, sizes and MIME types of the attachments of a
+// message, and sets the MIME types left out from the file names or the
+// contents
+func (a *Attachments) validate(parts []attachmentPart) error {
+	var size int64
+	names := make(map[string]bool)
+
+	for i := range parts {
+		part := &parts[i]
+
+		part.Name = filepath.Base(path.Clean("/" + strings.ReplaceAll(part.Name, `\`, "/")))
+		if part.Name == "/" || part.Name == "." {
+			return errors.New("attachments must have a name")
+		}
+
+		// inline images are referenced by name, as cid:<name>
+		if names[part.Name] {
+			return fmt.Errorf("attachment %q is given twice", part.Name)
+		}
+		names[part.Name] = true
+
+		size += int64(len(part.Data))
+		if size > a.maxSize {
+			return fmt.Errorf("attachments are too large, at most %d bytes are allowed", a.maxSize)
+		}
+
+		if part.ContentType == "" || part.ContentType == "application/octet-stream" {
+			part.ContentType = mime.TypeByExtension(filepath.Ext(part.Name))
+		}
+		if part.ContentType == "" {
+			part.ContentType = http.DetectContentType(part.Data)
+		}
+
+		mediaType, _, err := mime.ParseMediaType(part.ContentType)
+		if err != nil {
+			return fmt.Errorf("attachment %q has an invalid type %q", part.Name, part.ContentType)
+		}
+		if !a.allowed(mediaType) {
+			return fmt.Errorf("attachment %q has a type that is not allowed: %s", part.Name, mediaType)
+		}
+	}
+
+	return nil
+}
+
+// allowed reports whether a MIME type is in the allowed types
+func (a *Attachments) allowed(mediaType string) bool {
+	for _, t := range a.types {
+		if t == mediaType || t == "*/*" {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(t, "/*"); ok && strings.HasPrefix(mediaType, prefix+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// store writes the attachments of a message to files
+func (a *Attachments) store(parts []attachmentPart) ([]data.Attachment, error) {
+	var attachments []data.Attachment
+	for _, part := range parts {
+		file, err := os.CreateTemp(a.dir, "attachment-*")
+		if err != nil {
+			a.remove(attachments)
+			return nil, err
+		}
+
+		_, err = file.Write(part.Data)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			_ = os.Remove(file.Name())
+			a.remove(attachments)
+			return nil, err
+		}
+
+		attachments = append(attachments, data.Attachment{
+			Name:        part.Name,
+			ContentType: part.ContentType,
+			Size:        int64(len(part.Data)),
+			Inline:      part.Inline,
+			Path:        file.Name(),
+		})
+	}
+
+	return attachments, nil
+}
+
+// remove deletes the files of the attachments of a message
+func (a *Attachments) remove(attachments []data.Attachment) {
+	for _, attachment := range attachments {
+		if err := os.Remove(attachment.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Println("Error removing attachment:", err)
+		}
+	}
+}
+
+func readFormFile(header *multipart.FileHeader) ([]byte, error) {
+	file, err := header.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return io.ReadAll(file)
+}
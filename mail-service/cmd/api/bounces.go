@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mail-service/data"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// maxReportSize is the size of a DSN or a complaint, which may quote the
+// whole message with its attachments
+const maxReportSize = 32 << 20
+
+// report is what a DSN or a complaint says about a recipient of a message
+type report struct {
+	Address string `json:"address"`
+	// MessageID is the id of the message in the outbox, from the
+	// X-Outbox-Id header quoted by the report. It is empty when the report
+	// does not quote the headers of the message
+	MessageID string `json:"message_id,omitempty"`
+	// Action is the action of a DSN, failed, delayed, delivered, relayed or
+	// expanded, or complaint for a complaint
+	Action string `json:"action"`
+	// Status is the status code of a DSN, such as 5.1.1
+	Status     string `json:"status,omitempty"`
+	Diagnostic string `json:"diagnostic,omitempty"`
+	// Suppressed tells whether the address has been added to the
+	// suppression list
+	Suppressed bool `json:"suppressed"`
+}
+
+// complaintAction is the action of the reports made from a complaint
+const complaintAction = "complaint"
+
+// parseReport parses a DSN, a multipart/report message with a
+// message/delivery-status part as in RFC 3464, or a complaint, a
+// multipart/report message with a message/feedback-report part as in
+// RFC 5965. It returns a report per recipient
+func parseReport(r io.Reader) ([]report, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/report" || params["boundary"] == "" {
+		return nil, errors.New("not a delivery status notification or a complaint, which are multipart/report messages")
+	}
+
+	var (
+		reports  []report
+		original textproto.MIMEHeader
+		found    bool
+	)
+
+	parts := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := parts.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var body io.Reader = part
+		if strings.EqualFold(part.Header.Get("Content-Transfer-Encoding"), "base64") {
+			body = base64.NewDecoder(base64.StdEncoding, part)
+		}
+
+		partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		switch partType {
+		case "message/delivery-status", "message/global-delivery-status":
+			found = true
+			if reports, err = parseDeliveryStatus(body); err != nil {
+				return nil, err
+			}
+
+		case "message/feedback-report":
+			found = true
+			fields, err := readFieldGroups(body)
+			if err != nil {
+				return nil, err
+			}
+			if len(fields) > 0 {
+				reports = complaintReports(fields[0])
+			}
+
+		case "message/rfc822", "text/rfc822-headers", "message/global", "message/global-headers":
+			// only the headers of the message are needed
+			original, err = textproto.NewReader(bufio.NewReader(body)).ReadMIMEHeader()
+			if err != nil && !errors.Is(err, io.EOF) {
+				original = nil
+			}
+		}
+	}
+
+	if !found {
+		return nil, errors.New("the report has no delivery status nor feedback report")
+	}
+
+	for i := range reports {
+		if original != nil {
+			reports[i].MessageID = strings.TrimSpace(original.Get(outboxIDHeader))
+		}
+
+		// a complaint may leave the recipient out of the report, the message
+		// itself still tells who received it
+		if reports[i].Address == "" && original != nil {
+			if to, err := mail.ParseAddressList(original.Get("To")); err == nil && len(to) == 1 {
+				reports[i].Address = data.NormalizeAddress(to[0].Address)
+			}
+		}
+	}
+
+	// the reports without an address cannot be acted upon
+	valid := reports[:0]
+	for _, r := range reports {
+		if r.Address != "" {
+			valid = append(valid, r)
+		}
+	}
+
+	return valid, nil
+}
+
+// parseDeliveryStatus parses the per-recipient fields of a delivery status,
+// which follow the per-message fields
+func parseDeliveryStatus(r io.Reader) ([]report, error) {
+	groups, err := readFieldGroups(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var reports []report
+	for _, fields := range groups {
+		// the per-message fields have no recipient
+		address := typedValue(fields.Get("Original-Recipient"))
+		if address == "" {
+			address = typedValue(fields.Get("Final-Recipient"))
+		}
+		if address == "" {
+			continue
+		}
+
+		status, _, _ := strings.Cut(strings.TrimSpace(fields.Get("Status")), " ")
+
+		reports = append(reports, report{
+			Address:    data.NormalizeAddress(address),
+			Action:     strings.ToLower(strings.TrimSpace(fields.Get("Action"))),
+			Status:     status,
+			Diagnostic: typedValue(fields.Get("Diagnostic-Code")),
+		})
+	}
+
+	return reports, nil
+}
+
+// complaintReports returns the reports of the recipients of a feedback
+// report, or a report without an address when the report leaves them out
+func complaintReports(fields textproto.MIMEHeader) []report {
+	// a message marked as not being spam is no complaint
+	feedbackType := strings.ToLower(strings.TrimSpace(fields.Get("Feedback-Type")))
+	if feedbackType == "not-spam" {
+		return nil
+	}
+
+	complaint := report{Action: complaintAction}
+	if feedbackType != "" {
+		complaint.Diagnostic = "feedback type " + feedbackType
+	}
+
+	var reports []report
+	for _, address := range fields.Values("Original-Rcpt-To") {
+		complaint.Address = data.NormalizeAddress(strings.Trim(address, "<> "))
+		reports = append(reports, complaint)
+	}
+
+	if len(reports) == 0 {
+		reports = append(reports, complaint)
+	}
+
+	return reports
+}
+
+// readFieldGroups reads the groups of header fields separated by blank
+// lines of a delivery status or a feedback report
+func readFieldGroups(r io.Reader) ([]textproto.MIMEHeader, error) {
+	reader := textproto.NewReader(bufio.NewReader(r))
+
+	var groups []textproto.MIMEHeader
+	for {
+		fields, err := reader.ReadMIMEHeader()
+		if len(fields) > 0 {
+			groups = append(groups, fields)
+		}
+
+		if errors.Is(err, io.EOF) {
+			return groups, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid report: %w", err)
+		}
+	}
+}
+
+// typedValue returns the value of a field typed as in "rfc822; jane@example.com"
+func typedValue(field string) string {
+	if _, value, ok := strings.Cut(field, ";"); ok {
+		return strings.TrimSpace(value)
+	}
+
+	return strings.TrimSpace(field)
+}
+
+// hardBounce reports whether a DSN says that the message will never be
+// delivered to the address, as opposed to a temporary failure
+func (r *report) hardBounce() bool {
+	return r.Action == "failed" && strings.HasPrefix(r.Status, "5")
+}
+
+// recipient returns the status of the recipient the report records on its
+// message
+func (r *report) recipient() data.Recipient {
+	recipient := data.Recipient{Address: r.Address, Reason: r.Diagnostic}
+	if recipient.Reason == "" {
+		recipient.Reason = r.Status
+	}
+
+	switch r.Action {
+	case "failed":
+		recipient.Status = data.RecipientBounced
+	case "delayed":
+		recipient.Status = data.RecipientDelayed
+	case complaintAction:
+		recipient.Status = data.RecipientComplained
+	default:
+		recipient.Status = data.RecipientDelivered
+	}
+
+	return recipient
+}
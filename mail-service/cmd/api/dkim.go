@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/toorop/go-dkim"
+	mail "github.com/xhit/go-simple-mail/v2"
+)
+
+// dkimHeaders are the headers covered by the signatures
+var dkimHeaders = []string{"from", "to", "cc", "reply-to", "subject", "date", "message-id", "mime-version", "content-type"}
+
+// dkimKey is a selector of the domain and its private key
+type dkimKey struct {
+	selector   string
+	privateKey []byte
+}
+
+// dkimSigner signs the outgoing emails for a domain. While rotating keys,
+// the emails are signed with both the current and the next selector, so that
+// they verify whichever of the DNS records the receivers see
+type dkimSigner struct {
+	domain string
+	keys   []dkimKey
+}
+
+// createDKIMSigner reads the selector from DKIM_SELECTOR and its PEM private
+// key from DKIM_PRIVATE_KEY, or from the file at DKIM_PRIVATE_KEY_FILE. While
+// rotating keys, DKIM_NEXT_SELECTOR and DKIM_NEXT_PRIVATE_KEY or
+// DKIM_NEXT_PRIVATE_KEY_FILE add a second signature. It returns nil, not
+// signing anything, when DKIM_SELECTOR is not set
+func createDKIMSigner(domain string) *dkimSigner {
+	if os.Getenv("DKIM_SELECTOR") == "" {
+		return nil
+	}
+
+	if domain == "" {
+		log.Panic("MAIL_DOMAIN must be set to sign with DKIM")
+	}
+
+	signer := &dkimSigner{domain: domain}
+
+	for _, prefix := range []string{"DKIM_", "DKIM_NEXT_"} {
+		selector := os.Getenv(prefix + "SELECTOR")
+		if selector == "" {
+			continue
+		}
+
+		key, err := readDKIMKey(prefix)
+		if err != nil {
+			log.Panicf("Error reading the DKIM key of selector %s: %v", selector, err)
+		}
+
+		signer.keys = append(signer.keys, dkimKey{selector: selector, privateKey: key})
+		log.Printf("Signing mail with DKIM selector %s._domainkey.%s\n", selector, domain)
+	}
+
+	return signer
+}
+
+// readDKIMKey reads the private key given by the <prefix>PRIVATE_KEY or
+// <prefix>PRIVATE_KEY_FILE environment variables, and checks that it is an
+// RSA key
+func readDKIMKey(prefix string) ([]byte, error) {
+	key := []byte(os.Getenv(prefix + "PRIVATE_KEY"))
+
+	if len(key) == 0 {
+		path := os.Getenv(prefix + "PRIVATE_KEY_FILE")
+		if path == "" {
+			return nil, fmt.Errorf("%sPRIVATE_KEY or %sPRIVATE_KEY_FILE must be set", prefix, prefix)
+		}
+
+		var err error
+		if key, err = os.ReadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	block, _ := pem.Decode(key)
+	if block == nil {
+		return nil, errors.New("the key is not PEM encoded")
+	}
+
+	if _, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := parsed.(*rsa.PrivateKey); !ok {
+		return nil, errors.New("the key is not an RSA key")
+	}
+
+	return key, nil
+}
+
+// sign signs a MIME message with every selector. The signed message is the
+// one sent, as returned by rawMessage
+func (s *dkimSigner) sign(email *mail.Email) error {
+	if s == nil || email.Error != nil {
+		return nil
+	}
+
+	raw := []byte(rawMessage(email))
+
+	for _, key := range s.keys {
+		options := dkim.NewSigOptions()
+		options.Domain = s.domain
+		options.Selector = key.selector
+		options.PrivateKey = key.privateKey
+		options.Canonicalization = "relaxed/relaxed"
+		options.Headers = append([]string(nil), dkimHeaders...)
+
+		if err := dkim.Sign(&raw, options); err != nil {
+			return fmt.Errorf("signing with DKIM selector %s: %w", key.selector, err)
+		}
+	}
+
+	email.DkimMsg = string(raw)
+
+	return nil
+}
+
+// rawMessage returns the message sent for a MIME email, signed when it has
+// been signed
+func rawMessage(email *mail.Email) string {
+	if email.DkimMsg != "" {
+		return email.DkimMsg
+	}
+
+	return email.GetMessage()
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/toorop/go-dkim"
+)
+
+// dkimKeys generates the keys of the current and the next selector, the
+// current one PKCS #1 encoded in DKIM_PRIVATE_KEY and the next one PKCS #8
+// encoded in DKIM_NEXT_PRIVATE_KEY_FILE. It returns the DNS records of the
+// selectors
+func dkimKeys(t *testing.T) map[string]string {
+	t.Helper()
+
+	records := make(map[string]string)
+	for _, selector := range []string{"current", "next"} {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		public, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records[selector+"._domainkey.example.com"] = "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(public)
+
+		if selector == "current" {
+			t.Setenv("DKIM_SELECTOR", selector)
+			t.Setenv("DKIM_PRIVATE_KEY", string(pem.EncodeToMemory(&pem.Block{
+				Type:  "RSA PRIVATE KEY",
+				Bytes: x509.MarshalPKCS1PrivateKey(key),
+			})))
+			continue
+		}
+
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(t.TempDir(), "next.pem")
+		if err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		t.Setenv("DKIM_NEXT_SELECTOR", selector)
+		t.Setenv("DKIM_NEXT_PRIVATE_KEY_FILE", path)
+	}
+
+	return records
+}
+
+// verifyDKIM verifies the first DKIM signature of a message against the DNS
+// records
+func verifyDKIM(t *testing.T, message string, records map[string]string) {
+	t.Helper()
+
+	raw := []byte(message)
+	status, err := dkim.Verify(&raw, dkim.DNSOptLookupTXT(func(name string) ([]string, error) {
+		return []string{records[name]}, nil
+	}))
+	if err != nil || status != dkim.SUCCESS {
+		t.Errorf("verifying the signature: status %d, %v", status, err)
+	}
+}
+
+func TestDKIMSignature(t *testing.T) {
+	records := dkimKeys(t)
+
+	signer := createDKIMSigner("example.com")
+	if len(signer.keys) != 2 {
+		t.Fatalf("got %d DKIM keys, want 2", len(signer.keys))
+	}
+
+	email := testEmail()
+	email.ReplyTo = []string{"support@example.com", "help@example.com"}
+	email.dkim = signer
+
+	message := email.mime()
+	if message.Error != nil {
+		t.Fatal(message.Error)
+	}
+	if message.DkimMsg == "" {
+		t.Fatal("the message is not signed")
+	}
+
+	signatures := strings.Count(message.DkimMsg, "DKIM-Signature:")
+	if signatures != 2 {
+		t.Fatalf("got %d signatures, want 2", signatures)
+	}
+	verifyDKIM(t, message.DkimMsg, records)
+
+	// go-dkim verifies the first signature only, which is the one of the
+	// next selector as it signs last. The signature of the current selector
+	// is checked without the other one
+	second := strings.Index(message.DkimMsg[1:], "DKIM-Signature:") + 1
+	if !strings.Contains(message.DkimMsg[second:], "s=current;") {
+		t.Fatalf("the second signature is not the one of the current selector")
+	}
+	verifyDKIM(t, message.DkimMsg[second:], records)
+
+	// what goes over SMTP is exactly what was signed
+	smtp := newFakeSMTP(t)
+	if err := smtp.sender().pool.send(message); err != nil {
+		t.Fatal(err)
+	}
+
+	sent := smtp.sent()
+	if len(sent) != 1 {
+		t.Fatalf("got %d messages over SMTP, want 1", len(sent))
+	}
+	if !strings.Contains(sent[0], "Reply-To: <support@example.com>,\r\n <help@example.com>\r\n") {
+		t.Errorf("the message sent lacks the Reply-To addresses:\n%q", sent[0])
+	}
+	if sent[0] != message.DkimMsg {
+		t.Errorf("the message sent differs from the signed message:\n%q\n%q", sent[0], message.DkimMsg)
+	}
+	verifyDKIM(t, sent[0], records)
+}
+
+func TestDKIMDisabled(t *testing.T) {
+	t.Setenv("DKIM_SELECTOR", "")
+
+	if signer := createDKIMSigner("example.com"); signer != nil {
+		t.Fatalf("got a signer without DKIM_SELECTOR")
+	}
+
+	message := testEmail().mime()
+	if message.Error != nil || message.DkimMsg != "" {
+		t.Errorf("got a signed message without a signer: %v", message.Error)
+	}
+}
@@ -1,44 +1,499 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"mail-service/data"
+	"mime"
 	"net/http"
+	"net/mail"
+	"slices"
+	"time"
 	"tools"
+
+	"github.com/go-chi/chi/v5"
 )
 
+// sendRequest is the message given to SendMail
+type sendRequest struct {
+	From        string           `json:"from"`
+	To          data.Addresses   `json:"to"`
+	Cc          data.Addresses   `json:"cc"`
+	Bcc         data.Addresses   `json:"bcc"`
+	ReplyTo     data.Addresses   `json:"reply_to"`
+	Individual  bool             `json:"individual"`
+	Subject     string           `json:"subject"`
+	Message     string           `json:"message"`
+	Template    string           `json:"template"`
+	Data        map[string]any   `json:"data"`
+	Attachments []jsonAttachment `json:"attachments"`
+	SendAt      *time.Time       `json:"send_at"`
+	Cron        string           `json:"cron"`
+	Timezone    string           `json:"timezone"`
+}
+
+// jsonAttachment is an attachment of a JSON send request, with its content
+// base64 encoded
+type jsonAttachment struct {
+	Name        string `json:"name"`
+	ContentType string `json:"content_type"`
+	Inline      bool   `json:"inline"`
+	Content     string `json:"content"`
+}
+
+// SendMail queues a message in the outbox and returns its id right away. The
+// message is sent by the workers, its delivery can be followed with
+// GetMessage. It is rendered with the named template and data, or with the
+// default template when no template is given. With individual set, every to
+// address gets a message of its own rather than one message to all of them.
+// A message is sent later when given send_at, and again and again when given
+// a cron expression, until canceled with CancelMessage. The message is
+// either JSON, with base64 attachments, or multipart/form-data
+// with the JSON in the payload field and the files in the attachments and
+// inline fields
 func (app *Config) SendMail(w http.ResponseWriter, r *http.Request) {
-	type mailMessage struct {
-		From    string `json:"from"`
-		To      string `json:"to"`
-		Subject string `json:"subject"`
-		Message string `json:"message"`
+	requestPayload, parts, err := app.readSendRequest(w, r)
+	if err != nil {
+		_ = app.ErrorJSON(w, err)
+		return
 	}
 
-	var requestPayload mailMessage
+	if requestPayload.From != "" {
+		from, err := mail.ParseAddress(requestPayload.From)
+		if err != nil {
+			_ = app.ErrorJSON(w, fmt.Errorf("invalid from address %q: %v", requestPayload.From, err))
+			return
+		}
+		requestPayload.From = formatAddress(from)
+	}
 
-	err := app.ReadJSON(w, r, &requestPayload)
+	addresses, err := parseRecipients(requestPayload.To, requestPayload.Cc, requestPayload.Bcc, requestPayload.ReplyTo, app.MaxRecipients)
 	if err != nil {
 		_ = app.ErrorJSON(w, err)
 		return
 	}
 
-	msg := Message{
-		From:    requestPayload.From,
-		To:      requestPayload.To,
-		Subject: requestPayload.Subject,
-		Data:    requestPayload.Message,
+	// copying the cc and bcc addresses to every individual message would send
+	// them the same email many times
+	if requestPayload.Individual && (len(addresses.Cc) > 0 || len(addresses.Bcc) > 0) {
+		_ = app.ErrorJSON(w, errors.New("cc and bcc cannot be used with individual messages"))
+		return
 	}
 
-	err = app.Mailer.SendSMTPMessage(msg)
+	// render the message once, so that a missing template or variable is
+	// reported to the caller rather than failing every attempt
+	_, err = app.Mailer.buildMessage(Message{
+		Template: requestPayload.Template,
+		Data:     requestPayload.Message,
+		DataMap:  requestPayload.Data,
+	})
 	if err != nil {
 		_ = app.ErrorJSON(w, err)
 		return
 	}
 
+	sendAt, timezone, err := schedule(requestPayload.SendAt, requestPayload.Cron, requestPayload.Timezone)
+	if err != nil {
+		_ = app.ErrorJSON(w, err)
+		return
+	}
+
+	msg := data.Message{
+		From:     requestPayload.From,
+		To:       addresses.To,
+		Cc:       addresses.Cc,
+		Bcc:      addresses.Bcc,
+		ReplyTo:  addresses.ReplyTo,
+		Subject:  requestPayload.Subject,
+		Body:     requestPayload.Message,
+		Template: requestPayload.Template,
+		Data:     requestPayload.Data,
+		SendAt:   sendAt,
+		Cron:     requestPayload.Cron,
+		Timezone: timezone,
+	}
+
+	if !requestPayload.Individual {
+		queued, err := app.enqueue(msg, parts)
+		if err != nil {
+			_ = app.ErrorJSON(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		app.Outbox.Notify()
+
+		message := fmt.Sprintf("Email to %s queued", queued.To)
+		if queued.SendAt != nil {
+			message = fmt.Sprintf("Email to %s scheduled for %s", queued.To, queued.NextAttemptAt.Format(time.RFC3339))
+		}
+
+		responsePayload := tools.JsonResponse{
+			Error:   false,
+			Message: message,
+			Data:    queued,
+		}
+
+		_ = app.WriteJSON(w, http.StatusAccepted, responsePayload)
+		return
+	}
+
+	var queued []*data.Message
+	for _, to := range addresses.To {
+		msg.To = data.Addresses{to}
+
+		// every message gets its own copy of the attachments, removed once it
+		// has been sent
+		individual, err := app.enqueue(msg, parts)
+		if err != nil {
+			// the messages queued so far are sent anyway
+			app.Outbox.Notify()
+			_ = app.ErrorJSON(w, fmt.Errorf("queueing email to %s: %w", to, err), http.StatusInternalServerError)
+			return
+		}
+
+		queued = append(queued, individual)
+	}
+
+	app.Outbox.Notify()
+
 	responsePayload := tools.JsonResponse{
 		Error:   false,
-		Message: fmt.Sprintf("Email send to %s successfully!", requestPayload.To),
+		Message: fmt.Sprintf("%d emails queued", len(queued)),
+		Data:    queued,
 	}
 
 	_ = app.WriteJSON(w, http.StatusAccepted, responsePayload)
 }
+
+// CancelMessage cancels a message that has not been sent yet, or the next
+// occurrences of a recurring message. A message being sent cannot be
+// canceled
+func (app *Config) CancelMessage(w http.ResponseWriter, r *http.Request) {
+	msg, err := app.Models.Message.Cancel(chi.URLParam(r, "id"))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNotFound):
+			_ = app.ErrorJSON(w, errors.New("message not found"), http.StatusNotFound)
+		case errors.Is(err, data.ErrNotCancelable):
+			_ = app.ErrorJSON(w, err, http.StatusConflict)
+		default:
+			_ = app.ErrorJSON(w, err, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	app.Attachments.remove(msg.Attachments)
+
+	responsePayload := tools.JsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Email to %s canceled", msg.To),
+		Data:    msg,
+	}
+
+	_ = app.WriteJSON(w, http.StatusOK, responsePayload)
+}
+
+// readSendRequest reads a JSON or multipart/form-data send request, and
+// returns it with its attachments, validated
+func (app *Config) readSendRequest(w http.ResponseWriter, r *http.Request) (*sendRequest, []attachmentPart, error) {
+	var requestPayload sendRequest
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		if err := app.ReadJSON(w, r, &requestPayload); err != nil {
+			return nil, nil, err
+		}
+
+		parts, err := app.Attachments.decode(requestPayload.Attachments)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return &requestPayload, parts, app.Attachments.validate(parts)
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, int64(app.Attachments.maxRequestSize()))
+
+	if err := r.ParseMultipartForm(multipartMemory); err != nil {
+		return nil, nil, err
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	payload := r.FormValue("payload")
+	if payload == "" {
+		return nil, nil, errors.New("payload is required")
+	}
+
+	if err := json.Unmarshal([]byte(payload), &requestPayload); err != nil {
+		return nil, nil, fmt.Errorf("invalid payload: %w", err)
+	}
+
+	parts, err := app.Attachments.decode(requestPayload.Attachments)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	uploaded, err := app.Attachments.readMultipart(r.MultipartForm)
+	if err != nil {
+		return nil, nil, err
+	}
+	parts = append(parts, uploaded...)
+
+	return &requestPayload, parts, app.Attachments.validate(parts)
+}
+
+// enqueue stores the attachments of a message and queues it
+func (app *Config) enqueue(msg data.Message, parts []attachmentPart) (*data.Message, error) {
+	attachments, err := app.Attachments.store(parts)
+	if err != nil {
+		return nil, err
+	}
+	msg.Attachments = attachments
+
+	queued, err := app.Models.Message.Enqueue(msg)
+	if err != nil {
+		app.Attachments.remove(attachments)
+		return nil, err
+	}
+
+	return queued, nil
+}
+
+// GetMessage returns a message of the outbox with the state of its delivery,
+// including the error of the last failed attempt and the status of every
+// recipient, telling why a suppressed, failed or bounced address was not
+// sent to
+func (app *Config) GetMessage(w http.ResponseWriter, r *http.Request) {
+	msg, err := app.Models.Message.GetOne(chi.URLParam(r, "id"))
+	if err != nil {
+		if errors.Is(err, data.ErrNotFound) {
+			_ = app.ErrorJSON(w, errors.New("message not found"), http.StatusNotFound)
+			return
+		}
+
+		_ = app.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	responsePayload := tools.JsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Email to %s is %s", msg.To, msg.Status),
+		Data:    msg,
+	}
+
+	_ = app.WriteJSON(w, http.StatusOK, responsePayload)
+}
+
+// ProcessReport processes a DSN or a complaint, posted as the raw report
+// message, which a mail server or a provider sends back for a message. The
+// hard bounces and the complaints add the address to the suppression list,
+// and every report records the status of the recipient on the message it
+// quotes
+func (app *Config) ProcessReport(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxReportSize)
+
+	reports, err := parseReport(r.Body)
+	if err != nil {
+		_ = app.ErrorJSON(w, err)
+		return
+	}
+
+	for i := range reports {
+		if err = app.applyReport(&reports[i]); err != nil {
+			_ = app.ErrorJSON(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	responsePayload := tools.JsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("%d recipients reported", len(reports)),
+		Data:    reports,
+	}
+
+	_ = app.WriteJSON(w, http.StatusOK, responsePayload)
+}
+
+// applyReport suppresses the address of a hard bounce or a complaint, and
+// records the status of the recipient on its message
+func (app *Config) applyReport(r *report) error {
+	recipient := r.recipient()
+
+	reason := ""
+	switch {
+	case r.hardBounce():
+		reason = data.ReasonBounce
+	case r.Action == complaintAction:
+		reason = data.ReasonComplaint
+	}
+
+	if reason != "" {
+		_, err := app.Models.Suppression.Add(data.Suppression{
+			Address:   r.Address,
+			Reason:    reason,
+			Detail:    recipient.Reason,
+			MessageID: r.MessageID,
+		})
+		if err != nil {
+			return err
+		}
+
+		r.Suppressed = true
+		log.Printf("Suppressed %s after a %s: %s\n", r.Address, reason, recipient.Reason)
+	}
+
+	if r.MessageID == "" {
+		return nil
+	}
+
+	_, err := app.Models.Message.SetRecipient(r.MessageID, recipient)
+	if errors.Is(err, data.ErrNotFound) {
+		// the message has been pruned since
+		return nil
+	}
+
+	return err
+}
+
+// GetSuppressions lists the suppressed addresses
+func (app *Config) GetSuppressions(w http.ResponseWriter, r *http.Request) {
+	suppressions, err := app.Models.Suppression.GetAll()
+	if err != nil {
+		_ = app.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	responsePayload := tools.JsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("%d addresses suppressed", len(suppressions)),
+		Data:    suppressions,
+	}
+
+	_ = app.WriteJSON(w, http.StatusOK, responsePayload)
+}
+
+// AddSuppression adds an address to the suppression list, by hand or when
+// its owner unsubscribes. The reason is one of manual, the default,
+// unsubscribe, bounce or complaint
+func (app *Config) AddSuppression(w http.ResponseWriter, r *http.Request) {
+	type suppressionRequest struct {
+		Address string `json:"address"`
+		Reason  string `json:"reason"`
+		Detail  string `json:"detail"`
+	}
+
+	var requestPayload suppressionRequest
+
+	err := app.ReadJSON(w, r, &requestPayload)
+	if err != nil {
+		_ = app.ErrorJSON(w, err)
+		return
+	}
+
+	address, err := mail.ParseAddress(requestPayload.Address)
+	if err != nil {
+		_ = app.ErrorJSON(w, fmt.Errorf("invalid address %q: %v", requestPayload.Address, err))
+		return
+	}
+
+	if requestPayload.Reason == "" {
+		requestPayload.Reason = data.ReasonManual
+	}
+	if !slices.Contains(data.SuppressionReasons, requestPayload.Reason) {
+		_ = app.ErrorJSON(w, fmt.Errorf("invalid reason %q, must be one of %v", requestPayload.Reason, data.SuppressionReasons))
+		return
+	}
+
+	suppression, err := app.Models.Suppression.Add(data.Suppression{
+		Address: address.Address,
+		Reason:  requestPayload.Reason,
+		Detail:  requestPayload.Detail,
+	})
+	if err != nil {
+		_ = app.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	responsePayload := tools.JsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("%s suppressed", suppression.Address),
+		Data:    suppression,
+	}
+
+	_ = app.WriteJSON(w, http.StatusOK, responsePayload)
+}
+
+// RemoveSuppression removes an address from the suppression list, so that
+// the messages queued from then on are sent to it again
+func (app *Config) RemoveSuppression(w http.ResponseWriter, r *http.Request) {
+	address := chi.URLParam(r, "address")
+
+	err := app.Models.Suppression.Remove(address)
+	if err != nil {
+		if errors.Is(err, data.ErrNotFound) {
+			_ = app.ErrorJSON(w, errors.New("address not suppressed"), http.StatusNotFound)
+			return
+		}
+
+		_ = app.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	responsePayload := tools.JsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("%s no longer suppressed", data.NormalizeAddress(address)),
+	}
+
+	_ = app.WriteJSON(w, http.StatusOK, responsePayload)
+}
+
+// PreviewMail renders a template with sample data without sending anything,
+// and returns the subject, the HTML with its CSS inlined and the plain text
+func (app *Config) PreviewMail(w http.ResponseWriter, r *http.Request) {
+	type previewRequest struct {
+		Subject  string         `json:"subject"`
+		Message  string         `json:"message"`
+		Template string         `json:"template"`
+		Data     map[string]any `json:"data"`
+	}
+
+	var requestPayload previewRequest
+
+	err := app.ReadJSON(w, r, &requestPayload)
+	if err != nil {
+		_ = app.ErrorJSON(w, err)
+		return
+	}
+
+	rendered, err := app.Mailer.buildMessage(Message{
+		Subject:  requestPayload.Subject,
+		Template: requestPayload.Template,
+		Data:     requestPayload.Message,
+		DataMap:  requestPayload.Data,
+	})
+	if err != nil {
+		_ = app.ErrorJSON(w, err)
+		return
+	}
+
+	responsePayload := tools.JsonResponse{
+		Error:   false,
+		Message: "preview",
+		Data:    rendered,
+	}
+
+	_ = app.WriteJSON(w, http.StatusOK, responsePayload)
+}
+
+// GetTemplates lists the names of the templates
+func (app *Config) GetTemplates(w http.ResponseWriter, r *http.Request) {
+	responsePayload := tools.JsonResponse{
+		Error:   false,
+		Message: "templates",
+		Data:    app.Mailer.Templates.Names(),
+	}
+
+	_ = app.WriteJSON(w, http.StatusOK, responsePayload)
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
-	"bytes"
-	"html/template"
+	"fmt"
+	"log"
+	"mail-service/data"
+	"mail-service/templates"
+	"os"
 	"time"
 
 	"github.com/vanng822/go-premailer/premailer"
@@ -12,6 +15,14 @@ import (
 const (
 	connectTimeout = time.Second * 10
 	sendTimeout    = time.Second * 10
+
+	// defaultTemplate renders the messages sent without a template, from
+	// their message alone
+	defaultTemplate = "mail"
+
+	// defaultMailFileDir is where the file sender writes the emails when
+	// MAIL_FILE_DIR is not set
+	defaultMailFileDir = "/var/lib/mail/sent"
 )
 
 type Encryption string
@@ -31,19 +42,36 @@ type Mail struct {
 	Encryption  Encryption
 	FromAddress string
 	FromName    string
+	Templates   *templates.Registry
+
+	// sender delivers the rendered messages
+	sender Sender
+	// dkim signs the messages for Domain, nil when not configured
+	dkim *dkimSigner
 }
 
 type Message struct {
+	// ID is the id of the message in the outbox
+	ID          string
 	From        string
 	FromName    string
-	To          string
+	To          []string
+	Cc          []string
+	Bcc         []string
+	ReplyTo     []string
 	Subject     string
-	Attachments []string
-	Data        any
-	DataMap     map[string]any
+	Attachments []data.Attachment
+	// Template is the name of the template rendering the message, the
+	// default template when empty
+	Template string
+	// Data is available to the template as the message variable, besides
+	// the variables of DataMap
+	Data    any
+	DataMap map[string]any
 }
 
-func (m *Mail) SendSMTPMessage(msg Message) error {
+// SendMessage renders a message and delivers it with the configured senders
+func (m *Mail) SendMessage(msg Message) error {
 	if msg.From == "" {
 		// use default address if a specific one is not specified
 		msg.From = m.FromAddress
@@ -54,99 +82,62 @@ func (m *Mail) SendSMTPMessage(msg Message) error {
 		msg.FromName = m.FromName
 	}
 
-	data := map[string]any{
-		"message": msg.Data, // message will be mapped to the templates
-	}
-
-	msg.DataMap = data
-
-	formattedMessage, err := m.buildHTMLMessage(msg)
-	if err != nil {
-		return err
-	}
-
-	plainMessage, err := m.buildPlainTextMessage(msg)
-	if err != nil {
-		return err
-	}
-
-	// setup SMTP server
-	server := mail.NewSMTPClient()
-	server.Host = m.Host
-	server.Port = m.Port
-	server.Username = m.Username
-	server.Password = m.Password
-	server.Encryption = m.getEncryption()
-	server.KeepAlive = false
-	server.ConnectTimeout = connectTimeout
-	server.SendTimeout = sendTimeout
-
-	// connect to SMTP server
-	smtClient, err := server.Connect()
-	if err != nil {
-		return err
-	}
-
-	// setup new email message
-	email := mail.NewMSG()
-	email.SetFrom(msg.From)
-	email.AddTo(msg.To)
-	email.SetSubject(msg.Subject)
-	email.SetBody(mail.TextPlain, plainMessage)
-	email.AddAlternative(mail.TextHTML, formattedMessage)
-	if len(msg.Attachments) > 0 {
-		for _, attachment := range msg.Attachments {
-			email.AddAttachment(attachment)
-		}
-	}
-
-	// send email
-	err = email.Send(smtClient)
+	rendered, err := m.buildMessage(msg)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return m.sender.Send(&Email{
+		ID:          msg.ID,
+		From:        msg.From,
+		To:          msg.To,
+		Cc:          msg.Cc,
+		Bcc:         msg.Bcc,
+		ReplyTo:     msg.ReplyTo,
+		Subject:     rendered.Subject,
+		HTML:        rendered.HTML,
+		Plain:       rendered.Plain,
+		Attachments: msg.Attachments,
+		dkim:        m.dkim,
+	})
 }
 
-func (m *Mail) buildPlainTextMessage(msg Message) (string, error) {
-	templateToRender := "./templates/mail.plain.gohtml"
-
-	t, err := template.New("email-plain").ParseFiles(templateToRender)
-	if err != nil {
-		return "", err
+// buildMessage renders a message with its template and inlines the CSS of
+// the HTML version. The subject of the message takes precedence over the one
+// of the template
+func (m *Mail) buildMessage(msg Message) (*templates.Rendered, error) {
+	name := msg.Template
+	if name == "" {
+		name = defaultTemplate
 	}
 
-	var tpl bytes.Buffer
-	if err = t.ExecuteTemplate(&tpl, "body", msg.DataMap); err != nil {
-		return "", err
+	data := make(map[string]any, len(msg.DataMap)+1)
+	for key, value := range msg.DataMap {
+		data[key] = value
 	}
 
-	plainMessage := tpl.String()
-
-	return plainMessage, nil
-}
-
-func (m *Mail) buildHTMLMessage(msg Message) (string, error) {
-	templateToRender := "./templates/mail.html.gohtml"
+	// message will be mapped to the templates
+	if _, ok := data["message"]; !ok && msg.Data != nil {
+		data["message"] = msg.Data
+	}
 
-	t, err := template.New("email-html").ParseFiles(templateToRender)
+	rendered, err := m.Templates.Render(name, data)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	var tpl bytes.Buffer
-	if err = t.ExecuteTemplate(&tpl, "body", msg.DataMap); err != nil {
-		return "", err
+	if msg.Subject != "" {
+		rendered.Subject = msg.Subject
 	}
 
-	formattedMessage := tpl.String()
-	formattedMessage, err = m.inlineCSS(formattedMessage)
-	if err != nil {
-		return "", err
+	if rendered.HTML != "" {
+		rendered.HTML, err = m.inlineCSS(rendered.HTML)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return formattedMessage, nil
+	return rendered, nil
 }
 
 func (m *Mail) inlineCSS(s string) (string, error) {
@@ -169,6 +160,20 @@ func (m *Mail) inlineCSS(s string) (string, error) {
 	return html, nil
 }
 
+// smtpServer returns the settings of the SMTP server
+func (m *Mail) smtpServer() *mail.SMTPServer {
+	server := mail.NewSMTPClient()
+	server.Host = m.Host
+	server.Port = m.Port
+	server.Username = m.Username
+	server.Password = m.Password
+	server.Encryption = m.getEncryption()
+	server.ConnectTimeout = connectTimeout
+	server.SendTimeout = sendTimeout
+
+	return server
+}
+
 // getEncryption returns the encryption type based on the receiver
 // encryption field
 func (m Mail) getEncryption() mail.Encryption {
@@ -183,3 +188,70 @@ func (m Mail) getEncryption() mail.Encryption {
 		return mail.EncryptionSTARTTLS
 	}
 }
+
+// smtpSender sends the emails over the pooled connections to the SMTP server
+type smtpSender struct {
+	pool *smtpPool
+}
+
+func (s *smtpSender) Name() string {
+	return "smtp"
+}
+
+func (s *smtpSender) Send(email *Email) error {
+	return s.pool.send(email.mime())
+}
+
+// fileSender writes the emails to files, for development. Without a
+// directory it prints them on the standard output instead
+type fileSender struct {
+	dir string
+}
+
+// createFileSender reads the directory of the emails from MAIL_FILE_DIR
+func createFileSender() *fileSender {
+	dir := os.Getenv("MAIL_FILE_DIR")
+	if dir == "" {
+		dir = defaultMailFileDir
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		log.Panic(err)
+	}
+
+	return &fileSender{dir: dir}
+}
+
+func (s *fileSender) Name() string {
+	if s.dir == "" {
+		return "stdout"
+	}
+
+	return "file"
+}
+
+func (s *fileSender) Send(email *Email) error {
+	message := email.mime()
+	if err := message.GetError(); err != nil {
+		return err
+	}
+
+	raw := rawMessage(message)
+
+	if s.dir == "" {
+		_, err := fmt.Printf("%s\n\n", raw)
+		return err
+	}
+
+	file, err := os.CreateTemp(s.dir, time.Now().UTC().Format("20060102T150405")+"-*.eml")
+	if err != nil {
+		return err
+	}
+
+	_, err = file.WriteString(raw)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
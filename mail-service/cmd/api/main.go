@@ -2,10 +2,12 @@ package main
 
 import (
 	"fmt"
+	"io/fs"
 	"log"
+	"mail-service/data"
+	"mail-service/templates"
 	"net/http"
 	"os"
-	"strconv"
 	"tools"
 )
 
@@ -14,14 +16,42 @@ const webPort = 80
 type Config struct {
 	tools.Tools
 	Mailer Mail
+	Models data.Models
+
+	// Outbox sends the queued messages in the background
+	Outbox *Outbox
+
+	// Attachments keeps the attachments of the queued messages
+	Attachments *Attachments
+
+	// MaxRecipients is the number of to, cc and bcc addresses a message may
+	// have
+	MaxRecipients int
 }
 
 func main() {
+	// open the outbox selected by OUTBOX_STORE, files unless configured
+	// otherwise
+	store, closeStore := openStore()
+	defer closeStore()
+
 	app := Config{
 		Tools:  tools.New(),
 		Mailer: createMail(),
+		Models: data.New(store),
+
+		MaxRecipients: envInt("MAX_RECIPIENTS", defaultMaxRecipients),
+		Attachments:   createAttachments(),
 	}
 
+	// leave room for the attachments, base64 encoded
+	app.Tools.MaxJSONSize = max(app.Tools.MaxJSONSize, app.Attachments.maxRequestSize())
+
+	// send the queued messages, including the ones left over by a previous
+	// run
+	app.Outbox = createOutbox(app.Models, app.Attachments, app.Mailer.SendMessage)
+	app.Outbox.Start()
+
 	log.Println("Starting mail service on port", webPort)
 
 	srv := &http.Server{
@@ -36,10 +66,8 @@ func main() {
 }
 
 func createMail() Mail {
-	port, err := strconv.Atoi(os.Getenv("MAIL_PORT"))
-	if err != nil {
-		log.Panic(err)
-	}
+	// the port is only needed when sending over SMTP
+	port := envInt("MAIL_PORT", 25)
 	encryption := Encryption(os.Getenv("MAIL_ENCRYPTION"))
 
 	m := Mail{
@@ -51,7 +79,28 @@ func createMail() Mail {
 		Encryption:  encryption,
 		FromName:    os.Getenv("MAIL_FROM_NAME"),
 		FromAddress: os.Getenv("MAIL_FROM_ADDRESS"),
+		Templates:   loadTemplates(),
 	}
+	m.sender = m.createSender()
+	m.dkim = createDKIMSigner(m.Domain)
 
 	return m
 }
+
+// loadTemplates parses the templates in the TEMPLATES_DIR directory, or the
+// templates built into the service when it is not set
+func loadTemplates() *templates.Registry {
+	var fsys fs.FS = templates.Embedded
+	if dir := os.Getenv("TEMPLATES_DIR"); dir != "" {
+		fsys = os.DirFS(dir)
+	}
+
+	registry, err := templates.Load(fsys)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	log.Println("Loaded templates:", registry.Names())
+
+	return registry
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"mail-service/data"
+	"strings"
+	"time"
+)
+
+const (
+	defaultWorkers     = 4
+	defaultMaxAttempts = 8
+
+	// retryBackoff is the wait before the first retry, it doubles with every
+	// following attempt up to maxRetryBackoff
+	retryBackoff    = time.Second * 30
+	maxRetryBackoff = time.Hour
+
+	// claimLease is how long a worker holds a message. When it has not
+	// reported the outcome by then, for instance because the service
+	// crashed, another worker sends the message again
+	claimLease = time.Minute * 5
+
+	// pollInterval is how often idle workers look for due messages, besides
+	// being woken up by new messages
+	pollInterval = time.Second
+
+	// defaultMessageRetention is how long sent and failed messages are kept
+	// when MESSAGE_RETENTION is not set
+	defaultMessageRetention = time.Hour * 24 * 7
+)
+
+// Outbox sends the queued messages from a pool of workers, retrying failed
+// attempts with an exponential backoff. Recurring messages are queued again
+// for their next occurrence once sent. The suppressed addresses are left out
+// of every attempt
+type Outbox struct {
+	models      data.Models
+	attachments *Attachments
+	send        func(Message) error
+	workers     int
+	maxAttempts int
+	retention   time.Duration
+	wake        chan struct{}
+}
+
+// createOutbox reads the number of workers from MAIL_WORKERS, the number of
+// attempts per message from MAIL_MAX_ATTEMPTS and how long finished messages
+// are kept from MESSAGE_RETENTION
+func createOutbox(models data.Models, attachments *Attachments, send func(Message) error) *Outbox {
+	return &Outbox{
+		models:      models,
+		attachments: attachments,
+		send:        send,
+		workers:     envInt("MAIL_WORKERS", defaultWorkers),
+		maxAttempts: envInt("MAIL_MAX_ATTEMPTS", defaultMaxAttempts),
+		retention:   envDuration("MESSAGE_RETENTION", defaultMessageRetention),
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// Start starts the workers and the pruning of finished messages
+func (o *Outbox) Start() {
+	for i := 0; i < o.workers; i++ {
+		go o.work()
+	}
+
+	go o.prune()
+}
+
+// Notify wakes up an idle worker, to send a new message right away
+func (o *Outbox) Notify() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// work sends the due messages one at a time, and waits for new ones when
+// none is due
+func (o *Outbox) work() {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		msg, err := o.models.Message.Claim(claimLease)
+		if err != nil {
+			log.Println("Error claiming message:", err)
+		}
+
+		if msg == nil {
+			select {
+			case <-o.wake:
+			case <-ticker.C:
+			}
+			continue
+		}
+
+		o.deliver(msg)
+	}
+}
+
+// deliver attempts to send a claimed message once and records the outcome
+func (o *Outbox) deliver(msg *data.Message) {
+	mailMsg := mailMessage(msg)
+
+	sendErr := o.suppress(msg, &mailMsg)
+	if sendErr == nil {
+		sendErr = o.send(mailMsg)
+	}
+
+	if sendErr == nil {
+		settleRecipients(msg, nil, true)
+
+		if o.recur(msg, nil) {
+			return
+		}
+
+		if err := o.models.Message.MarkSent(msg); err != nil {
+			log.Println("Error recording sent message:", err)
+		}
+		o.attachments.remove(msg.Attachments)
+		return
+	}
+
+	var retryAt time.Time
+	if msg.Attempts+1 < o.maxAttempts && !permanent(sendErr) {
+		retryAt = time.Now().Add(backoff(msg.Attempts + 1))
+	}
+
+	settleRecipients(msg, sendErr, retryAt.IsZero())
+
+	if retryAt.IsZero() {
+		log.Printf("Giving up on message %s to %s: %v\n", msg.ID, msg.To, sendErr)
+
+		// a recurring message goes on with its next occurrence
+		if o.recur(msg, sendErr) {
+			return
+		}
+	} else {
+		log.Printf("Error sending message %s to %s, retrying at %s: %v\n", msg.ID, msg.To, retryAt.Format(time.RFC3339), sendErr)
+	}
+
+	if err := o.models.Message.MarkFailed(msg, sendErr, retryAt); err != nil {
+		log.Println("Error recording failed message:", err)
+	}
+
+	if retryAt.IsZero() {
+		o.attachments.remove(msg.Attachments)
+	}
+}
+
+// suppress leaves the suppressed addresses out of the message about to be
+// sent, and resets the status of every recipient of the message. It returns
+// a suppressedError when no address is left
+func (o *Outbox) suppress(msg *data.Message, mailMsg *Message) error {
+	var addresses []string
+	for _, list := range []data.Addresses{msg.To, msg.Cc, msg.Bcc} {
+		for _, address := range list {
+			addresses = append(addresses, bareAddress(address))
+		}
+	}
+
+	suppressions, err := o.models.Suppression.Find(addresses)
+	if err != nil {
+		return fmt.Errorf("checking the suppression list: %w", err)
+	}
+
+	now := time.Now().UTC()
+	msg.Recipients = nil
+
+	keep := func(list data.Addresses) []string {
+		var kept []string
+		for _, address := range list {
+			recipient := data.Recipient{
+				Address:   bareAddress(address),
+				Status:    data.RecipientPending,
+				UpdatedAt: now,
+			}
+
+			if suppression, ok := suppressions[recipient.Address]; ok {
+				recipient.Status = data.RecipientSuppressed
+				recipient.Reason = suppression.Reason
+				if suppression.Detail != "" {
+					recipient.Reason += ": " + suppression.Detail
+				}
+			} else {
+				kept = append(kept, address)
+			}
+
+			msg.Recipients = append(msg.Recipients, recipient)
+		}
+
+		return kept
+	}
+
+	mailMsg.To = keep(msg.To)
+	mailMsg.Cc = keep(msg.Cc)
+	mailMsg.Bcc = keep(msg.Bcc)
+
+	// a message is not worth sending to its cc and bcc addresses alone
+	if len(mailMsg.To) == 0 {
+		suppressed := make([]string, len(msg.To))
+		for i, address := range msg.To {
+			suppressed[i] = bareAddress(address)
+		}
+
+		return &suppressedError{addresses: suppressed}
+	}
+
+	return nil
+}
+
+// settleRecipients records the outcome of an attempt for the recipients
+// that were sent to. They stay pending while the message is retried
+func settleRecipients(msg *data.Message, sendErr error, final bool) {
+	if sendErr != nil && !final {
+		return
+	}
+
+	now := time.Now().UTC()
+	for i := range msg.Recipients {
+		recipient := &msg.Recipients[i]
+		if recipient.Status != data.RecipientPending {
+			continue
+		}
+
+		recipient.UpdatedAt = now
+		if sendErr == nil {
+			recipient.Status = data.RecipientSent
+		} else {
+			recipient.Status = data.RecipientFailed
+			recipient.Reason = sendErr.Error()
+		}
+	}
+}
+
+// suppressedError is returned when every to address of a message is
+// suppressed
+type suppressedError struct {
+	addresses []string
+}
+
+func (e *suppressedError) Error() string {
+	return "every to address is suppressed: " + strings.Join(e.addresses, ", ")
+}
+
+// Permanent is true, the message is sent again only once the addresses are
+// removed from the suppression list, and queued again
+func (e *suppressedError) Permanent() bool {
+	return true
+}
+
+// recur queues a recurring message again for its next occurrence, and
+// reports whether it did. A message whose schedule has no next occurrence is
+// finished as usual
+func (o *Outbox) recur(msg *data.Message, sendErr error) bool {
+	if msg.Cron == "" {
+		return false
+	}
+
+	next, err := nextOccurrence(msg)
+	if err != nil {
+		log.Printf("Error scheduling message %s again: %v\n", msg.ID, err)
+		return false
+	}
+
+	if err = o.models.Message.Recur(msg, sendErr, next); err != nil {
+		log.Println("Error recording recurring message:", err)
+	}
+
+	return true
+}
+
+// prune deletes the finished messages older than the retention, hourly
+func (o *Outbox) prune() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		_, err := o.models.Message.Prune(time.Now().Add(-o.retention))
+		if err != nil {
+			log.Println("Error pruning messages:", err)
+		}
+	}
+}
+
+// backoff returns the wait after the given number of failed attempts
+func backoff(attempts int) time.Duration {
+	wait := retryBackoff
+	for i := 1; i < attempts && wait < maxRetryBackoff; i++ {
+		wait *= 2
+	}
+
+	return min(wait, maxRetryBackoff)
+}
+
+// mailMessage converts a message of the outbox into the message given to the
+// mailer
+func mailMessage(msg *data.Message) Message {
+	return Message{
+		ID:       msg.ID,
+		From:     msg.From,
+		FromName: msg.FromName,
+		To:       msg.To,
+		Cc:       msg.Cc,
+		Bcc:      msg.Bcc,
+		ReplyTo:  msg.ReplyTo,
+		Subject:  msg.Subject,
+		Template: msg.Template,
+		Data:     msg.Body,
+		DataMap:  msg.Data,
+
+		Attachments: msg.Attachments,
+	}
+}
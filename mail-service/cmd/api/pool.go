@@ -0,0 +1,248 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/textproto"
+	"sync"
+	"time"
+
+	mail "github.com/xhit/go-simple-mail/v2"
+)
+
+const (
+	// defaultPoolSize is the number of SMTP connections kept open when
+	// SMTP_POOL_SIZE is not set, one per worker of the outbox
+	defaultPoolSize = defaultWorkers
+
+	// defaultMaxMessagesPerConnection is how many messages are sent over a
+	// connection before it is replaced, when SMTP_MAX_MESSAGES is not set
+	defaultMaxMessagesPerConnection = 100
+
+	// defaultKeepAliveInterval is how often idle connections are checked
+	// with a NOOP when SMTP_KEEPALIVE_INTERVAL is not set
+	defaultKeepAliveInterval = time.Second * 30
+
+	// defaultIdleTimeout is how long a connection may stay unused before it
+	// is closed, when SMTP_IDLE_TIMEOUT is not set
+	defaultIdleTimeout = time.Minute * 5
+)
+
+// smtpConn is a connection of the pool
+type smtpConn struct {
+	client *mail.SMTPClient
+	// sent is the number of messages sent over the connection
+	sent int
+	// checked is when the connection last proved to be alive, by sending a
+	// message or answering a NOOP
+	checked time.Time
+	// used is when the connection last sent a message
+	used time.Time
+}
+
+// smtpPool is a bounded pool of keep-alive SMTP connections, shared by the
+// concurrent senders. Connections are checked with a NOOP when they have been
+// idle for a while, and replaced when they fail or have sent their share of
+// messages
+type smtpPool struct {
+	server            *mail.SMTPServer
+	size              int
+	maxMessages       int
+	keepAliveInterval time.Duration
+	idleTimeout       time.Duration
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	idle []*smtpConn
+	// open is the number of connections, idle or in use
+	open int
+}
+
+// newSMTPPool returns a pool connecting to server. It reads the number of
+// connections from SMTP_POOL_SIZE, how many messages are sent over a
+// connection from SMTP_MAX_MESSAGES, how often idle connections are checked
+// from SMTP_KEEPALIVE_INTERVAL and when they are closed from
+// SMTP_IDLE_TIMEOUT
+func newSMTPPool(server *mail.SMTPServer) *smtpPool {
+	server.KeepAlive = true
+
+	p := &smtpPool{
+		server:            server,
+		size:              envInt("SMTP_POOL_SIZE", defaultPoolSize),
+		maxMessages:       envInt("SMTP_MAX_MESSAGES", defaultMaxMessagesPerConnection),
+		keepAliveInterval: envDuration("SMTP_KEEPALIVE_INTERVAL", defaultKeepAliveInterval),
+		idleTimeout:       envDuration("SMTP_IDLE_TIMEOUT", defaultIdleTimeout),
+	}
+	p.cond = sync.NewCond(&p.mu)
+
+	go p.keepAlive()
+
+	return p
+}
+
+// send sends an email over a connection of the pool
+func (p *smtpPool) send(email *mail.Email) error {
+	// an email that cannot be built is not worth a connection
+	if err := email.GetError(); err != nil {
+		return err
+	}
+
+	conn, err := p.get()
+	if err != nil {
+		return err
+	}
+
+	err = email.Send(conn.client)
+	p.put(conn, err)
+
+	return err
+}
+
+// get returns an idle connection, or opens a new one when there are fewer
+// than size, waiting for a connection to be returned otherwise
+func (p *smtpPool) get() (*smtpConn, error) {
+	p.mu.Lock()
+	for len(p.idle) == 0 && p.open >= p.size {
+		p.cond.Wait()
+	}
+
+	if len(p.idle) == 0 {
+		p.open++
+		p.mu.Unlock()
+
+		conn, err := p.dial()
+		if err != nil {
+			p.release()
+			return nil, err
+		}
+
+		return conn, nil
+	}
+
+	// the most recently used connection is the most likely to be alive
+	conn := p.idle[len(p.idle)-1]
+	p.idle = p.idle[:len(p.idle)-1]
+	p.mu.Unlock()
+
+	if time.Since(conn.checked) < p.keepAliveInterval {
+		return conn, nil
+	}
+
+	if err := conn.client.Noop(); err == nil {
+		conn.checked = time.Now()
+		return conn, nil
+	}
+
+	// the server dropped the connection, reconnect in its place
+	_ = conn.client.Close()
+
+	conn, err := p.dial()
+	if err != nil {
+		p.release()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// put returns a connection after sending a message over it. The connection
+// is kept unless the message failed for another reason than a reply of the
+// server, or the connection has sent the maximum number of messages
+func (p *smtpPool) put(conn *smtpConn, sendErr error) {
+	var smtpErr *textproto.Error
+	healthy := sendErr == nil || errors.As(sendErr, &smtpErr)
+
+	now := time.Now()
+	conn.sent++
+	conn.used = now
+	if healthy {
+		conn.checked = now
+	}
+
+	if !healthy || conn.sent >= p.maxMessages {
+		p.discard(conn, healthy)
+		return
+	}
+
+	p.mu.Lock()
+	p.idle = append(p.idle, conn)
+	p.cond.Signal()
+	p.mu.Unlock()
+}
+
+// keepAlive sends a NOOP over the idle connections that have not been used
+// for keepAliveInterval, so that the server does not time them out, and
+// closes the connections that failed or have been idle for idleTimeout
+func (p *smtpPool) keepAlive() {
+	ticker := time.NewTicker(p.keepAliveInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now()
+
+		// take the connections to check out of the pool, so that they are not
+		// used meanwhile
+		p.mu.Lock()
+		var due []*smtpConn
+		idle := p.idle[:0]
+		for _, conn := range p.idle {
+			if now.Sub(conn.checked) >= p.keepAliveInterval {
+				due = append(due, conn)
+			} else {
+				idle = append(idle, conn)
+			}
+		}
+		p.idle = idle
+		p.mu.Unlock()
+
+		for _, conn := range due {
+			if now.Sub(conn.used) >= p.idleTimeout {
+				p.discard(conn, true)
+				continue
+			}
+
+			if err := conn.client.Noop(); err != nil {
+				log.Println("Error checking SMTP connection, closing it:", err)
+				p.discard(conn, false)
+				continue
+			}
+			conn.checked = time.Now()
+
+			p.mu.Lock()
+			p.idle = append(p.idle, conn)
+			p.cond.Signal()
+			p.mu.Unlock()
+		}
+	}
+}
+
+// dial opens a new connection
+func (p *smtpPool) dial() (*smtpConn, error) {
+	client, err := p.server.Connect()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	return &smtpConn{client: client, checked: now, used: now}, nil
+}
+
+// discard closes a connection, saying goodbye to the server when it is still
+// healthy, and makes room for a new one
+func (p *smtpPool) discard(conn *smtpConn, healthy bool) {
+	if healthy {
+		_ = conn.client.Quit()
+	}
+	_ = conn.client.Close()
+
+	p.release()
+}
+
+// release removes a closed connection from the count of open connections
+func (p *smtpPool) release() {
+	p.mu.Lock()
+	p.open--
+	p.cond.Signal()
+	p.mu.Unlock()
+}
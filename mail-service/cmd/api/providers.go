@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSendGridURL = "https://api.sendgrid.com"
+	defaultMailgunURL  = "https://api.mailgun.net"
+
+	// maxErrorBody is how much of an error reply of a provider is kept in
+	// the error
+	maxErrorBody = 1024
+)
+
+// providerClient is the HTTP client of the providers
+var providerClient = &http.Client{Timeout: sendTimeout}
+
+// sendGridSender sends the emails with the v3 mail send API of SendGrid
+type sendGridSender struct {
+	url    string
+	apiKey string
+}
+
+// createSendGridSender reads the API key from SENDGRID_API_KEY, and the URL
+// of the API from SENDGRID_URL
+func createSendGridSender() *sendGridSender {
+	return &sendGridSender{
+		url:    envString("SENDGRID_URL", defaultSendGridURL),
+		apiKey: requireEnv("SENDGRID_API_KEY"),
+	}
+}
+
+func (s *sendGridSender) Name() string {
+	return "sendgrid"
+}
+
+type sendGridAddress struct {
+	Email string `json:"email"`
+	Name  string `json:"name,omitempty"`
+}
+
+type sendGridContent struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type sendGridAttachment struct {
+	Content     string `json:"content"`
+	Type        string `json:"type"`
+	Filename    string `json:"filename"`
+	Disposition string `json:"disposition"`
+	ContentID   string `json:"content_id,omitempty"`
+}
+
+type sendGridPersonalization struct {
+	To  []sendGridAddress `json:"to"`
+	Cc  []sendGridAddress `json:"cc,omitempty"`
+	Bcc []sendGridAddress `json:"bcc,omitempty"`
+}
+
+type sendGridMessage struct {
+	Personalizations []sendGridPersonalization `json:"personalizations"`
+	From             sendGridAddress           `json:"from"`
+	ReplyTo          *sendGridAddress          `json:"reply_to,omitempty"`
+	ReplyToList      []sendGridAddress         `json:"reply_to_list,omitempty"`
+	Subject          string                    `json:"subject"`
+	Content          []sendGridContent         `json:"content"`
+	Attachments      []sendGridAttachment      `json:"attachments,omitempty"`
+	Headers          map[string]string         `json:"headers,omitempty"`
+}
+
+func (s *sendGridSender) Send(email *Email) error {
+	message := sendGridMessage{
+		Personalizations: []sendGridPersonalization{{
+			To:  sendGridAddresses(email.To),
+			Cc:  sendGridAddresses(email.Cc),
+			Bcc: sendGridAddresses(email.Bcc),
+		}},
+		From:    sendGridAddresses([]string{email.From})[0],
+		Subject: email.Subject,
+	}
+
+	switch len(email.ReplyTo) {
+	case 0:
+	case 1:
+		message.ReplyTo = &sendGridAddresses(email.ReplyTo)[0]
+	default:
+		message.ReplyToList = sendGridAddresses(email.ReplyTo)
+	}
+	if email.ID != "" {
+		message.Headers = map[string]string{outboxIDHeader: email.ID}
+	}
+
+	// the plain text must come first
+	if email.Plain != "" {
+		message.Content = append(message.Content, sendGridContent{Type: "text/plain", Value: email.Plain})
+	}
+	if email.HTML != "" {
+		message.Content = append(message.Content, sendGridContent{Type: "text/html", Value: email.HTML})
+	}
+
+	for _, attachment := range email.Attachments {
+		content, err := os.ReadFile(attachment.Path)
+		if err != nil {
+			return err
+		}
+
+		part := sendGridAttachment{
+			Content:     base64.StdEncoding.EncodeToString(content),
+			Type:        attachment.ContentType,
+			Filename:    attachment.Name,
+			Disposition: "attachment",
+		}
+		if attachment.Inline {
+			part.Disposition = "inline"
+			part.ContentID = attachment.Name
+		}
+
+		message.Attachments = append(message.Attachments, part)
+	}
+
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest(http.MethodPost, s.url+"/v3/mail/send", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Authorization", "Bearer "+s.apiKey)
+
+	return doProviderRequest(s.Name(), request)
+}
+
+func sendGridAddresses(addresses []string) []sendGridAddress {
+	var list []sendGridAddress
+	for _, address := range addresses {
+		name, email := splitAddress(address)
+		list = append(list, sendGridAddress{Email: email, Name: name})
+	}
+
+	return list
+}
+
+// mailgunSender sends the emails with the messages API of Mailgun
+type mailgunSender struct {
+	url    string
+	domain string
+	apiKey string
+}
+
+// createMailgunSender reads the sending domain from MAILGUN_DOMAIN, the API
+// key from MAILGUN_API_KEY and the URL of the API from MAILGUN_URL, which is
+// https://api.eu.mailgun.net for the domains in the EU region
+func createMailgunSender() *mailgunSender {
+	return &mailgunSender{
+		url:    envString("MAILGUN_URL", defaultMailgunURL),
+		domain: requireEnv("MAILGUN_DOMAIN"),
+		apiKey: requireEnv("MAILGUN_API_KEY"),
+	}
+}
+
+func (s *mailgunSender) Name() string {
+	return "mailgun"
+}
+
+func (s *mailgunSender) Send(email *Email) error {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+
+	fields := [][2]string{
+		{"from", email.From},
+		{"subject", email.Subject},
+	}
+	for _, to := range email.To {
+		fields = append(fields, [2]string{"to", to})
+	}
+	for _, cc := range email.Cc {
+		fields = append(fields, [2]string{"cc", cc})
+	}
+	for _, bcc := range email.Bcc {
+		fields = append(fields, [2]string{"bcc", bcc})
+	}
+	if len(email.ReplyTo) > 0 {
+		fields = append(fields, [2]string{"h:Reply-To", strings.Join(email.ReplyTo, ", ")})
+	}
+	if email.ID != "" {
+		fields = append(fields, [2]string{"h:" + outboxIDHeader, email.ID})
+	}
+	if email.Plain != "" {
+		fields = append(fields, [2]string{"text", email.Plain})
+	}
+	if email.HTML != "" {
+		fields = append(fields, [2]string{"html", email.HTML})
+	}
+
+	for _, field := range fields {
+		if err := form.WriteField(field[0], field[1]); err != nil {
+			return err
+		}
+	}
+
+	// inline images are referenced as cid:<name>, as with SMTP
+	for _, attachment := range email.Attachments {
+		field := "attachment"
+		if attachment.Inline {
+			field = "inline"
+		}
+
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Disposition", fmt.Sprintf(`form-data; name=%q; filename=%q`, field, attachment.Name))
+		header.Set("Content-Type", attachment.ContentType)
+
+		part, err := form.CreatePart(header)
+		if err != nil {
+			return err
+		}
+
+		if err = copyFile(part, attachment.Path); err != nil {
+			return err
+		}
+	}
+
+	if err := form.Close(); err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest(http.MethodPost, s.url+"/v3/"+s.domain+"/messages", &body)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", form.FormDataContentType())
+	request.SetBasicAuth("api", s.apiKey)
+
+	return doProviderRequest(s.Name(), request)
+}
+
+// sesSender sends the emails with the v2 API of Amazon SES, as raw MIME
+// messages so that attachments and inline images work as with SMTP
+type sesSender struct {
+	url          string
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+// createSESSender reads the region from SES_REGION or AWS_REGION, the
+// credentials from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN, and the URL of the API from SES_URL
+func createSESSender() *sesSender {
+	region := envString("SES_REGION", os.Getenv("AWS_REGION"))
+	if region == "" {
+		requireEnv("SES_REGION")
+	}
+
+	return &sesSender{
+		url:          envString("SES_URL", "https://email."+region+".amazonaws.com"),
+		region:       region,
+		accessKey:    requireEnv("AWS_ACCESS_KEY_ID"),
+		secretKey:    requireEnv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+}
+
+func (s *sesSender) Name() string {
+	return "ses"
+}
+
+func (s *sesSender) Send(email *Email) error {
+	message := email.mime()
+	if err := message.GetError(); err != nil {
+		return err
+	}
+
+	// the destination includes the bcc addresses, which the raw message
+	// leaves out
+	destination := map[string][]string{"ToAddresses": email.To}
+	if len(email.Cc) > 0 {
+		destination["CcAddresses"] = email.Cc
+	}
+	if len(email.Bcc) > 0 {
+		destination["BccAddresses"] = email.Bcc
+	}
+
+	payload := map[string]any{
+		"FromEmailAddress": email.From,
+		"Destination":      destination,
+		"Content": map[string]any{
+			"Raw": map[string][]byte{
+				"Data": []byte(rawMessage(message)),
+			},
+		},
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest(http.MethodPost, s.url+"/v2/email/outbound-emails", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	s.sign(request, body, time.Now().UTC())
+
+	return doProviderRequest(s.Name(), request)
+}
+
+// sign signs a request with AWS Signature Version 4
+func (s *sesSender) sign(request *http.Request, body []byte, now time.Time) {
+	const service = "ses"
+
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	request.Header.Set("X-Amz-Date", amzDate)
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.sessionToken != "" {
+		request.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	signedHeaders := []string{"content-type", "host", "x-amz-content-sha256", "x-amz-date"}
+	if s.sessionToken != "" {
+		signedHeaders = append(signedHeaders, "x-amz-security-token")
+	}
+
+	var canonicalHeaders strings.Builder
+	for _, name := range signedHeaders {
+		value := request.Header.Get(name)
+		if name == "host" {
+			value = request.URL.Host
+		}
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, strings.TrimSpace(value))
+	}
+
+	path := request.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		path,
+		request.URL.RawQuery,
+		canonicalHeaders.String(),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.region + "/" + service + "/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	request.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, strings.Join(signedHeaders, ";"), signature,
+	))
+}
+
+// doProviderRequest sends a request to the API of a provider, turning the
+// error replies into a providerError
+func doProviderRequest(provider string, request *http.Request) error {
+	response, err := providerClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		_, _ = io.Copy(io.Discard, response.Body)
+		return nil
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(response.Body, maxErrorBody))
+
+	return &providerError{
+		provider: provider,
+		status:   response.StatusCode,
+		body:     strings.TrimSpace(string(body)),
+	}
+}
+
+// splitAddress splits an address into its name and email address
+func splitAddress(address string) (string, string) {
+	parsed, err := mail.ParseAddress(address)
+	if err != nil {
+		return "", address
+	}
+
+	return parsed.Name, parsed.Address
+}
+
+func copyFile(w io.Writer, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(w, file)
+	return err
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
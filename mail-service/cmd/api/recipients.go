@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"mail-service/data"
+	"net/mail"
+	"strings"
+)
+
+// defaultMaxRecipients is the number of to, cc and bcc addresses a message may
+// have when MAX_RECIPIENTS is not set
+const defaultMaxRecipients = 50
+
+// recipients are the validated addresses of a message
+type recipients struct {
+	To      data.Addresses
+	Cc      data.Addresses
+	Bcc     data.Addresses
+	ReplyTo data.Addresses
+}
+
+// parseRecipients validates the addresses of a message, as RFC 5322 addresses
+// such as "Jane <jane@example.com>", and returns them normalized. There must
+// be at least one to address and at most limit to, cc and bcc addresses in
+// total
+func parseRecipients(to, cc, bcc, replyTo []string, limit int) (*recipients, error) {
+	var (
+		r   recipients
+		err error
+	)
+
+	if r.To, err = parseAddresses("to", to); err != nil {
+		return nil, err
+	}
+	if r.Cc, err = parseAddresses("cc", cc); err != nil {
+		return nil, err
+	}
+	if r.Bcc, err = parseAddresses("bcc", bcc); err != nil {
+		return nil, err
+	}
+
+	if len(r.To) == 0 {
+		return nil, errors.New("to is required")
+	}
+
+	if count := len(r.To) + len(r.Cc) + len(r.Bcc); count > limit {
+		return nil, fmt.Errorf("too many recipients: %d, at most %d are allowed", count, limit)
+	}
+
+	if r.ReplyTo, err = parseAddresses("reply_to", replyTo); err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+// parseAddresses parses a list of addresses of the given field
+func parseAddresses(field string, addresses []string) (data.Addresses, error) {
+	var parsed data.Addresses
+	for _, address := range addresses {
+		a, err := mail.ParseAddress(address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s address %q: %v", field, address, err)
+		}
+
+		parsed = append(parsed, formatAddress(a))
+	}
+
+	return parsed, nil
+}
+
+// bareAddress returns the address of a formatted address such as
+// "Jane <jane@example.com>", normalized as in the suppression list
+func bareAddress(address string) string {
+	if a, err := mail.ParseAddress(address); err == nil {
+		address = a.Address
+	}
+
+	return data.NormalizeAddress(address)
+}
+
+// formatAddress formats a parsed address, leaving out the angle brackets when
+// it has no name
+func formatAddress(a *mail.Address) string {
+	if a.Name == "" {
+		return a.Address
+	}
+
+	return a.String()
+}
+
+// replyToHeader returns the Reply-To header line of several addresses
+func replyToHeader(addresses []string) (string, error) {
+	formatted := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		a, err := mail.ParseAddress(address)
+		if err != nil {
+			return "", fmt.Errorf("invalid reply_to address %q: %v", address, err)
+		}
+
+		formatted = append(formatted, a.String())
+	}
+
+	return "Reply-To: " + strings.Join(formatted, ",\r\n ") + "\r\n", nil
+}
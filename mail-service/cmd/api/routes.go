@@ -24,6 +24,16 @@ func (app *Config) routes() http.Handler {
 	mux.Use(middleware.Heartbeat("/ping"))
 
 	mux.Post("/send", app.SendMail)
+	mux.Get("/messages/{id}", app.GetMessage)
+	mux.Delete("/messages/{id}", app.CancelMessage)
+
+	mux.Post("/reports", app.ProcessReport)
+	mux.Get("/suppressions", app.GetSuppressions)
+	mux.Post("/suppressions", app.AddSuppression)
+	mux.Delete("/suppressions/{address}", app.RemoveSuppression)
+
+	mux.Post("/preview", app.PreviewMail)
+	mux.Get("/templates", app.GetTemplates)
 
 	return mux
 }
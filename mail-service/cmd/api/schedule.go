@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"mail-service/cron"
+	"mail-service/data"
+	"time"
+
+	// time zone database, for the images that lack one
+	_ "time/tzdata"
+)
+
+// schedule works out when a message is first sent. Without a cron
+// expression that is sendAt, nil meaning right away. A recurring message is
+// first sent at the first occurrence of its cron expression in the timezone
+// location, from sendAt or from now. It returns the time zone to keep with
+// the message
+func schedule(sendAt *time.Time, cronExpr, timezone string) (*time.Time, string, error) {
+	if cronExpr == "" {
+		if timezone != "" {
+			return nil, "", errors.New("timezone is only used with cron")
+		}
+
+		return sendAt, "", nil
+	}
+
+	if timezone == "" {
+		timezone = "UTC"
+	}
+
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid timezone %q: %v", timezone, err)
+	}
+
+	s, err := cron.Parse(cronExpr)
+	if err != nil {
+		return nil, "", err
+	}
+
+	start := time.Now()
+	if sendAt != nil && sendAt.After(start) {
+		start = *sendAt
+	}
+
+	// the first occurrence may be at start itself
+	first, err := s.Next(start.Add(-time.Nanosecond).In(loc))
+	if err != nil {
+		return nil, "", err
+	}
+
+	return &first, timezone, nil
+}
+
+// nextOccurrence returns when a recurring message is sent next, after now
+func nextOccurrence(msg *data.Message) (time.Time, error) {
+	s, err := cron.Parse(msg.Cron)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	loc := time.UTC
+	if msg.Timezone != "" {
+		if loc, err = time.LoadLocation(msg.Timezone); err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	return s.Next(time.Now().In(loc))
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"mail-service/data"
+	"net/http"
+	"net/textproto"
+	"os"
+	"strings"
+
+	mail "github.com/xhit/go-simple-mail/v2"
+)
+
+// outboxIDHeader carries the id of the message in the outbox, which the DSNs
+// quote back with the headers of the message
+const outboxIDHeader = "X-Outbox-Id"
+
+// Email is a rendered email, ready to be handed to a sender
+type Email struct {
+	// ID is the id of the message in the outbox, sent as the X-Outbox-Id
+	// header
+	ID          string
+	From        string
+	To          []string
+	Cc          []string
+	Bcc         []string
+	ReplyTo     []string
+	Subject     string
+	HTML        string
+	Plain       string
+	Attachments []data.Attachment
+
+	// dkim signs the MIME message, when MAIL_DOMAIN has a DKIM selector.
+	// The providers taking JSON sign with the domain settings of the account
+	dkim *dkimSigner
+}
+
+// Sender delivers emails, over SMTP, through the HTTP API of a provider or
+// to files
+type Sender interface {
+	// Name names the sender in the logs and the errors
+	Name() string
+	Send(email *Email) error
+}
+
+// permanentError is implemented by the errors telling whether retrying the
+// same email could succeed
+type permanentError interface {
+	Permanent() bool
+}
+
+// providerError is an error reply of the HTTP API of a provider
+type providerError struct {
+	provider string
+	status   int
+	body     string
+}
+
+func (e *providerError) Error() string {
+	if e.body == "" {
+		return fmt.Sprintf("%s replied %d", e.provider, e.status)
+	}
+
+	return fmt.Sprintf("%s replied %d: %s", e.provider, e.status, e.body)
+}
+
+// Permanent reports a rejection of the email itself. Other client errors,
+// such as a bad API key or a rate limit, may be fixed by the time the email
+// is retried
+func (e *providerError) Permanent() bool {
+	switch e.status {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		return true
+	default:
+		return false
+	}
+}
+
+// failoverSender tries its senders in order, until one of them delivers the
+// email. It stops at a sender rejecting the email for good, as the next ones
+// would reject it too
+type failoverSender struct {
+	senders []Sender
+}
+
+func (f *failoverSender) Name() string {
+	names := make([]string, len(f.senders))
+	for i, sender := range f.senders {
+		names[i] = sender.Name()
+	}
+
+	return strings.Join(names, ",")
+}
+
+func (f *failoverSender) Send(email *Email) error {
+	var errs []error
+	for i, sender := range f.senders {
+		err := sender.Send(email)
+		if err == nil {
+			return nil
+		}
+
+		errs = append(errs, fmt.Errorf("%s: %w", sender.Name(), err))
+		if permanent(err) {
+			break
+		}
+
+		if i < len(f.senders)-1 {
+			log.Printf("Error sending with %s, failing over: %v\n", sender.Name(), err)
+		}
+	}
+
+	return &failoverError{errs: errs}
+}
+
+// failoverError is returned when every sender failed
+type failoverError struct {
+	errs []error
+}
+
+func (e *failoverError) Error() string {
+	return errors.Join(e.errs...).Error()
+}
+
+func (e *failoverError) Unwrap() []error {
+	return e.errs
+}
+
+// Permanent reports whether the last sender tried rejected the email for
+// good
+func (e *failoverError) Permanent() bool {
+	return permanent(e.errs[len(e.errs)-1])
+}
+
+// createSender reads the senders from MAIL_SENDERS, a comma separated list
+// tried in order: smtp (the default), sendgrid, mailgun, ses, file or stdout
+func (m *Mail) createSender() Sender {
+	names := os.Getenv("MAIL_SENDERS")
+	if names == "" {
+		names = "smtp"
+	}
+
+	failover := &failoverSender{}
+	for _, name := range strings.Split(names, ",") {
+		var sender Sender
+
+		switch strings.TrimSpace(name) {
+		case "smtp":
+			sender = &smtpSender{pool: newSMTPPool(m.smtpServer())}
+		case "sendgrid":
+			sender = createSendGridSender()
+		case "mailgun":
+			sender = createMailgunSender()
+		case "ses":
+			sender = createSESSender()
+		case "file":
+			sender = createFileSender()
+		case "stdout":
+			sender = &fileSender{}
+		default:
+			log.Panicf("MAIL_SENDERS must list smtp, sendgrid, mailgun, ses, file or stdout, got %q", name)
+		}
+
+		failover.senders = append(failover.senders, sender)
+	}
+
+	log.Println("Sending mail with", failover.Name())
+
+	return failover
+}
+
+// mime builds the MIME message of an email, for the senders speaking SMTP or
+// taking raw messages
+func (e *Email) mime() *mail.Email {
+	email := mail.NewMSG()
+	if e.ID != "" {
+		email.AddHeader(outboxIDHeader, e.ID)
+	}
+	email.SetFrom(e.From)
+	email.AddTo(e.To...)
+	if len(e.Cc) > 0 {
+		email.AddCc(e.Cc...)
+	}
+	if len(e.Bcc) > 0 {
+		email.AddBcc(e.Bcc...)
+	}
+	if len(e.ReplyTo) == 1 {
+		email.SetReplyTo(e.ReplyTo[0])
+	}
+	email.SetSubject(e.Subject)
+	if e.Plain != "" {
+		email.SetBody(mail.TextPlain, e.Plain)
+		if e.HTML != "" {
+			email.AddAlternative(mail.TextHTML, e.HTML)
+		}
+	} else {
+		email.SetBody(mail.TextHTML, e.HTML)
+	}
+	for _, attachment := range e.Attachments {
+		email.Attach(&mail.File{
+			FilePath: attachment.Path,
+			Name:     attachment.Name,
+			MimeType: attachment.ContentType,
+			Inline:   attachment.Inline,
+		})
+	}
+
+	// go-simple-mail takes a single Reply-To address, so the header with
+	// all of them is added to the message sent, which is the one signed
+	if len(e.ReplyTo) > 1 && email.Error == nil {
+		header, err := replyToHeader(e.ReplyTo)
+		if err != nil {
+			email.Error = err
+			return email
+		}
+		email.DkimMsg = header + email.GetMessage()
+	}
+
+	if err := e.dkim.sign(email); err != nil {
+		email.Error = err
+	}
+
+	return email
+}
+
+// permanent reports whether the email was rejected for good, in which case
+// retrying or failing over would not help: a rejection by a provider, or a
+// 550, 553 or 554 reply of the SMTP server with an enhanced status about the
+// recipients (5.1.x), the content (5.6.x) or the size (5.3.4) of the message.
+// The other 5xx replies, such as 530 and 535 for the authentication or 5.7.1
+// for relaying, tell about the server rather than the email
+func permanent(err error) bool {
+	var permanentErr permanentError
+	if errors.As(err, &permanentErr) {
+		return permanentErr.Permanent()
+	}
+
+	var smtpErr *textproto.Error
+	if !errors.As(err, &smtpErr) {
+		return false
+	}
+	switch smtpErr.Code {
+	case 550, 553, 554:
+	default:
+		return false
+	}
+
+	status, _, _ := strings.Cut(smtpErr.Msg, " ")
+
+	return strings.HasPrefix(status, "5.1.") || strings.HasPrefix(status, "5.6.") || status == "5.3.4"
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeSMTP is an SMTP server accepting every message, or replying mailReply
+// to MAIL FROM when set, and recording the messages as sent over DATA
+type fakeSMTP struct {
+	listener  net.Listener
+	mailReply string
+
+	mu       sync.Mutex
+	messages []string
+}
+
+func newFakeSMTP(t *testing.T) *fakeSMTP {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &fakeSMTP{listener: listener}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	reply := func(line string) {
+		_, _ = io.WriteString(conn, line+"\r\n")
+	}
+
+	reply("220 localhost ESMTP")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		command := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(command, "MAIL FROM"):
+			if s.mailReply != "" {
+				reply(s.mailReply)
+				continue
+			}
+			reply("250 OK")
+		case strings.HasPrefix(command, "DATA"):
+			reply("354 go ahead")
+			message, err := readData(reader)
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, message)
+			s.mu.Unlock()
+			reply("250 OK queued")
+		case command == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			// RCPT TO, NOOP and RSET
+			reply("250 OK")
+		}
+	}
+}
+
+// readData reads the message sent after DATA as is, undoing the dot
+// stuffing only
+func readData(reader *bufio.Reader) (string, error) {
+	var message strings.Builder
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		if line == ".\r\n" {
+			return message.String(), nil
+		}
+
+		message.WriteString(strings.TrimPrefix(line, "."))
+	}
+}
+
+func (s *fakeSMTP) sent() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.messages...)
+}
+
+// sender returns an smtp sender connecting to the server
+func (s *fakeSMTP) sender() *smtpSender {
+	port, _ := strconv.Atoi(strings.TrimPrefix(s.listener.Addr().String(), "127.0.0.1:"))
+
+	m := Mail{Host: "127.0.0.1", Port: port, Encryption: None}
+
+	return &smtpSender{pool: newSMTPPool(m.smtpServer())}
+}
+
+// fakeProvider is the HTTP API of a provider replying status to every
+// request, and recording the requests
+type fakeProvider struct {
+	*httptest.Server
+	status int
+
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func newFakeProvider(t *testing.T, status int) *fakeProvider {
+	t.Helper()
+
+	p := &fakeProvider{status: status}
+	p.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		p.mu.Lock()
+		p.requests = append(p.requests, r)
+		p.bodies = append(p.bodies, body)
+		p.mu.Unlock()
+
+		w.WriteHeader(p.status)
+		if p.status >= 300 {
+			_, _ = io.WriteString(w, `{"errors":[{"message":"fake error"}]}`)
+		}
+	}))
+	t.Cleanup(p.Close)
+
+	return p
+}
+
+func (p *fakeProvider) count() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return len(p.requests)
+}
+
+func testEmail() *Email {
+	return &Email{
+		ID:      "0123456789abcdef",
+		From:    "Sender <sender@example.com>",
+		To:      []string{"Jane <jane@example.org>"},
+		Cc:      []string{"john@example.org"},
+		Subject: "Hello",
+		HTML:    "<p>Hello Jane</p>",
+		Plain:   "Hello Jane",
+	}
+}
+
+func TestProviders(t *testing.T) {
+	sendGrid := newFakeProvider(t, http.StatusAccepted)
+	mailgun := newFakeProvider(t, http.StatusOK)
+	ses := newFakeProvider(t, http.StatusOK)
+
+	senders := []Sender{
+		&sendGridSender{url: sendGrid.URL, apiKey: "sendgrid-key"},
+		&mailgunSender{url: mailgun.URL, domain: "mg.example.com", apiKey: "mailgun-key"},
+		&sesSender{url: ses.URL, region: "eu-west-1", accessKey: "AKID", secretKey: "secret"},
+	}
+	for _, sender := range senders {
+		email := testEmail()
+		email.ReplyTo = []string{"support@example.com", "Help <help@example.com>"}
+		if err := sender.Send(email); err != nil {
+			t.Fatalf("%s: %v", sender.Name(), err)
+		}
+	}
+
+	request, body := sendGrid.requests[0], sendGrid.bodies[0]
+	if request.URL.Path != "/v3/mail/send" || request.Header.Get("Authorization") != "Bearer sendgrid-key" {
+		t.Errorf("sendgrid got %s with %q", request.URL.Path, request.Header.Get("Authorization"))
+	}
+	var message sendGridMessage
+	if err := json.Unmarshal(body, &message); err != nil {
+		t.Fatal(err)
+	}
+	if message.Personalizations[0].To[0].Email != "jane@example.org" || message.Headers[outboxIDHeader] != "0123456789abcdef" {
+		t.Errorf("sendgrid got %s", body)
+	}
+	if message.ReplyTo != nil || len(message.ReplyToList) != 2 || message.ReplyToList[1].Email != "help@example.com" {
+		t.Errorf("sendgrid got reply to %s", body)
+	}
+
+	request = mailgun.requests[0]
+	if user, password, _ := request.BasicAuth(); request.URL.Path != "/v3/mg.example.com/messages" || user != "api" || password != "mailgun-key" {
+		t.Errorf("mailgun got %s as %s", request.URL.Path, user)
+	}
+	_, params, _ := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	form, err := multipart.NewReader(strings.NewReader(string(mailgun.bodies[0])), params["boundary"]).ReadForm(1 << 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if form.Value["to"][0] != "Jane <jane@example.org>" || form.Value["h:"+outboxIDHeader][0] != "0123456789abcdef" {
+		t.Errorf("mailgun got %v", form.Value)
+	}
+	if replyTo := form.Value["h:Reply-To"]; len(replyTo) != 1 || replyTo[0] != "support@example.com, Help <help@example.com>" {
+		t.Errorf("mailgun got reply to %q", replyTo)
+	}
+
+	request = ses.requests[0]
+	if request.URL.Path != "/v2/email/outbound-emails" || !strings.HasPrefix(request.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+		t.Errorf("ses got %s with %q", request.URL.Path, request.Header.Get("Authorization"))
+	}
+	var payload struct {
+		Content struct{ Raw struct{ Data []byte } }
+	}
+	if err := json.Unmarshal(ses.bodies[0], &payload); err != nil {
+		t.Fatal(err)
+	}
+	if raw := string(payload.Content.Raw.Data); !strings.Contains(raw, "Subject: Hello") || !strings.Contains(raw, "Reply-To: <support@example.com>,\r\n \"Help\" <help@example.com>\r\n") {
+		t.Errorf("ses got raw message %q", payload.Content.Raw.Data)
+	}
+}
+
+func TestFailoverOnTransientError(t *testing.T) {
+	sendGrid := newFakeProvider(t, http.StatusServiceUnavailable)
+	mailgun := newFakeProvider(t, http.StatusTooManyRequests)
+	ses := newFakeProvider(t, http.StatusInternalServerError)
+	smtp := newFakeSMTP(t)
+
+	failover := &failoverSender{senders: []Sender{
+		&sendGridSender{url: sendGrid.URL, apiKey: "key"},
+		&mailgunSender{url: mailgun.URL, domain: "mg.example.com", apiKey: "key"},
+		&sesSender{url: ses.URL, region: "eu-west-1", accessKey: "AKID", secretKey: "secret"},
+		smtp.sender(),
+	}}
+
+	if err := failover.Send(testEmail()); err != nil {
+		t.Fatal(err)
+	}
+
+	if sendGrid.count() != 1 || mailgun.count() != 1 || ses.count() != 1 {
+		t.Errorf("providers got %d, %d and %d requests, want 1 each", sendGrid.count(), mailgun.count(), ses.count())
+	}
+	if sent := smtp.sent(); len(sent) != 1 || !strings.Contains(sent[0], "Subject: Hello") {
+		t.Errorf("smtp got %q", sent)
+	}
+}
+
+func TestFailoverGivesUp(t *testing.T) {
+	smtp := newFakeSMTP(t)
+	smtp.mailReply = "451 4.3.0 try again later"
+	sendGrid := newFakeProvider(t, http.StatusBadGateway)
+
+	failover := &failoverSender{senders: []Sender{
+		smtp.sender(),
+		&sendGridSender{url: sendGrid.URL, apiKey: "key"},
+	}}
+
+	err := failover.Send(testEmail())
+	if err == nil {
+		t.Fatal("sending succeeded, want an error")
+	}
+	if permanent(err) {
+		t.Errorf("%v is permanent, want it retried", err)
+	}
+	if sendGrid.count() != 1 {
+		t.Errorf("sendgrid got %d requests, want 1", sendGrid.count())
+	}
+}
+
+func TestFailoverOnServerRejection(t *testing.T) {
+	for _, reply := range []string{
+		"530 5.7.0 authentication required",
+		"535 5.7.8 authentication failed",
+		"550 5.7.1 relaying denied",
+		"554 5.7.1 client host rejected",
+	} {
+		t.Run(reply[:3], func(t *testing.T) {
+			smtp := newFakeSMTP(t)
+			smtp.mailReply = reply
+			next := newFakeProvider(t, http.StatusAccepted)
+
+			failover := &failoverSender{senders: []Sender{
+				smtp.sender(),
+				&sendGridSender{url: next.URL, apiKey: "key"},
+			}}
+
+			if err := failover.Send(testEmail()); err != nil {
+				t.Fatal(err)
+			}
+			if next.count() != 1 {
+				t.Errorf("sendgrid got %d requests, want 1", next.count())
+			}
+		})
+	}
+}
+
+func TestNoFailoverOnPermanentError(t *testing.T) {
+	tests := []struct {
+		name  string
+		first func(t *testing.T) Sender
+	}{
+		{
+			name: "sendgrid",
+			first: func(t *testing.T) Sender {
+				return &sendGridSender{url: newFakeProvider(t, http.StatusBadRequest).URL, apiKey: "key"}
+			},
+		},
+		{
+			name: "mailgun",
+			first: func(t *testing.T) Sender {
+				return &mailgunSender{url: newFakeProvider(t, http.StatusUnprocessableEntity).URL, domain: "mg.example.com", apiKey: "key"}
+			},
+		},
+		{
+			name: "ses",
+			first: func(t *testing.T) Sender {
+				return &sesSender{url: newFakeProvider(t, http.StatusBadRequest).URL, region: "eu-west-1", accessKey: "AKID", secretKey: "secret"}
+			},
+		},
+		{
+			name: "smtp",
+			first: func(t *testing.T) Sender {
+				smtp := newFakeSMTP(t)
+				smtp.mailReply = "550 5.1.1 mailbox unavailable"
+				return smtp.sender()
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			next := newFakeProvider(t, http.StatusAccepted)
+
+			failover := &failoverSender{senders: []Sender{
+				test.first(t),
+				&sendGridSender{url: next.URL, apiKey: "key"},
+			}}
+
+			err := failover.Send(testEmail())
+			if err == nil {
+				t.Fatal("sending succeeded, want a permanent error")
+			}
+			if !permanent(err) {
+				t.Errorf("%v is not permanent", err)
+			}
+			if next.count() != 0 {
+				t.Errorf("failed over after a permanent error")
+			}
+		})
+	}
+}
+
+func TestFileSender(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "sent")
+	t.Setenv("MAIL_FILE_DIR", dir)
+
+	sender := createFileSender()
+	if err := sender.Send(testEmail()); err != nil {
+		t.Fatal(err)
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 1 {
+		t.Fatalf("got %d .eml files, want 1", len(paths))
+	}
+
+	content, err := os.ReadFile(paths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"Subject: Hello", outboxIDHeader + ": 0123456789abcdef", "Hello Jane"} {
+		if !strings.Contains(string(content), want) {
+			t.Errorf("%s does not contain %q", paths[0], want)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"mail-service/data"
+	"os"
+	"strconv"
+	"time"
+
+	// PostgreSQL driver
+	_ "github.com/jackc/pgx/v4/stdlib"
+)
+
+const (
+	// defaultOutboxDir is where the file store keeps the messages when
+	// OUTBOX_DIR is not set
+	defaultOutboxDir = "/var/lib/mail/outbox"
+
+	// maxCount is the maximum number of times connecting to the
+	// database is attempted
+	maxCount = 10
+
+	// timeInterval is the time between each attempt at connecting
+	// to the database
+	timeInterval = time.Second * 2
+)
+
+// openStore opens the outbox store selected by the OUTBOX_STORE environment
+// variable: file (the default), which keeps the messages in OUTBOX_DIR, or
+// postgres, which connects to DSN. It returns the store and a function
+// closing it
+func openStore() (data.Store, func()) {
+	switch os.Getenv("OUTBOX_STORE") {
+	case "", "file":
+		dir := os.Getenv("OUTBOX_DIR")
+		if dir == "" {
+			dir = defaultOutboxDir
+		}
+
+		store, err := data.NewFileStore(dir)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		log.Println("Keeping the outbox in", dir)
+
+		return store, func() {}
+
+	case "postgres":
+		conn := connectToDB()
+		if conn == nil {
+			log.Panic("Can't connect to Postgres!")
+		}
+
+		store, err := data.NewPostgresStore(conn)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		closeStore := func() {
+			if err := conn.Close(); err != nil {
+				log.Println("Error closing Postgres connection:", err)
+			}
+		}
+
+		return store, closeStore
+
+	default:
+		log.Panicf("OUTBOX_STORE must be either file or postgres, got %q", os.Getenv("OUTBOX_STORE"))
+		return nil, nil
+	}
+}
+
+// envString reads an environment variable, returning fallback when it is not
+// set
+func envString(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+
+	return fallback
+}
+
+// requireEnv reads an environment variable that must be set
+func requireEnv(name string) string {
+	value := os.Getenv(name)
+	if value == "" {
+		log.Panicf("%s must be set", name)
+	}
+
+	return value
+}
+
+// envInt reads a positive integer from an environment variable, returning
+// fallback when it is not set
+func envInt(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		log.Panicf("%s must be a positive integer, got %q", name, value)
+	}
+
+	return n
+}
+
+// envDuration reads a duration such as "30s" from an environment variable,
+// returning fallback when it is not set
+func envDuration(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		log.Panicf("%s must be a positive duration, got %q", name, value)
+	}
+
+	return duration
+}
+
+func connectToDB() *sql.DB {
+	// count is the number of times connecting to the database is attempted
+	count := 0
+
+	dataSourceName := os.Getenv("DSN")
+
+	for {
+		connection, err := openDB(dataSourceName)
+		if err != nil {
+			log.Println("Postgres not yet ready...")
+			count++
+		} else {
+			log.Println("Connected to PostgreSQL!")
+			return connection
+		}
+
+		if count >= maxCount {
+			log.Println(err)
+			return nil
+		}
+
+		log.Println("Backing off for two seconds...")
+		time.Sleep(timeInterval)
+	}
+}
+
+func openDB(dataSourceName string) (*sql.DB, error) {
+	db, err := sql.Open("pgx", dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Ping()
+	if err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
@@ -0,0 +1,350 @@
+package data
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// suppressionsFile is the file of the suppression list in the directory of
+// the store. It has no .json extension, which would make it a message
+const suppressionsFile = "suppressions"
+
+// fileStore keeps every message as a JSON file in a directory, and all of
+// them in memory, as well as the suppression list in a file of its own.
+// Files are written to a temporary file first and renamed, so a crash never
+// leaves a message half written
+type fileStore struct {
+	dir string
+
+	mu           sync.Mutex
+	messages     map[string]*Message
+	suppressions map[string]*Suppression
+}
+
+// NewFileStore returns a store keeping the messages in dir, loading the
+// messages already there. It is meant for a single replica of the service
+func NewFileStore(dir string) (Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	s := &fileStore{
+		dir:          dir,
+		messages:     make(map[string]*Message),
+		suppressions: make(map[string]*Suppression),
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range paths {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		var msg Message
+		if err = json.Unmarshal(content, &msg); err != nil {
+			log.Printf("Error reading message %s: %v\n", path, err)
+			continue
+		}
+
+		s.messages[msg.ID] = &msg
+	}
+
+	content, err := os.ReadFile(filepath.Join(dir, suppressionsFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		var suppressions []*Suppression
+		if err = json.Unmarshal(content, &suppressions); err != nil {
+			return nil, err
+		}
+
+		for _, suppression := range suppressions {
+			s.suppressions[suppression.Address] = suppression
+		}
+	}
+
+	return s, nil
+}
+
+func (s *fileStore) Insert(msg *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.write(msg); err != nil {
+		return err
+	}
+
+	stored := *msg
+	s.messages[msg.ID] = &stored
+
+	return nil
+}
+
+func (s *fileStore) Get(id string) (*Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msg, ok := s.messages[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	found := *msg
+	return &found, nil
+}
+
+func (s *fileStore) Update(msg *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.messages[msg.ID]; !ok {
+		return ErrNotFound
+	}
+
+	if err := s.write(msg); err != nil {
+		return err
+	}
+
+	stored := *msg
+	s.messages[msg.ID] = &stored
+
+	return nil
+}
+
+func (s *fileStore) Claim(now time.Time, lease time.Duration) (*Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var next *Message
+	for _, msg := range s.messages {
+		if msg.due(now) && (next == nil || msg.NextAttemptAt.Before(next.NextAttemptAt)) {
+			next = msg
+		}
+	}
+
+	if next == nil {
+		return nil, nil
+	}
+
+	claimed := *next
+	claimed.claim(now, lease)
+
+	if err := s.write(&claimed); err != nil {
+		return nil, err
+	}
+
+	*next = claimed
+
+	return &claimed, nil
+}
+
+func (s *fileStore) Cancel(id string, now time.Time) (*Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msg, ok := s.messages[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	canceled := *msg
+	if err := canceled.cancel(now); err != nil {
+		return nil, err
+	}
+
+	if err := s.write(&canceled); err != nil {
+		return nil, err
+	}
+
+	*msg = canceled
+
+	return &canceled, nil
+}
+
+func (s *fileStore) DeleteFinished(before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var deleted int64
+	for id, msg := range s.messages {
+		if !msg.finished() || !msg.UpdatedAt.Before(before) {
+			continue
+		}
+
+		err := os.Remove(s.path(id))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Println("Error removing message:", err)
+			return deleted, err
+		}
+
+		delete(s.messages, id)
+		deleted++
+	}
+
+	return deleted, nil
+}
+
+func (s *fileStore) SetRecipient(id string, recipient Recipient) (*Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msg, ok := s.messages[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	updated := *msg
+	updated.Recipients = append([]Recipient(nil), msg.Recipients...)
+	updated.setRecipient(recipient)
+
+	if err := s.write(&updated); err != nil {
+		return nil, err
+	}
+
+	*msg = updated
+
+	return &updated, nil
+}
+
+func (s *fileStore) Suppress(suppression *Suppression) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous, existed := s.suppressions[suppression.Address]
+
+	stored := *suppression
+	s.suppressions[suppression.Address] = &stored
+
+	if err := s.writeSuppressions(); err != nil {
+		if existed {
+			s.suppressions[suppression.Address] = previous
+		} else {
+			delete(s.suppressions, suppression.Address)
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (s *fileStore) Unsuppress(address string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous, ok := s.suppressions[address]
+	if !ok {
+		return ErrNotFound
+	}
+
+	delete(s.suppressions, address)
+
+	if err := s.writeSuppressions(); err != nil {
+		s.suppressions[address] = previous
+		return err
+	}
+
+	return nil
+}
+
+func (s *fileStore) Suppressions(addresses ...string) ([]*Suppression, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var found []*Suppression
+	if len(addresses) == 0 {
+		for _, suppression := range s.suppressions {
+			copied := *suppression
+			found = append(found, &copied)
+		}
+	}
+	for _, address := range addresses {
+		if suppression, ok := s.suppressions[address]; ok {
+			copied := *suppression
+			found = append(found, &copied)
+		}
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].Address < found[j].Address
+	})
+
+	return found, nil
+}
+
+// write saves a message to its file. The caller holds mu
+func (s *fileStore) write(msg *Message) error {
+	content, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	if err = s.writeFile(s.path(msg.ID), content); err != nil {
+		log.Println("Error writing message:", err)
+		return err
+	}
+
+	return nil
+}
+
+// writeSuppressions saves the suppression list to its file. The caller
+// holds mu
+func (s *fileStore) writeSuppressions() error {
+	suppressions := make([]*Suppression, 0, len(s.suppressions))
+	for _, suppression := range s.suppressions {
+		suppressions = append(suppressions, suppression)
+	}
+
+	content, err := json.Marshal(suppressions)
+	if err != nil {
+		return err
+	}
+
+	if err = s.writeFile(filepath.Join(s.dir, suppressionsFile), content); err != nil {
+		log.Println("Error writing suppression list:", err)
+		return err
+	}
+
+	return nil
+}
+
+// writeFile writes a file through a temporary file renamed in its place
+func (s *fileStore) writeFile(path string, content []byte) error {
+	tmp, err := os.CreateTemp(s.dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err = tmp.Write(content); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	return nil
+}
+
+func (s *fileStore) path(id string) string {
+	// ids are generated, but never let one escape the directory
+	return filepath.Join(s.dir, strings.ReplaceAll(id, string(filepath.Separator), "_")+".json")
+}
@@ -0,0 +1,361 @@
+package data
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// Message statuses. A queued message waits for its next attempt, a sending
+// message is held by a worker until its lease expires, and sent, failed and
+// canceled messages are final
+const (
+	StatusQueued   = "queued"
+	StatusSending  = "sending"
+	StatusSent     = "sent"
+	StatusFailed   = "failed"
+	StatusCanceled = "canceled"
+)
+
+// Recipient statuses. A pending recipient waits for the message to be sent.
+// The DSNs sent back for a message tell whether it was then delivered to a
+// recipient, delayed or bounced, and the complaints whether the recipient
+// marked it as spam
+const (
+	RecipientPending    = "pending"
+	RecipientSuppressed = "suppressed"
+	RecipientSent       = "sent"
+	RecipientFailed     = "failed"
+	RecipientDelivered  = "delivered"
+	RecipientDelayed    = "delayed"
+	RecipientBounced    = "bounced"
+	RecipientComplained = "complained"
+)
+
+// Suppression reasons
+const (
+	ReasonManual      = "manual"
+	ReasonUnsubscribe = "unsubscribe"
+	ReasonBounce      = "bounce"
+	ReasonComplaint   = "complaint"
+)
+
+// SuppressionReasons are the valid reasons of a suppression
+var SuppressionReasons = []string{ReasonManual, ReasonUnsubscribe, ReasonBounce, ReasonComplaint}
+
+// store is where the models keep their data, set by New
+var store Store
+
+// Models is the type for this package. Any model that is included as a member
+// in this type is available throughout the application, anywhere that the app
+// variable is used, provided that the model is also added in the New function
+type Models struct {
+	Message     Message
+	Suppression Suppression
+}
+
+// Message is one email in the outbox, together with the state of its
+// delivery
+type Message struct {
+	ID       string    `json:"id"`
+	From     string    `json:"from"`
+	FromName string    `json:"from_name,omitempty"`
+	To       Addresses `json:"to"`
+	Cc       Addresses `json:"cc,omitempty"`
+	Bcc      Addresses `json:"bcc,omitempty"`
+	ReplyTo  Addresses `json:"reply_to,omitempty"`
+	Subject  string    `json:"subject"`
+	Body     string    `json:"message,omitempty"`
+	// Template is the name of the template rendering the message, with the
+	// variables of Data
+	Template string         `json:"template,omitempty"`
+	Data     map[string]any `json:"data,omitempty"`
+	// Attachments are kept in files until the message has been sent or has
+	// failed for good
+	Attachments []Attachment `json:"attachments,omitempty"`
+
+	// SendAt is when the message was asked to be sent first, nil to send it
+	// right away
+	SendAt *time.Time `json:"send_at,omitempty"`
+	// Cron is the cron expression of a recurring message, which is queued
+	// again for its next occurrence, in the Timezone location, after every
+	// send
+	Cron     string `json:"cron,omitempty"`
+	Timezone string `json:"timezone,omitempty"`
+	// Occurrences is the number of times a recurring message went out, or
+	// failed for good
+	Occurrences int `json:"occurrences,omitempty"`
+
+	// Recipients is the status of every address of the last attempt, or of
+	// the last occurrence of a recurring message
+	Recipients []Recipient `json:"recipients,omitempty"`
+
+	Status   string `json:"status"`
+	Attempts int    `json:"attempts"`
+	// LastError is the error of the last failed attempt, as returned by the
+	// SMTP server
+	LastError string `json:"last_error,omitempty"`
+	// NextAttemptAt is when a queued message is sent next, or when the lease
+	// of the worker sending it expires
+	NextAttemptAt time.Time  `json:"next_attempt_at"`
+	SentAt        *time.Time `json:"sent_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+// Attachment is a file attached to a message. Inline attachments are images
+// shown by the HTML version of the message, which references them by name as
+// cid:<name>
+type Attachment struct {
+	Name        string `json:"name"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	Inline      bool   `json:"inline,omitempty"`
+	Path        string `json:"path"`
+}
+
+// Recipient is the delivery status of one address of a message
+type Recipient struct {
+	Address string `json:"address"`
+	Status  string `json:"status"`
+	// Reason says why the message was not sent to the address, or what
+	// the DSN of the address said
+	Reason    string    `json:"reason,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Suppression is an address never sent to again, until it is removed from
+// the suppression list
+type Suppression struct {
+	Address string `json:"address"`
+	Reason  string `json:"reason"`
+	// Detail is the diagnostic of a bounce or a note given with a manual
+	// suppression
+	Detail string `json:"detail,omitempty"`
+	// MessageID is the message that bounced or was complained about
+	MessageID string    `json:"message_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Addresses is a list of email addresses. In JSON it is an array, or a single
+// string for one address
+type Addresses []string
+
+// UnmarshalJSON accepts both an array and a single string, as the messages
+// used to have only one recipient
+func (a *Addresses) UnmarshalJSON(b []byte) error {
+	var address string
+	if err := json.Unmarshal(b, &address); err == nil {
+		*a = nil
+		if address != "" {
+			*a = Addresses{address}
+		}
+		return nil
+	}
+
+	var addresses []string
+	if err := json.Unmarshal(b, &addresses); err != nil {
+		return err
+	}
+
+	*a = addresses
+
+	return nil
+}
+
+// String joins the addresses with commas, as in an address header
+func (a Addresses) String() string {
+	return strings.Join(a, ", ")
+}
+
+// New creates an instance of the data package. It returns the type
+// Models, which embeds all the types needed for the application
+func New(s Store) Models {
+	store = s
+
+	return Models{
+		Message:     Message{},
+		Suppression: Suppression{},
+	}
+}
+
+// Enqueue stores a new message, to be sent as soon as a worker is free or at
+// its SendAt time, and returns it with its id
+func (m *Message) Enqueue(msg Message) (*Message, error) {
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+
+	msg.ID = id
+	msg.Status = StatusQueued
+	msg.Attempts = 0
+	msg.LastError = ""
+	msg.NextAttemptAt = now
+	if msg.SendAt != nil && msg.SendAt.After(now) {
+		msg.NextAttemptAt = msg.SendAt.UTC()
+	}
+	msg.Occurrences = 0
+	msg.SentAt = nil
+	msg.CreatedAt = now
+	msg.UpdatedAt = now
+
+	if err = store.Insert(&msg); err != nil {
+		return nil, err
+	}
+
+	return &msg, nil
+}
+
+// GetOne returns one message by id, or ErrNotFound
+func (m *Message) GetOne(id string) (*Message, error) {
+	return store.Get(id)
+}
+
+// Claim takes the message whose next attempt is the most overdue and leases
+// it to the caller, who has until lease has passed to report the outcome. It
+// returns nil when no message is due
+func (m *Message) Claim(lease time.Duration) (*Message, error) {
+	return store.Claim(time.Now().UTC(), lease)
+}
+
+// MarkSent records the successful delivery of a claimed message
+func (m *Message) MarkSent(msg *Message) error {
+	now := time.Now().UTC()
+
+	msg.Status = StatusSent
+	msg.Attempts++
+	msg.LastError = ""
+	msg.SentAt = &now
+	msg.UpdatedAt = now
+
+	return store.Update(msg)
+}
+
+// MarkFailed records a failed attempt at delivering a claimed message. The
+// message is attempted again at retryAt, unless retryAt is zero in which case
+// it has failed for good
+func (m *Message) MarkFailed(msg *Message, sendErr error, retryAt time.Time) error {
+	msg.Attempts++
+	msg.LastError = sendErr.Error()
+	msg.UpdatedAt = time.Now().UTC()
+
+	if retryAt.IsZero() {
+		msg.Status = StatusFailed
+	} else {
+		msg.Status = StatusQueued
+		msg.NextAttemptAt = retryAt.UTC()
+	}
+
+	return store.Update(msg)
+}
+
+// Recur queues a recurring message again for its next occurrence, after it
+// has been sent or has failed for good, in which case sendErr is the error
+// of the last attempt
+func (m *Message) Recur(msg *Message, sendErr error, next time.Time) error {
+	now := time.Now().UTC()
+
+	msg.Status = StatusQueued
+	msg.Attempts = 0
+	msg.Occurrences++
+	msg.NextAttemptAt = next.UTC()
+	msg.UpdatedAt = now
+
+	if sendErr == nil {
+		msg.LastError = ""
+		msg.SentAt = &now
+	} else {
+		msg.LastError = sendErr.Error()
+	}
+
+	return store.Update(msg)
+}
+
+// Cancel cancels a queued message, which is then never sent, and returns it.
+// It returns ErrNotFound when the message does not exist, and
+// ErrNotCancelable when it is being sent or is already final
+func (m *Message) Cancel(id string) (*Message, error) {
+	return store.Cancel(id, time.Now().UTC())
+}
+
+// SetRecipient records the status of a recipient of a message, as reported
+// by a DSN, and returns the message. It returns ErrNotFound when the message
+// does not exist
+func (m *Message) SetRecipient(id string, recipient Recipient) (*Message, error) {
+	recipient.Address = NormalizeAddress(recipient.Address)
+	recipient.UpdatedAt = time.Now().UTC()
+
+	return store.SetRecipient(id, recipient)
+}
+
+// Prune deletes the sent, failed and canceled messages last updated before the given
+// time, and returns how many were deleted
+func (m *Message) Prune(before time.Time) (int64, error) {
+	return store.DeleteFinished(before)
+}
+
+// Add adds an address to the suppression list, replacing its entry when it
+// is already suppressed, and returns the new entry
+func (s *Suppression) Add(suppression Suppression) (*Suppression, error) {
+	suppression.Address = NormalizeAddress(suppression.Address)
+	suppression.CreatedAt = time.Now().UTC()
+
+	if err := store.Suppress(&suppression); err != nil {
+		return nil, err
+	}
+
+	return &suppression, nil
+}
+
+// Remove removes an address from the suppression list, so that it is sent
+// to again. It returns ErrNotFound when the address is not suppressed
+func (s *Suppression) Remove(address string) error {
+	return store.Unsuppress(NormalizeAddress(address))
+}
+
+// GetAll returns the suppression list, sorted by address
+func (s *Suppression) GetAll() ([]*Suppression, error) {
+	return store.Suppressions()
+}
+
+// Find returns the entries of the suppressed addresses among the given ones,
+// by normalized address
+func (s *Suppression) Find(addresses []string) (map[string]*Suppression, error) {
+	normalized := make([]string, len(addresses))
+	for i, address := range addresses {
+		normalized[i] = NormalizeAddress(address)
+	}
+
+	suppressions, err := store.Suppressions(normalized...)
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[string]*Suppression, len(suppressions))
+	for _, suppression := range suppressions {
+		found[suppression.Address] = suppression
+	}
+
+	return found, nil
+}
+
+// NormalizeAddress returns the form of a bare address under which it is
+// suppressed and its recipient status is recorded
+func NormalizeAddress(address string) string {
+	return strings.ToLower(strings.TrimSpace(address))
+}
+
+// newID returns a random id of 32 hexadecimal characters
+func newID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(id), nil
+}
@@ -0,0 +1,360 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+)
+
+const dbTimeout = time.Second * 3
+
+// postgresSchema creates the messages and suppressions tables. The message
+// itself is kept as JSON, the columns only serve to find the messages to
+// send and to prune
+const postgresSchema = `
+	CREATE TABLE IF NOT EXISTS messages (
+		id text PRIMARY KEY,
+		status text NOT NULL,
+		next_attempt_at timestamptz NOT NULL,
+		updated_at timestamptz NOT NULL,
+		message jsonb NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS messages_status_next_attempt_at ON messages (status, next_attempt_at);
+
+	CREATE TABLE IF NOT EXISTS suppressions (
+		address text PRIMARY KEY,
+		reason text NOT NULL,
+		detail text NOT NULL,
+		message_id text NOT NULL,
+		created_at timestamptz NOT NULL
+	);
+`
+
+// postgresStore keeps the messages in the messages table. Several replicas of
+// the service may share it
+type postgresStore struct {
+	db *sql.DB
+}
+
+// NewPostgresStore returns a store backed by PostgreSQL, creating its table
+// when it does not exist yet
+func NewPostgresStore(db *sql.DB) (Store, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	if _, err := db.ExecContext(ctx, postgresSchema); err != nil {
+		log.Println("Error creating messages table:", err)
+		return nil, err
+	}
+
+	return &postgresStore{db: db}, nil
+}
+
+func (s *postgresStore) Insert(msg *Message) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	content, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	query := `
+	INSERT INTO messages
+		(id, status, next_attempt_at, updated_at, message)
+	VALUES
+		($1, $2, $3, $4, $5)
+	`
+
+	_, err = s.db.ExecContext(ctx, query, msg.ID, msg.Status, msg.NextAttemptAt, msg.UpdatedAt, string(content))
+	if err != nil {
+		log.Println("Error inserting message:", err)
+		return err
+	}
+
+	return nil
+}
+
+func (s *postgresStore) Get(id string) (*Message, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	row := s.db.QueryRowContext(ctx, `SELECT message FROM messages WHERE id = $1`, id)
+
+	msg, err := scanMessage(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		log.Println("Error retrieving message:", err)
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+func (s *postgresStore) Update(msg *Message) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	return s.update(ctx, s.db, msg)
+}
+
+// Claim locks the due message with SKIP LOCKED, so that the workers of every
+// replica claim different messages
+func (s *postgresStore) Claim(now time.Time, lease time.Duration) (*Message, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `
+	SELECT
+		message
+	FROM
+		messages
+	WHERE
+		status IN ($1, $2) AND next_attempt_at <= $3
+	ORDER BY
+		next_attempt_at
+	LIMIT 1
+	FOR UPDATE SKIP LOCKED
+	`
+
+	msg, err := scanMessage(tx.QueryRowContext(ctx, query, StatusQueued, StatusSending, now))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		log.Println("Error claiming message:", err)
+		return nil, err
+	}
+
+	msg.claim(now, lease)
+
+	if err = s.update(ctx, tx, msg); err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// Cancel locks the message, so that it is not claimed meanwhile
+func (s *postgresStore) Cancel(id string, now time.Time) (*Message, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	msg, err := scanMessage(tx.QueryRowContext(ctx, `SELECT message FROM messages WHERE id = $1 FOR UPDATE`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		log.Println("Error retrieving message:", err)
+		return nil, err
+	}
+
+	if err = msg.cancel(now); err != nil {
+		return nil, err
+	}
+
+	if err = s.update(ctx, tx, msg); err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+func (s *postgresStore) DeleteFinished(before time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `DELETE FROM messages WHERE status IN ($1, $2, $3) AND updated_at < $4`
+
+	result, err := s.db.ExecContext(ctx, query, StatusSent, StatusFailed, StatusCanceled, before)
+	if err != nil {
+		log.Println("Error deleting messages:", err)
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// SetRecipient locks the message, so that it is not updated meanwhile
+func (s *postgresStore) SetRecipient(id string, recipient Recipient) (*Message, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	msg, err := scanMessage(tx.QueryRowContext(ctx, `SELECT message FROM messages WHERE id = $1 FOR UPDATE`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		log.Println("Error retrieving message:", err)
+		return nil, err
+	}
+
+	msg.setRecipient(recipient)
+
+	if err = s.update(ctx, tx, msg); err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+func (s *postgresStore) Suppress(suppression *Suppression) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `
+	INSERT INTO suppressions
+		(address, reason, detail, message_id, created_at)
+	VALUES
+		($1, $2, $3, $4, $5)
+	ON CONFLICT (address) DO UPDATE SET
+		reason = EXCLUDED.reason,
+		detail = EXCLUDED.detail,
+		message_id = EXCLUDED.message_id,
+		created_at = EXCLUDED.created_at
+	`
+
+	_, err := s.db.ExecContext(ctx, query, suppression.Address, suppression.Reason, suppression.Detail, suppression.MessageID, suppression.CreatedAt)
+	if err != nil {
+		log.Println("Error inserting suppression:", err)
+		return err
+	}
+
+	return nil
+}
+
+func (s *postgresStore) Unsuppress(address string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	result, err := s.db.ExecContext(ctx, `DELETE FROM suppressions WHERE address = $1`, address)
+	if err != nil {
+		log.Println("Error deleting suppression:", err)
+		return err
+	}
+
+	if deleted, _ := result.RowsAffected(); deleted == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (s *postgresStore) Suppressions(addresses ...string) ([]*Suppression, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `SELECT address, reason, detail, message_id, created_at FROM suppressions ORDER BY address`
+	var args []any
+	if len(addresses) > 0 {
+		query = `SELECT address, reason, detail, message_id, created_at FROM suppressions WHERE address = ANY($1) ORDER BY address`
+		args = append(args, addresses)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		log.Println("Error retrieving suppressions:", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var suppressions []*Suppression
+	for rows.Next() {
+		var suppression Suppression
+		err = rows.Scan(&suppression.Address, &suppression.Reason, &suppression.Detail, &suppression.MessageID, &suppression.CreatedAt)
+		if err != nil {
+			log.Println("Error scanning suppression:", err)
+			return nil, err
+		}
+
+		suppressions = append(suppressions, &suppression)
+	}
+
+	return suppressions, rows.Err()
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+func (s *postgresStore) update(ctx context.Context, db execer, msg *Message) error {
+	content, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	query := `
+	UPDATE
+		messages
+	SET
+		status = $2,
+		next_attempt_at = $3,
+		updated_at = $4,
+		message = $5
+	WHERE
+		id = $1
+	`
+
+	result, err := db.ExecContext(ctx, query, msg.ID, msg.Status, msg.NextAttemptAt, msg.UpdatedAt, string(content))
+	if err != nil {
+		log.Printf("Error updating message with id of %s: %v\n", msg.ID, err)
+		return err
+	}
+
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func scanMessage(row *sql.Row) (*Message, error) {
+	var content []byte
+	if err := row.Scan(&content); err != nil {
+		return nil, err
+	}
+
+	var msg Message
+	if err := json.Unmarshal(content, &msg); err != nil {
+		return nil, err
+	}
+
+	return &msg, nil
+}
@@ -0,0 +1,91 @@
+package data
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned when a message does not exist
+	ErrNotFound = errors.New("not found")
+
+	// ErrNotCancelable is returned when canceling a message that is being
+	// sent, or that is already sent, failed or canceled
+	ErrNotCancelable = errors.New("message can no longer be canceled")
+)
+
+// Store keeps the messages of the outbox. The models stamp the ids, dates and
+// statuses of the messages before passing them to the store
+type Store interface {
+	Insert(msg *Message) error
+	Get(id string) (*Message, error)
+	// Update replaces the message with the same id
+	Update(msg *Message) error
+	// Claim marks the queued message whose next attempt is the most overdue,
+	// or a sending message whose lease has expired, as sending until now plus
+	// lease, and returns it. It returns nil when no message is due. A message
+	// is never claimed twice at once, even by different replicas
+	Claim(now time.Time, lease time.Duration) (*Message, error)
+	// Cancel marks a queued message as canceled and returns it, or returns
+	// ErrNotCancelable. The check and the update are atomic, so that a
+	// message is never both canceled and claimed
+	Cancel(id string, now time.Time) (*Message, error)
+	// DeleteFinished deletes the sent, failed and canceled messages last
+	// updated before the given time
+	DeleteFinished(before time.Time) (int64, error)
+	// SetRecipient replaces the status of the same address among the
+	// recipients of a message, or adds it, and returns the message. The
+	// update is atomic, so that it never undoes the update of a worker
+	SetRecipient(id string, recipient Recipient) (*Message, error)
+
+	// Suppress adds an address to the suppression list, replacing its entry
+	// when there is one
+	Suppress(suppression *Suppression) error
+	// Unsuppress removes an address from the suppression list, or returns
+	// ErrNotFound
+	Unsuppress(address string) error
+	// Suppressions returns the entries of the given addresses, or of every
+	// address when none is given, sorted by address
+	Suppressions(addresses ...string) ([]*Suppression, error)
+}
+
+// due reports whether a message may be claimed at now
+func (m *Message) due(now time.Time) bool {
+	return (m.Status == StatusQueued || m.Status == StatusSending) && !m.NextAttemptAt.After(now)
+}
+
+// finished reports whether a message is in a final status
+func (m *Message) finished() bool {
+	return m.Status == StatusSent || m.Status == StatusFailed || m.Status == StatusCanceled
+}
+
+// cancel marks the message as canceled at now, when it is queued
+func (m *Message) cancel(now time.Time) error {
+	if m.Status != StatusQueued {
+		return ErrNotCancelable
+	}
+
+	m.Status = StatusCanceled
+	m.UpdatedAt = now
+
+	return nil
+}
+
+// setRecipient replaces the status of the same address, or adds it
+func (m *Message) setRecipient(recipient Recipient) {
+	for i := range m.Recipients {
+		if m.Recipients[i].Address == recipient.Address {
+			m.Recipients[i] = recipient
+			return
+		}
+	}
+
+	m.Recipients = append(m.Recipients, recipient)
+}
+
+// claim leases the message until now plus lease
+func (m *Message) claim(now time.Time, lease time.Duration) {
+	m.Status = StatusSending
+	m.NextAttemptAt = now.Add(lease)
+	m.UpdatedAt = now
+}
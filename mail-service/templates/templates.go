@@ -0,0 +1,209 @@
+// Package templates renders the emails sent by the mail-service. An email
+// template is named after its files, <name>.html.gohtml and
+// <name>.plain.gohtml, one of which may be missing. Both define a "body"
+// template, which may use the templates defined in the layouts and partials
+// directories by the files of the same kind. Either file may also define a
+// "subject" template, the plain text one taking precedence. Every variable a
+// template uses must be given, a missing one is an error rather than an
+// empty string
+package templates
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	texttemplate "text/template"
+)
+
+const (
+	htmlSuffix  = ".html.gohtml"
+	plainSuffix = ".plain.gohtml"
+
+	// bodyTemplate is the template executed to render an email
+	bodyTemplate = "body"
+
+	// subjectTemplate is the optional template rendering the subject
+	subjectTemplate = "subject"
+)
+
+var (
+	// ErrUnknownTemplate is returned when rendering a template that does not
+	// exist
+	ErrUnknownTemplate = errors.New("unknown template")
+
+	// ErrMissingVariable is returned when the data given to a template lacks
+	// one of the variables it uses
+	ErrMissingVariable = errors.New("missing template variable")
+)
+
+// Embedded holds the templates built into the service
+//
+//go:embed *.gohtml layouts/*.gohtml partials/*.gohtml
+var Embedded embed.FS
+
+// missingKey extracts the name of the missing variable from the errors of
+// the template packages
+var missingKey = regexp.MustCompile(`map has no entry for key "([^"]*)"`)
+
+// Rendered is an email rendered by a template. The parts the template does
+// not have are empty
+type Rendered struct {
+	Subject string `json:"subject"`
+	HTML    string `json:"html"`
+	Plain   string `json:"plain"`
+}
+
+// Registry holds the parsed templates, by name
+type Registry struct {
+	html  map[string]*htmltemplate.Template
+	plain map[string]*texttemplate.Template
+}
+
+// Load parses every template found in fsys
+func Load(fsys fs.FS) (*Registry, error) {
+	htmlBase := htmltemplate.New("").Option("missingkey=error")
+	plainBase := texttemplate.New("").Option("missingkey=error")
+
+	for _, dir := range []string{"layouts", "partials"} {
+		files, err := fs.Glob(fsys, path.Join(dir, "*"+htmlSuffix))
+		if err != nil {
+			return nil, err
+		}
+		if len(files) > 0 {
+			if _, err = htmlBase.ParseFS(fsys, files...); err != nil {
+				return nil, err
+			}
+		}
+
+		files, err = fs.Glob(fsys, path.Join(dir, "*"+plainSuffix))
+		if err != nil {
+			return nil, err
+		}
+		if len(files) > 0 {
+			if _, err = plainBase.ParseFS(fsys, files...); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	r := &Registry{
+		html:  make(map[string]*htmltemplate.Template),
+		plain: make(map[string]*texttemplate.Template),
+	}
+
+	files, err := fs.Glob(fsys, "*.gohtml")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		switch {
+		case strings.HasSuffix(file, htmlSuffix):
+			t, err := htmlBase.Clone()
+			if err != nil {
+				return nil, err
+			}
+			if _, err = t.ParseFS(fsys, file); err != nil {
+				return nil, err
+			}
+			if t.Lookup(bodyTemplate) == nil {
+				return nil, fmt.Errorf("%s does not define %q", file, bodyTemplate)
+			}
+
+			r.html[strings.TrimSuffix(file, htmlSuffix)] = t
+
+		case strings.HasSuffix(file, plainSuffix):
+			t, err := plainBase.Clone()
+			if err != nil {
+				return nil, err
+			}
+			if _, err = t.ParseFS(fsys, file); err != nil {
+				return nil, err
+			}
+			if t.Lookup(bodyTemplate) == nil {
+				return nil, fmt.Errorf("%s does not define %q", file, bodyTemplate)
+			}
+
+			r.plain[strings.TrimSuffix(file, plainSuffix)] = t
+		}
+	}
+
+	return r, nil
+}
+
+// Names returns the names of the templates, sorted
+func (r *Registry) Names() []string {
+	var names []string
+	for name := range r.html {
+		names = append(names, name)
+	}
+	for name := range r.plain {
+		if _, ok := r.html[name]; !ok {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// Render renders the subject and the HTML and plain text versions of a
+// template
+func (r *Registry) Render(name string, data map[string]any) (*Rendered, error) {
+	htmlTemplate, hasHTML := r.html[name]
+	plainTemplate, hasPlain := r.plain[name]
+
+	if !hasHTML && !hasPlain {
+		return nil, fmt.Errorf("%w %q", ErrUnknownTemplate, name)
+	}
+
+	var html, plain, subject bytes.Buffer
+
+	if hasHTML {
+		if err := htmlTemplate.ExecuteTemplate(&html, bodyTemplate, data); err != nil {
+			return nil, renderError(name, err)
+		}
+	}
+
+	if hasPlain {
+		if err := plainTemplate.ExecuteTemplate(&plain, bodyTemplate, data); err != nil {
+			return nil, renderError(name, err)
+		}
+	}
+
+	switch {
+	case hasPlain && plainTemplate.Lookup(subjectTemplate) != nil:
+		if err := plainTemplate.ExecuteTemplate(&subject, subjectTemplate, data); err != nil {
+			return nil, renderError(name, err)
+		}
+	case hasHTML && htmlTemplate.Lookup(subjectTemplate) != nil:
+		// the subject is not HTML, but the escaping is harmless for the
+		// usual subjects
+		if err := htmlTemplate.ExecuteTemplate(&subject, subjectTemplate, data); err != nil {
+			return nil, renderError(name, err)
+		}
+	}
+
+	return &Rendered{
+		Subject: strings.TrimSpace(subject.String()),
+		HTML:    html.String(),
+		Plain:   plain.String(),
+	}, nil
+}
+
+// renderError names the missing variable when that is why rendering failed
+func renderError(name string, err error) error {
+	if match := missingKey.FindStringSubmatch(err.Error()); match != nil {
+		return fmt.Errorf("%w %q in template %q", ErrMissingVariable, match[1], name)
+	}
+
+	return fmt.Errorf("rendering template %q: %w", name, err)
+}